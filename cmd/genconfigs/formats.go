@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/hjson/hjson-go/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats
+const (
+	FORMAT_JSON    = "json"    // <name>.json
+	FORMAT_HJSON   = "hjson"   // <name>.conf, commented like -genconf of the daemon
+	FORMAT_YAML    = "yaml"    // <name>.yaml for provisioning tools, the daemon doesn't read YAML
+	FORMAT_MOBILE  = "mobile"  // <name>.json without a TUN interface, like GenerateConfigJSON of the mobile package
+	FORMAT_SYSTEMD = "systemd" // <name>/ with the config and a systemd unit, laid out like the root of the device
+	FORMAT_LAUNCHD = "launchd" // <name>/ with the config and a launchd plist, laid out like the root of the device
+)
+
+// outputFile is a file written for a node, relative to the output directory.
+type outputFile struct {
+	Name   string
+	Data   []byte
+	Config bool // holds the config of the node, and so its private key
+}
+
+const systemdUnit = `[Unit]
+Description=Yggdrasil Network
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ProtectHome=true
+ProtectSystem=true
+SyslogIdentifier=yggdrasil
+CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_BIND_SERVICE
+ExecStartPre=+-/sbin/modprobe tun
+ExecStart=/usr/bin/yggdrasil -useconffile %s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=always
+TimeoutStopSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const launchdPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>Label</key>
+  <string>yggdrasil</string>
+  <key>ProgramArguments</key>
+  <array>
+    <string>/usr/local/bin/yggdrasil</string>
+    <string>-useconffile</string>
+    <string>%s</string>
+    <string>-logto</string>
+    <string>/var/log/yggdrasil.log</string>
+  </array>
+  <key>KeepAlive</key>
+  <true/>
+  <key>RunAtLoad</key>
+  <true/>
+  <key>ProcessType</key>
+  <string>Interactive</string>
+</dict>
+</plist>
+`
+
+// checkFormat returns an error if format isn't one of the output formats.
+func checkFormat(format string) error {
+	switch format {
+	case FORMAT_JSON, FORMAT_HJSON, FORMAT_YAML, FORMAT_MOBILE, FORMAT_SYSTEMD, FORMAT_LAUNCHD:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// marshalHJSON marshals a config with the comments of its fields, like -genconf of the daemon.
+func marshalHJSON(c configOutput) ([]byte, error) {
+	data, err := hjson.Marshal(c)
+	return append(data, '\n'), err
+}
+
+// marshalYAML marshals a config to YAML, with the fields in the same order as in JSON.
+func marshalYAML(c configOutput) ([]byte, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML, read it as a node tree to keep the field order and drop its flow style
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var blockStyle func(n *yaml.Node)
+	blockStyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, child := range n.Content {
+			blockStyle(child)
+		}
+	}
+	blockStyle(&root)
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// renderOutputs returns the files of a node config in a format.
+func renderOutputs(name string, c configOutput, format string) ([]outputFile, error) {
+	switch format {
+	case FORMAT_JSON:
+		data, err := json.MarshalIndent(c, "", "  ")
+		return []outputFile{{Name: name + ".json", Data: data, Config: true}}, err
+	case FORMAT_HJSON:
+		data, err := marshalHJSON(c)
+		return []outputFile{{Name: name + ".conf", Data: data, Config: true}}, err
+	case FORMAT_YAML:
+		data, err := marshalYAML(c)
+		return []outputFile{{Name: name + ".yaml", Data: data, Config: true}}, err
+	case FORMAT_MOBILE:
+		nc := *c.NodeConfig
+		nc.IfName = "none"
+		c.NodeConfig = &nc
+		data, err := json.MarshalIndent(c, "", "  ")
+		return []outputFile{{Name: name + ".json", Data: data, Config: true}}, err
+	case FORMAT_SYSTEMD:
+		data, err := marshalHJSON(c)
+		configPath := "/etc/yggdrasil/yggdrasil.conf"
+		return []outputFile{
+			{Name: path.Join(name, configPath), Data: data, Config: true},
+			{Name: path.Join(name, "/etc/systemd/system/yggdrasil.service"), Data: fmt.Appendf(nil, systemdUnit, configPath)},
+		}, err
+	case FORMAT_LAUNCHD:
+		data, err := marshalHJSON(c)
+		configPath := "/etc/yggdrasil.conf"
+		return []outputFile{
+			{Name: path.Join(name, configPath), Data: data, Config: true},
+			{Name: path.Join(name, "/Library/LaunchDaemons/yggdrasil.plist"), Data: fmt.Appendf(nil, launchdPlist, configPath)},
+		}, err
+	}
+	return nil, checkFormat(format)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hjson/hjson-go/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"gopkg.in/yaml.v3"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+func testOutput() configOutput {
+	c := configOutput{NodeConfig: config.GenerateConfig(), ManagerConfig: &mconfig.ManagerConfig{}}
+	c.Peers = []string{"quic://hub.example.org:1000"}
+	c.Manager.Tags = []string{"laptops"}
+	c.Manager.Devices = []devices.Device{{Name: "hub", PublicKey: strings.Repeat("ab", 32), AddedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	return c
+}
+
+func TestRenderOutputs(t *testing.T) {
+	c := testOutput()
+	names := func(files []outputFile) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	files, err := renderOutputs("a", c, FORMAT_HJSON)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a.conf"}, names(files))
+		assert.Contains(t, string(files[0].Data), "# Your private key.", "HJSON keeps the comments of the fields")
+		assert.Contains(t, string(files[0].Data), "# Tags of this node")
+		parsed, parsedManager := config.GenerateConfig(), mconfig.ManagerConfig{}
+		if assert.NoError(t, parsed.UnmarshalHJSON(files[0].Data)) && assert.NoError(t, parsedManager.UnmarshalHJSON(files[0].Data)) {
+			assert.Equal(t, c.PrivateKey, parsed.PrivateKey)
+			assert.Equal(t, c.Peers, parsed.Peers)
+			assert.Equal(t, c.Manager.Devices, parsedManager.Manager.Devices)
+			assert.Equal(t, []string{"laptops"}, parsedManager.Manager.Tags)
+		}
+	}
+
+	files, err = renderOutputs("a", c, FORMAT_YAML)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a.yaml"}, names(files))
+		assert.True(t, strings.HasPrefix(string(files[0].Data), "PrivateKey: "), "fields keep the JSON order")
+		assert.Contains(t, string(files[0].Data), "\nPeers:\n  - quic://hub.example.org:1000\n", "block style")
+		var parsed, expected any
+		jsonData, _ := json.Marshal(c)
+		if assert.NoError(t, yaml.Unmarshal(files[0].Data, &parsed)) && assert.NoError(t, yaml.Unmarshal(jsonData, &expected)) {
+			assert.Equal(t, expected, parsed, "the YAML holds the same config as the JSON")
+		}
+	}
+
+	files, err = renderOutputs("a", c, FORMAT_MOBILE)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a.json"}, names(files))
+		assert.Contains(t, string(files[0].Data), `"IfName": "none"`)
+		assert.NotEqual(t, "none", c.IfName, "the config of the node isn't changed")
+	}
+
+	files, err = renderOutputs("a", c, FORMAT_SYSTEMD)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a/etc/yggdrasil/yggdrasil.conf", "a/etc/systemd/system/yggdrasil.service"}, names(files))
+		assert.True(t, files[0].Config)
+		assert.False(t, files[1].Config)
+		assert.Contains(t, string(files[1].Data), "ExecStart=/usr/bin/yggdrasil -useconffile /etc/yggdrasil/yggdrasil.conf\n")
+	}
+
+	files, err = renderOutputs("a", c, FORMAT_LAUNCHD)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a/etc/yggdrasil.conf", "a/Library/LaunchDaemons/yggdrasil.plist"}, names(files))
+		assert.Contains(t, string(files[1].Data), "<string>/etc/yggdrasil.conf</string>")
+	}
+
+	_, err = renderOutputs("a", c, "rpm")
+	assert.EqualError(t, err, `unknown output format "rpm"`)
+}
+
+func TestExampleInput(t *testing.T) {
+	example, err := hjson.Marshal(exampleInput())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(string(example), "{\n  # How the nodes are linked"), "the example is commented")
+
+	var input fleetInput
+	if assert.NoError(t, hjson.Unmarshal(example, &input)) {
+		expected := exampleInput()
+		for i := range expected.Nodes {
+			expected.Nodes[i].MulticastInterfaces = []config.MulticastInterfaceConfig{}
+		}
+		assert.Equal(t, expected, input, "the example reads back as input")
+		assert.NoError(t, checkListeners(input.Nodes, input.Topology))
+		links, err := buildLinks(input.Nodes, input.Topology)
+		if assert.NoError(t, err) {
+			assert.NoError(t, checkConnected(input.Nodes, links, nil))
+		}
+	}
+}
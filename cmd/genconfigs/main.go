@@ -1,61 +1,232 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
+	"filippo.io/age"
+	"github.com/hjson/hjson-go/v4"
+	"github.com/nermolov/yggdrasil-manager/src/confbundle"
 	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/peerindex"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
 )
 
 const PROTOCOL = "quic"
 
 type configInput struct {
-	Name                string `comment:"Unique name for the node, resulting config file will be named <name>.json"`
-	PrivateKey          config.KeyBytes
-	Listen              *configInputListen                `comment:"If set, the node will listen for incoming connections according to the provided options, and other nodes will be configured to connect to it"`
+	Name                string                            `comment:"Unique name for the node, the files generated for it are named after it"`
+	PrivateKey          config.KeyBytes                   `json:",omitempty" comment:"Private key of the node. If empty, it is kept in the state file, or generated for a new node."`
+	Tags                []string                          `json:",omitempty" comment:"Tags of the node, used by Manager.Policy in the generated configs"`
+	Listen              listenInputs                      `json:",omitempty" comment:"If set, the node will listen for incoming connections according to the provided options, and other nodes will be configured to connect to it. One listener, or a list of listeners on different transports."`
+	BundleRecipient     string                            `json:",omitempty" comment:"age recipient (X25519 public key, age1...) of the device, the config bundle of the node is sealed to with -bundle"`
+	BundlePassphrase    string                            `json:",omitempty" comment:"Passphrase the config bundle of the node is sealed to with -bundle, if it has no BundleRecipient"`
+	Format              string                            `json:",omitempty" comment:"Output format of the node: json, hjson, yaml, mobile, systemd or launchd. Defaults to -format."`
+	Transports          []string                          `json:",omitempty" comment:"Transports the node dials other nodes with, in order of preference, e.g. [\"quic\", \"tls\"]. Defaults to Topology.Transport."`
 	MulticastInterfaces []config.MulticastInterfaceConfig `comment:"Multicast interface configurations for the node. If empty, the default platform-specific multicast configuration will be used."`
 }
 
+// fleetInput is the input file, or only its Nodes in the original format of a plain list.
+type fleetInput struct {
+	Topology topologyInput `json:",omitempty" comment:"How the nodes are linked to each other"`
+	Nodes    []configInput `comment:"The nodes to generate configs for"`
+}
+
 type configInputListen struct {
+	Transport  string `json:",omitempty" comment:"Transport to listen on: quic, tcp, tls or ws. Defaults to Topology.Transport."`
 	Port       int    `comment:"Port to listen on"`
 	PublicHost string `comment:"Public hostname or IP address that other nodes will use to connect to this node"`
 	PublicPort int    `comment:"Public port that other nodes will use to connect to this node"`
 }
 
+// listenInputs are the listeners of a node, given as a list or as a single listener.
+type listenInputs []configInputListen
+
+func (l *listenInputs) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var listener configInputListen
+		if err := json.Unmarshal(data, &listener); err != nil {
+			return err
+		}
+		*l = listenInputs{listener}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]configInputListen)(l))
+}
+
 type configOutput struct {
 	*config.NodeConfig
 	*mconfig.ManagerConfig
 	// re-specify to set omitempty on marshal, allowing multicast auto-config at runtime
-	MulticastInterfaces []config.MulticastInterfaceConfig `json:",omitempty"`
+	MulticastInterfaces []config.MulticastInterfaceConfig `json:",omitempty" comment:"Configuration for which interfaces multicast peer discovery should be\nenabled on. If empty, the default platform-specific configuration is\nused at runtime."`
+}
+
+// exampleInput is the input printed by -geninput.
+func exampleInput() fleetInput {
+	return fleetInput{
+		Topology: topologyInput{
+			Mode:      TOPOLOGY_HUB,
+			Hubs:      []string{"server"},
+			Transport: PROTOCOL,
+			Links:     []linkInput{{From: "laptop", To: "desktop", Transport: "tls", Priority: 1, Interface: "en0"}},
+		},
+		Nodes: []configInput{
+			{
+				Name:   "server",
+				Tags:   []string{"servers"},
+				Listen: listenInputs{{Transport: "quic", Port: 443, PublicHost: "server.example.org", PublicPort: 443}, {Transport: "tls", Port: 443, PublicHost: "server.example.org", PublicPort: 443}},
+				Format: FORMAT_SYSTEMD,
+			},
+			{
+				Name:            "desktop",
+				Tags:            []string{"desktops"},
+				Listen:          listenInputs{{Transport: "tls", Port: 9001, PublicHost: "192.168.1.10", PublicPort: 9001}},
+				Transports:      []string{"quic", "tls"},
+				Format:          FORMAT_HJSON,
+				BundleRecipient: "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p",
+			},
+			{
+				Name:       "laptop",
+				Tags:       []string{"laptops"},
+				Transports: []string{"quic", "tls"},
+				Format:     FORMAT_LAUNCHD,
+			},
+			{
+				Name:             "phone",
+				Tags:             []string{"phones"},
+				Format:           FORMAT_MOBILE,
+				BundlePassphrase: "correct horse battery staple",
+			},
+		},
+	}
+}
+
+// format returns the output format of the node.
+func (n configInput) format(defaultFormat string) string {
+	if n.Format == "" {
+		return defaultFormat
+	}
+	return n.Format
 }
 
 func main() {
 	inputFile := flag.String("input", "", "config input json file path")
 	outputDir := flag.String("output", "", "config output directory path")
+	privateMesh := flag.Bool("privatemesh", false, "only let the nodes peer with each other, public peers are used as last-resort relays")
+	peerIndex := flag.String("peerindex", peerindex.DefaultURL, "public peer index: URL or local file of the index page, the public-peers JSON format or a list of peer URIs")
+	countries := flag.String("countries", PEER_COUNTRY, "comma-separated country sections of the peer index, all if empty")
+	peerCount := flag.Int("peercount", PEER_PUBLIC_COUNT, "number of public peers to select, 0 to skip the peer index")
+	transports := flag.String("transports", "", "comma-separated transports public peers may use, e.g. quic,tls, defaults to the transports all nodes dial")
+	stateFile := flag.String("state", "", "state file keeping the node keys between runs, defaults to "+STATE_FILE+" next to the input file. It holds the private keys of all nodes, keep it secret and out of the output directory")
+	format := flag.String("format", FORMAT_JSON, "output format of nodes without a Format: json, hjson, yaml, mobile, systemd or launchd")
+	genInput := flag.Bool("geninput", false, "print a commented example input in HJSON to stdout")
+	bundle := flag.Bool("bundle", false, "seal each config into an encrypted <name>.json.age bundle for -useconfbundle, to the BundleRecipient or BundlePassphrase of the node, instead of writing plaintext JSON")
+	dryRun := flag.Bool("dryrun", false, "only show what would change in the config files, without writing anything")
+	measure := flag.Bool("measure", true, "select the public peers with the lowest ping latency, otherwise the first ones in the index")
 	flag.Parse()
+	if *genInput {
+		example, err := hjson.Marshal(exampleInput())
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(example))
+		return
+	}
 	if *inputFile == "" || *outputDir == "" {
 		panic("input config file path and output directory path are required")
 	}
 
 	// read config input
-	f, err := os.Open(*inputFile)
+	data, err := os.ReadFile(*inputFile)
 	if err != nil {
 		panic(err)
 	}
-	defer f.Close()
+	var input fleetInput
+	if err := hjson.Unmarshal(data, &input); err != nil {
+		// the original format, a list of nodes
+		if listErr := hjson.Unmarshal(data, &input.Nodes); listErr != nil {
+			panic(err)
+		}
+	}
+	inputConfigs := input.Nodes
+	for _, n := range inputConfigs {
+		if err := checkFormat(n.format(*format)); err != nil {
+			panic(fmt.Sprintf("invalid format for node %s: %v", n.Name, err))
+		}
+		if *bundle && !slices.Contains([]string{FORMAT_JSON, FORMAT_HJSON, FORMAT_MOBILE}, n.format(*format)) {
+			panic(fmt.Sprintf("node %s: the %s format can't be sealed into a bundle", n.Name, n.format(*format)))
+		}
+	}
+
+	// check the bundle recipients, before writing anything
+	recipients := map[string]age.Recipient{}
+	if *bundle {
+		for _, n := range inputConfigs {
+			if recipients[n.Name], err = confbundle.Recipient(n.BundleRecipient, n.BundlePassphrase); err != nil {
+				panic(fmt.Sprintf("invalid bundle recipient for node %s: %v", n.Name, err))
+			}
+		}
+	}
 
-	var inputConfigs []configInput
-	if err := json.NewDecoder(f).Decode(&inputConfigs); err != nil {
+	// keep the identities of known nodes, generate them for new ones
+	if *stateFile == "" {
+		*stateFile = filepath.Join(filepath.Dir(*inputFile), STATE_FILE)
+	}
+	if err := checkStatePath(*stateFile, *outputDir); err != nil {
+		panic(err)
+	}
+	state, err := loadState(*stateFile)
+	if err != nil {
+		panic(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := state.assignIdentities(inputConfigs, now); err != nil {
 		panic(err)
 	}
 
-	publicPeers := selectPublicPeers()
+	// lay out the links, before writing anything
+	if err := checkListeners(inputConfigs, input.Topology); err != nil {
+		panic(fmt.Sprintf("invalid listeners: %v", err))
+	}
+	links, err := buildLinks(inputConfigs, input.Topology)
+	if err != nil {
+		panic(fmt.Sprintf("invalid topology: %v", err))
+	}
+	// public peers are dialed by every node
+	publicTransports := splitList(*transports)
+	if len(publicTransports) == 0 {
+		publicTransports = fleetTransports(inputConfigs, input.Topology)
+		if len(publicTransports) == 0 {
+			fmt.Println("The nodes dial no transport in common, no public peer qualifies")
+		}
+	}
+	publicPeers := selectPublicPeers(peerSelection{
+		Index:      *peerIndex,
+		Countries:  splitList(*countries),
+		Count:      *peerCount,
+		Transports: publicTransports,
+		Measure:    *measure,
+	})
+	if err := checkConnected(inputConfigs, links, publicPeers); err != nil {
+		if anyListens(inputConfigs) {
+			panic(err)
+		}
+		// devices behind NAT can still meet through peers configured by hand, or on the LAN
+		fmt.Printf("Warning: %v, no node has Listen set and no public peer was selected\n", err)
+	}
 
+	outputs := map[string]outputFile{}
+	changed := 0
 	for _, n := range inputConfigs {
 		configOutput := configOutput{}
 		configOutput.NodeConfig = config.GenerateConfig()
@@ -64,20 +235,29 @@ func main() {
 		// set private key
 		configOutput.NodeConfig.PrivateKey = n.PrivateKey
 		// if listener, configure listening
-		if n.Listen != nil {
-			configOutput.Listen = []string{fmt.Sprintf("%v://0.0.0.0:%v", PROTOCOL, n.Listen.Port)}
-		} else { // else connect to all other listening nodes
-			for _, on := range inputConfigs {
-				if on.Listen != nil {
-					configOutput.Peers = append(configOutput.Peers, fmt.Sprintf("%v://%v:%v", PROTOCOL, on.Listen.PublicHost, on.Listen.PublicPort))
-				}
+		if len(n.Listen) > 0 {
+			configOutput.Listen = listenURIs(n)
+		}
+		// dial the links from this node
+		for _, l := range links {
+			if l.From != n.Name {
+				continue
+			}
+			to := inputConfigs[slices.IndexFunc(inputConfigs, func(on configInput) bool { return on.Name == l.To })]
+			if l.Interface != "" {
+				configOutput.InterfacePeers[l.Interface] = append(configOutput.InterfacePeers[l.Interface], peerURI(l, to))
+			} else {
+				configOutput.Peers = append(configOutput.Peers, peerURI(l, to))
 			}
 		}
-		// add public peers
-		for _, peer := range publicPeers {
-			configOutput.Peers = append(configOutput.Peers, peer)
+		// add public peers, only as relays in a private mesh
+		if *privateMesh {
+			configOutput.Manager.PrivateMesh = true
+			configOutput.Manager.RelayPeers = publicPeers
+		} else {
+			configOutput.Peers = append(configOutput.Peers, publicPeers...)
 		}
-		// whitelist peers and connections
+		// add the other nodes as devices, the daemon allows them to peer and connect
 		for _, on := range inputConfigs {
 			if n.Name == on.Name {
 				continue
@@ -85,22 +265,109 @@ func main() {
 			privateKey := ed25519.PrivateKey(on.PrivateKey)
 			publicKey := privateKey.Public().(ed25519.PublicKey)
 
-			configOutput.Manager.FilterAllowedPublicKeys = append(configOutput.Manager.FilterAllowedPublicKeys, hex.EncodeToString(publicKey))
-			configOutput.NodeConfig.AllowedPublicKeys = configOutput.Manager.FilterAllowedPublicKeys
+			configOutput.Manager.Devices = append(configOutput.Manager.Devices, devices.Device{
+				Name:      on.Name,
+				PublicKey: hex.EncodeToString(publicKey),
+				Tags:      on.Tags,
+				AddedAt:   state.Nodes[on.Name].AddedAt,
+			})
 		}
+		configOutput.Manager.Tags = n.Tags
 		// set multicast interfaces
 		configOutput.MulticastInterfaces = n.MulticastInterfaces
 
-		// write config file to directory
-		output, err := json.MarshalIndent(configOutput, "", "  ")
+		// show what changes in the files of the node
+		files, err := renderOutputs(n.Name, configOutput, n.format(*format))
 		if err != nil {
 			panic(fmt.Sprintf("failed to marshal config output: %v\n", err))
 		}
-		outputPath := fmt.Sprintf("%s/%s.json", *outputDir, n.Name)
-		if err := os.WriteFile(outputPath, output, 0644); err != nil {
+		nodeChanged := false
+		for _, f := range files {
+			outputPath := filepath.Join(*outputDir, f.Name)
+			bundledTo := n.BundleRecipient
+			if *bundle && f.Config {
+				outputPath += ".age"
+				if bundledTo == "" {
+					bundledTo = "passphrase"
+				}
+			}
+			current, err := readConfig(outputPath)
+			if err != nil {
+				panic(fmt.Sprintf("failed to read config file %s: %v\n", outputPath, err))
+			}
+			if *bundle && f.Config {
+				// bundles can't be read back, they are compared with the config last sealed
+				if current != nil && state.Nodes[n.Name].BundledTo == bundledTo {
+					current = []byte(state.Nodes[n.Name].Bundled)
+				} else {
+					current = nil
+				}
+			}
+			diff, err := configDiff(outputPath, current, f.Data)
+			if err != nil {
+				panic(fmt.Sprintf("failed to compare config file %s: %v\n", outputPath, err))
+			}
+			if diff == "" {
+				continue
+			}
+			if !nodeChanged {
+				fmt.Printf("%s:\n", n.Name)
+				nodeChanged = true
+			}
+			fmt.Print(diff)
+			if *bundle && f.Config {
+				state.Nodes[n.Name].Bundled, state.Nodes[n.Name].BundledTo = redact(f.Data), bundledTo
+				if f.Data, err = confbundle.Seal(f.Data, recipients[n.Name]); err != nil {
+					panic(fmt.Sprintf("failed to seal config bundle %s: %v\n", outputPath, err))
+				}
+				f.Config = false // sealed
+			}
+			outputs[outputPath] = f
+		}
+		if !nodeChanged {
+			fmt.Printf("%s: unchanged\n", n.Name)
+			continue
+		}
+		changed++
+	}
+	for name := range state.Nodes {
+		if !slices.ContainsFunc(inputConfigs, func(n configInput) bool { return n.Name == name }) {
+			fmt.Printf("%s: no longer in the input, its config file is left in place and its key is kept in the state file\n", name)
+		}
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, %d of %d configs would change\n", changed, len(inputConfigs))
+		return
+	}
+
+	// write config files to directory, and the state once they are written. Plaintext configs
+	// hold the private key of the node.
+	for outputPath, output := range outputs {
+		mode := os.FileMode(0644)
+		if output.Config {
+			mode = 0600
+		}
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			panic(fmt.Sprintf("failed to create directory for %s: %v\n", outputPath, err))
+		}
+		if err := writeFile(outputPath, output.Data, mode); err != nil {
 			panic(fmt.Sprintf("failed to write config file %s: %v\n", outputPath, err))
 		}
 	}
+	if err := state.save(*stateFile); err != nil {
+		panic(fmt.Sprintf("failed to write state file %s: %v\n", *stateFile, err))
+	}
 
-	fmt.Printf("Configs written to %v\n", *outputDir)
+	fmt.Printf("%d of %d configs written to %v\n", changed, len(inputConfigs), *outputDir)
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -1,76 +1,40 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	probing "github.com/prometheus-community/pro-bing"
-	"golang.org/x/net/html"
+
+	"github.com/nermolov/yggdrasil-manager/src/peerindex"
 )
 
-const PEER_INDEX_URL = "https://publicpeers.neilalexander.dev/"
 const PEER_COUNTRY = "united-states"
 const PEER_PUBLIC_COUNT = 3
 
-func hasAttribute(node *html.Node, name, value string) bool {
-	if node.Type != html.ElementNode {
-		return false
-	}
-	for _, attr := range node.Attr {
-		if attr.Key == name && attr.Val == value {
-			return true
-		}
-	}
-	return false
+// peerSelection configures how public peers are selected, see the genconfigs flags.
+type peerSelection struct {
+	Index      string   // URL or local file of the peer index
+	Countries  []string // sections of the index, all if empty
+	Count      int      // number of peers to select
+	Transports []string // allowed peer URI schemes
+	Measure    bool     // order the peers by ping latency instead of keeping the index order
 }
 
-// fetchOnlinePeers fetches the list of online peers from PEER_INDEX_URL for the specified PEER_COUNTRY
-func fetchOnlinePeers() []string {
-	peerIndex, err := http.Get(PEER_INDEX_URL)
-	if err != nil {
-		panic(err)
-	}
-	if peerIndex.StatusCode != http.StatusOK {
-		panic(fmt.Sprintf("failed to fetch peer index: %s", peerIndex.Status))
-	}
-	defer peerIndex.Body.Close()
-
-	doc, err := html.Parse(peerIndex.Body)
+// fetchOnlinePeers fetches the list of online peers from the peer index for the selected countries
+func fetchOnlinePeers(s peerSelection) []string {
+	peers, err := peerindex.Load(context.Background(), http.DefaultClient, s.Index, s.Countries)
 	if err != nil {
-		panic(err)
+		panic(fmt.Sprintf("failed to load peer index %s: %v", s.Index, err))
 	}
-
-	peers := []string{}
-
-	inCountry := false
-	for node := range doc.Descendants() {
-		// find table header
-		if found := hasAttribute(node, "id", "country"); found {
-			if node.FirstChild.Data == PEER_COUNTRY {
-				inCountry = true
-			} else {
-				inCountry = false
-			}
-			continue
-		}
-		// collect online peers in the country section
-		if inCountry {
-			if found := hasAttribute(node, "class", "statusgood"); found {
-				for subnode := range node.Descendants() {
-					if found := hasAttribute(subnode, "id", "address"); found {
-						peers = append(peers, subnode.FirstChild.Data)
-					}
-				}
-			}
-		}
-	}
-
 	return peers
 }
 
@@ -84,21 +48,27 @@ func (ps peerStats) Len() int           { return len(ps) }
 func (ps peerStats) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
 func (ps peerStats) Less(i, j int) bool { return ps[i].Latency < ps[j].Latency }
 
-func isConfiguredPeerProtocol(address string) bool {
-	return strings.HasPrefix(address, fmt.Sprintf("%v://", PROTOCOL))
+func isAllowedTransport(address string, transports []string) bool {
+	return slices.ContainsFunc(transports, func(transport string) bool {
+		return strings.HasPrefix(address, fmt.Sprintf("%v://", transport))
+	})
 }
 
-// selectPublicPeers selects the top PEER_PUBLIC_COUNT online public peers based on latency.
-// Ignores any peers that do not support the PROTOCOL or have packet loss.
-func selectPublicPeers() []string {
+// selectPublicPeers selects the top s.Count online public peers based on latency, or the first
+// ones in the index without measuring. Ignores any peers that do not use one of the allowed
+// transports or have packet loss.
+func selectPublicPeers(s peerSelection) []string {
+	if s.Count <= 0 || len(s.Transports) == 0 {
+		return []string{}
+	}
 	fmt.Println("Selecting public peers")
 
-	onlinePeers := fetchOnlinePeers()
+	onlinePeers := fetchOnlinePeers(s)
 
 	peerStatsList := peerStats{}
 
 	for _, peer := range onlinePeers {
-		if !isConfiguredPeerProtocol(peer) {
+		if !isAllowedTransport(peer, s.Transports) {
 			continue
 		}
 
@@ -107,6 +77,10 @@ func selectPublicPeers() []string {
 			fmt.Printf("Failed to parse peer URL %s: %v\n", peer, err)
 			continue
 		}
+		if !s.Measure {
+			peerStatsList = append(peerStatsList, peerStat{Address: peer})
+			continue
+		}
 
 		pinger, err := probing.NewPinger(peerUrl.Hostname())
 		if err != nil {
@@ -135,13 +109,21 @@ func selectPublicPeers() []string {
 		})
 	}
 
-	sort.Sort(peerStatsList)
-	peerStatsList = peerStatsList[:PEER_PUBLIC_COUNT]
+	sort.Stable(peerStatsList)
+	if len(peerStatsList) < s.Count {
+		fmt.Printf("Only %d of %d public peers qualify\n", len(peerStatsList), s.Count)
+	} else {
+		peerStatsList = peerStatsList[:s.Count]
+	}
 
 	fmt.Println("Selected public peers:")
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
 	for _, ps := range peerStatsList {
-		fmt.Fprintf(w, "%v\t%v\n", ps.Latency, ps.Address)
+		if s.Measure {
+			fmt.Fprintf(w, "%v\t%v\n", ps.Latency, ps.Address)
+		} else {
+			fmt.Fprintf(w, "%v\n", ps.Address)
+		}
 	}
 	w.Flush()
 
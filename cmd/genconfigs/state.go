@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+// STATE_FILE is the name of the state file next to the input file, unless set with -state.
+const STATE_FILE = "genconfigs-state.json"
+
+// fleetState keeps the identities of the nodes between runs, so re-generated configs keep the
+// same keys and device entries. It holds private keys and is only readable by its owner.
+type fleetState struct {
+	Nodes map[string]*nodeState
+}
+
+type nodeState struct {
+	PrivateKey config.KeyBytes
+	AddedAt    time.Time // when the node was first generated, the AddedAt of its device entries
+	Bundled    string    `json:",omitempty"` // the config last sealed into a bundle, redacted, to show what changes
+	BundledTo  string    `json:",omitempty"` // the recipient of the bundle, or "passphrase"
+}
+
+// checkStatePath returns an error if the state file is inside the output directory, which is
+// handed out or synced to the devices, while the state file holds the private keys of all nodes.
+func checkStatePath(statePath, outputDir string) error {
+	state, err := filepath.Abs(statePath)
+	if err != nil {
+		return err
+	}
+	output, err := filepath.Abs(outputDir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(output, state); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("the state file %s holds the private keys of all nodes and must be kept out of the output directory %s, move it elsewhere and set -state", statePath, outputDir)
+	}
+	return nil
+}
+
+// loadState reads the state file, an empty state if it doesn't exist yet.
+func loadState(path string) (*fleetState, error) {
+	state := &fleetState{Nodes: map[string]*nodeState{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if state.Nodes == nil {
+		state.Nodes = map[string]*nodeState{}
+	}
+	return state, nil
+}
+
+func (s *fleetState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data, 0600)
+}
+
+// writeFile writes data to a temporary file with mode and renames it to path, so that the file
+// gets mode even if it already existed with another one, and is never left half written.
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// assignIdentities sets the private key of the nodes that don't have one in the input, from the
+// state or else a new key, and records the identities of all nodes in the state. A key in the
+// input replaces the one in the state.
+func (s *fleetState) assignIdentities(nodes []configInput, now time.Time) error {
+	for i := range nodes {
+		n := &nodes[i]
+		state, ok := s.Nodes[n.Name]
+		if !ok {
+			state = &nodeState{AddedAt: now}
+			s.Nodes[n.Name] = state
+		}
+		switch {
+		case len(n.PrivateKey) == ed25519.PrivateKeySize:
+			state.PrivateKey = n.PrivateKey
+		case len(n.PrivateKey) != 0:
+			return fmt.Errorf("invalid private key for node %s", n.Name)
+		case len(state.PrivateKey) == ed25519.PrivateKeySize:
+			n.PrivateKey = state.PrivateKey
+		default:
+			_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Generated a new key for node %s\n", n.Name)
+			n.PrivateKey, state.PrivateKey = config.KeyBytes(privateKey), config.KeyBytes(privateKey)
+		}
+	}
+	return nil
+}
+
+// privateKeyPattern matches private keys in configs, the second half of which is the public key.
+var privateKeyPattern = regexp.MustCompile(`("?PrivateKey"?: )"?[0-9a-f]{64}([0-9a-f]{64})"?`)
+
+// redact shows the private keys in a config by their public key.
+func redact(config []byte) string {
+	return privateKeyPattern.ReplaceAllString(string(config), `$1"<redacted, public key $2>"`)
+}
+
+// readConfig reads the current content of a config file, nil if it doesn't exist yet.
+func readConfig(path string) ([]byte, error) {
+	current, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return current, err
+}
+
+// configDiff returns a unified diff from the current content of a config file, nil if it
+// doesn't exist yet, to its new content, empty if it didn't change. Private keys are shown by
+// their public key.
+func configDiff(path string, current, output []byte) (string, error) {
+	fromFile := path
+	if current == nil {
+		fromFile = "/dev/null"
+	}
+	lines := func(data []byte) []string {
+		if len(data) == 0 {
+			return nil
+		}
+		return difflib.SplitLines(redact(data))
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        lines(current),
+		B:        lines(output),
+		FromFile: fromFile,
+		ToFile:   path,
+		Context:  2,
+	})
+}
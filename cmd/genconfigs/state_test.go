@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignIdentities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), STATE_FILE)
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	nodes := []configInput{{Name: "a"}, {Name: "b"}}
+	if assert.NoError(t, state.assignIdentities(nodes, first)) {
+		assert.Len(t, nodes[0].PrivateKey, 64, "new nodes get a key")
+		assert.NotEqual(t, nodes[0].PrivateKey, nodes[1].PrivateKey)
+	}
+	if err := state.save(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the state file holds private keys")
+	}
+
+	state, err = loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := []configInput{{Name: "b"}, {Name: "c"}, {Name: "a", PrivateKey: bytes.Repeat([]byte{1}, 64)}}
+	if assert.NoError(t, state.assignIdentities(again, first.Add(time.Hour))) {
+		assert.Equal(t, nodes[1].PrivateKey, again[0].PrivateKey, "known nodes keep their key")
+		assert.Equal(t, first, state.Nodes["b"].AddedAt)
+		assert.Equal(t, first.Add(time.Hour), state.Nodes["c"].AddedAt)
+		assert.Equal(t, again[2].PrivateKey, state.Nodes["a"].PrivateKey, "a key in the input replaces the one in the state")
+	}
+	assert.ErrorContains(t, state.assignIdentities([]configInput{{Name: "d", PrivateKey: []byte{1}}}, first), "invalid private key")
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.json")
+	if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NoError(t, writeFile(path, []byte(`{"PrivateKey": ""}`), 0600)) {
+		info, err := os.Stat(path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "files from earlier runs get the new mode")
+		}
+		data, _ := os.ReadFile(path)
+		assert.Equal(t, `{"PrivateKey": ""}`, string(data))
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, entries, 1, "no temporary files are left")
+}
+
+func TestCheckStatePath(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out")
+	assert.NoError(t, checkStatePath(filepath.Join(dir, STATE_FILE), output))
+	assert.NoError(t, checkStatePath(filepath.Join(dir, "output-state.json"), output))
+	assert.Error(t, checkStatePath(filepath.Join(output, STATE_FILE), output))
+	assert.Error(t, checkStatePath(filepath.Join(output, "nodes", STATE_FILE), output+"/"))
+	assert.Error(t, checkStatePath(STATE_FILE, "."))
+}
+
+func TestConfigDiff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.json")
+	key := bytes.Repeat([]byte("ab"), 32)
+	output := []byte("{\n  \"PrivateKey\": \"" + string(key) + string(bytes.Repeat([]byte("cd"), 32)) + "\",\n  \"Peers\": []\n}\n")
+	diff, err := configDiff(path, nil, output)
+	if assert.NoError(t, err) {
+		assert.Contains(t, diff, "--- /dev/null")
+		assert.Contains(t, diff, "+  \"PrivateKey\": \"<redacted, public key "+string(bytes.Repeat([]byte("cd"), 32))+">\",")
+		assert.NotContains(t, diff, string(key), "private keys aren't shown")
+	}
+	if err := os.WriteFile(path, output, 0644); err != nil {
+		t.Fatal(err)
+	}
+	current, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err = configDiff(path, current, output)
+	if assert.NoError(t, err) {
+		assert.Empty(t, diff)
+	}
+	diff, err = configDiff(path, current, bytes.Replace(output, []byte("[]"), []byte("[\"tls://a:1\"]"), 1))
+	if assert.NoError(t, err) {
+		assert.Contains(t, diff, "-  \"Peers\": []\n+  \"Peers\": [\"tls://a:1\"]\n")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Topology modes
+const (
+	TOPOLOGY_LISTENERS = "listeners" // nodes without Listen dial every node with Listen they can dial
+	TOPOLOGY_MESH      = "mesh"      // every pair of nodes is linked, if one of them can dial the other
+	TOPOLOGY_HUB       = "hub"       // every node is linked to every hub
+	TOPOLOGY_EDGES     = "edges"     // only the explicit links
+)
+
+// listenTransports are the transports nodes can listen on.
+var listenTransports = []string{"quic", "tcp", "tls", "ws"}
+
+// streamTransports share a TCP port, so a node can only listen on one of them per port.
+var streamTransports = []string{"tcp", "tls", "ws"}
+
+type topologyInput struct {
+	Mode      string      `json:",omitempty" comment:"How the nodes are linked: \"listeners\" (default) links nodes without Listen to every node with Listen, \"mesh\" links every pair of nodes, \"hub\" links every node to every node in Hubs, \"edges\" only has the Links"`
+	Hubs      []string    `json:",omitempty" comment:"Names of the hub nodes in hub mode"`
+	Transport string      `json:",omitempty" comment:"Default transport of the listeners, and the transport nodes without Transports prefer. Defaults to quic."`
+	Links     []linkInput `json:",omitempty" comment:"Links added to the layout of Mode, replacing generated links between the same nodes"`
+}
+
+type linkInput struct {
+	From      string `comment:"Name of the node that dials the link"`
+	To        string `comment:"Name of the node that is dialed, must have Listen set"`
+	Transport string `json:",omitempty" comment:"Transport of the link, one To listens on. Defaults to the first of the Transports of From that To listens on."`
+	Priority  uint8  `json:",omitempty" comment:"Peering priority of the link, links with a lower value are preferred between the same nodes"`
+	Interface string `json:",omitempty" comment:"If set, the link is only dialed over this network interface of From, through InterfacePeers"`
+}
+
+// defaultTransport returns the transport of listeners and links that don't set one.
+func (t topologyInput) defaultTransport() string {
+	if t.Transport == "" {
+		return PROTOCOL
+	}
+	return t.Transport
+}
+
+// checkListeners sets the default transport of listeners without one and checks that a node
+// doesn't listen twice on a transport, or on several stream transports on the same port.
+func checkListeners(nodes []configInput, topology topologyInput) error {
+	for _, n := range nodes {
+		transports, streamPorts := []string{}, map[int]string{}
+		for i := range n.Listen {
+			l := &n.Listen[i]
+			if l.Transport == "" {
+				l.Transport = topology.defaultTransport()
+			}
+			if !slices.Contains(listenTransports, l.Transport) {
+				return fmt.Errorf("%s can't listen on transport %q", n.Name, l.Transport)
+			}
+			if slices.Contains(transports, l.Transport) {
+				return fmt.Errorf("%s listens on %s twice", n.Name, l.Transport)
+			}
+			transports = append(transports, l.Transport)
+			if slices.Contains(streamTransports, l.Transport) {
+				if other, ok := streamPorts[l.Port]; ok {
+					return fmt.Errorf("%s can't listen on both %s and %s on port %d", n.Name, other, l.Transport, l.Port)
+				}
+				streamPorts[l.Port] = l.Transport
+			}
+		}
+	}
+	return nil
+}
+
+// preferences returns the transports a node dials in order of preference.
+func (n configInput) preferences(topology topologyInput) []string {
+	if len(n.Transports) == 0 {
+		return []string{topology.defaultTransport()}
+	}
+	return n.Transports
+}
+
+// listener returns the listener of a node on a transport, nil if it doesn't listen on it.
+func (n configInput) listener(transport string) *configInputListen {
+	for i := range n.Listen {
+		if n.Listen[i].Transport == transport {
+			return &n.Listen[i]
+		}
+	}
+	return nil
+}
+
+// fleetTransports returns the transports every node dials, in the order the first node
+// prefers them.
+func fleetTransports(nodes []configInput, topology topologyInput) []string {
+	if len(nodes) == 0 {
+		return []string{topology.defaultTransport()}
+	}
+	transports := slices.Clone(nodes[0].preferences(topology))
+	for _, n := range nodes[1:] {
+		transports = slices.DeleteFunc(transports, func(t string) bool { return !slices.Contains(n.preferences(topology), t) })
+	}
+	return transports
+}
+
+// buildLinks returns the links between the nodes in the layout of the topology, see
+// checkListeners for the listeners.
+func buildLinks(nodes []configInput, topology topologyInput) ([]linkInput, error) {
+	byName := map[string]configInput{}
+	for _, n := range nodes {
+		if _, ok := byName[n.Name]; ok {
+			return nil, fmt.Errorf("duplicate node name %q", n.Name)
+		}
+		byName[n.Name] = n
+	}
+
+	// link dials a node of the pair that listens on a transport the other one dials
+	links := []linkInput{}
+	canDial := func(a, b configInput) bool {
+		return slices.ContainsFunc(a.preferences(topology), func(t string) bool { return b.listener(t) != nil })
+	}
+	link := func(a, b configInput) bool {
+		switch {
+		case canDial(a, b):
+			links = append(links, linkInput{From: a.Name, To: b.Name})
+		case canDial(b, a):
+			links = append(links, linkInput{From: b.Name, To: a.Name})
+		default:
+			return false
+		}
+		return true
+	}
+	switch topology.Mode {
+	case "", TOPOLOGY_LISTENERS:
+		for _, n := range nodes {
+			for _, on := range nodes {
+				if len(n.Listen) == 0 && canDial(n, on) {
+					links = append(links, linkInput{From: n.Name, To: on.Name})
+				}
+			}
+		}
+	case TOPOLOGY_MESH:
+		for i, n := range nodes {
+			for _, on := range nodes[i+1:] {
+				link(n, on) // can't be linked if neither listens on a transport the other dials
+			}
+		}
+	case TOPOLOGY_HUB:
+		if len(topology.Hubs) == 0 {
+			return nil, fmt.Errorf("hub topology needs at least one hub")
+		}
+		for i, hub := range topology.Hubs {
+			h, ok := byName[hub]
+			if !ok {
+				return nil, fmt.Errorf("unknown hub %q", hub)
+			}
+			for _, n := range nodes {
+				if n.Name == hub || slices.Contains(topology.Hubs[:i], n.Name) {
+					continue
+				}
+				if !link(n, h) {
+					return nil, fmt.Errorf("hub %s and %s can't be linked, neither listens on a transport the other dials", hub, n.Name)
+				}
+			}
+		}
+	case TOPOLOGY_EDGES:
+	default:
+		return nil, fmt.Errorf("unknown topology mode %q", topology.Mode)
+	}
+
+	for _, l := range topology.Links {
+		from, ok := byName[l.From]
+		if !ok {
+			return nil, fmt.Errorf("link from unknown node %q", l.From)
+		}
+		to, ok := byName[l.To]
+		if !ok {
+			return nil, fmt.Errorf("link to unknown node %q", l.To)
+		}
+		if from.Name == to.Name {
+			return nil, fmt.Errorf("link from %s to itself", l.From)
+		}
+		if len(to.Listen) == 0 {
+			return nil, fmt.Errorf("link from %s to %s, which doesn't have Listen set", l.From, l.To)
+		}
+		links = slices.DeleteFunc(links, func(g linkInput) bool {
+			return (g.From == l.From && g.To == l.To) || (g.From == l.To && g.To == l.From)
+		})
+		links = append(links, l)
+	}
+	for i := range links {
+		l := &links[i]
+		from, to := byName[l.From], byName[l.To]
+		if l.Transport != "" {
+			if to.listener(l.Transport) == nil {
+				return nil, fmt.Errorf("link from %s to %s uses %s, which %s doesn't listen on", l.From, l.To, l.Transport, l.To)
+			}
+			continue
+		}
+		preferred := slices.IndexFunc(from.preferences(topology), func(t string) bool { return to.listener(t) != nil })
+		if preferred < 0 {
+			return nil, fmt.Errorf("%s can't dial %s, which listens on none of %s", l.From, l.To, strings.Join(from.preferences(topology), ", "))
+		}
+		l.Transport = from.preferences(topology)[preferred]
+	}
+	return links, nil
+}
+
+// checkConnected returns an error if some nodes can't reach each other over the links. Every
+// node dials the public peers, so the nodes reach each other through them if there are any.
+func checkConnected(nodes []configInput, links []linkInput, publicPeers []string) error {
+	if len(nodes) == 0 || len(publicPeers) > 0 {
+		return nil
+	}
+	reached := map[string]bool{nodes[0].Name: true}
+	queue := []string{nodes[0].Name}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, l := range links {
+			for _, next := range []string{l.From, l.To} {
+				if (l.From == name || l.To == name) && !reached[next] {
+					reached[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+	}
+	unreached := []string{}
+	for _, n := range nodes {
+		if !reached[n.Name] {
+			unreached = append(unreached, n.Name)
+		}
+	}
+	if len(unreached) > 0 {
+		return fmt.Errorf("the topology isn't connected, %s can't reach %s", nodes[0].Name, strings.Join(unreached, ", "))
+	}
+	return nil
+}
+
+// anyListens reports whether some node has Listen set.
+func anyListens(nodes []configInput) bool {
+	return slices.ContainsFunc(nodes, func(n configInput) bool { return len(n.Listen) > 0 })
+}
+
+// listenURIs returns the listen addresses of a node.
+func listenURIs(n configInput) []string {
+	uris := []string{}
+	for _, l := range n.Listen {
+		uris = append(uris, fmt.Sprintf("%v://0.0.0.0:%v", l.Transport, l.Port))
+	}
+	return uris
+}
+
+// peerURI returns the address a link dials its listening node at.
+func peerURI(l linkInput, to configInput) string {
+	listener := to.listener(l.Transport)
+	u := url.URL{
+		Scheme: l.Transport,
+		Host:   net.JoinHostPort(listener.PublicHost, strconv.Itoa(listener.PublicPort)),
+	}
+	if l.Priority > 0 {
+		u.RawQuery = url.Values{"priority": {strconv.Itoa(int(l.Priority))}}.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNodes() []configInput {
+	return []configInput{
+		{Name: "hub", Listen: listenInputs{{Port: 1000, PublicHost: "hub.example.org", PublicPort: 1000}}},
+		{Name: "server", Listen: listenInputs{{Port: 2000, PublicHost: "2001:db8::2", PublicPort: 2001}, {Transport: "tls", Port: 2000, PublicHost: "2001:db8::2", PublicPort: 2001}}},
+		{Name: "laptop", Transports: []string{"tls", "quic"}},
+		{Name: "phone"},
+	}
+}
+
+func linkPairs(links []linkInput) []string {
+	pairs := []string{}
+	for _, l := range links {
+		pairs = append(pairs, l.From+">"+l.To+" "+l.Transport)
+	}
+	return pairs
+}
+
+func TestBuildLinks(t *testing.T) {
+	nodes := testNodes()
+	if err := checkListeners(nodes, topologyInput{}); err != nil {
+		t.Fatal(err)
+	}
+	links, err := buildLinks(nodes, topologyInput{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"laptop>hub quic", "laptop>server tls", "phone>hub quic", "phone>server quic"}, linkPairs(links), "nodes without Listen dial every listener over the transport they prefer")
+	}
+	links, err = buildLinks(nodes, topologyInput{Mode: TOPOLOGY_MESH})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"hub>server quic", "laptop>hub quic", "phone>hub quic", "laptop>server tls", "phone>server quic"}, linkPairs(links), "laptop and phone can't be linked")
+	}
+	links, err = buildLinks(nodes, topologyInput{Mode: TOPOLOGY_HUB, Hubs: []string{"hub"}, Links: []linkInput{
+		{From: "hub", To: "server", Transport: "tls", Priority: 1},
+		{From: "phone", To: "server"},
+	}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"laptop>hub quic", "phone>hub quic", "hub>server tls", "phone>server quic"}, linkPairs(links), "explicit links replace generated ones")
+	}
+
+	_, err = buildLinks(nodes, topologyInput{Mode: TOPOLOGY_HUB, Hubs: []string{"laptop"}})
+	assert.ErrorContains(t, err, "neither listens on a transport the other dials")
+	_, err = buildLinks(nodes, topologyInput{Mode: TOPOLOGY_EDGES, Links: []linkInput{{From: "hub", To: "laptop"}}})
+	assert.ErrorContains(t, err, "doesn't have Listen set")
+	_, err = buildLinks(nodes, topologyInput{Mode: "ring"})
+	assert.ErrorContains(t, err, "unknown topology mode")
+	_, err = buildLinks(nodes, topologyInput{Mode: TOPOLOGY_EDGES, Links: []linkInput{{From: "hub", To: "server", Transport: "ws"}}})
+	assert.ErrorContains(t, err, "which server doesn't listen on")
+	nodes[2].Transports = []string{"ws"}
+	links, err = buildLinks(nodes, topologyInput{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"phone>hub quic", "phone>server quic"}, linkPairs(links), "laptop can't dial any listener")
+	}
+	_, err = buildLinks(nodes, topologyInput{Mode: TOPOLOGY_EDGES, Links: []linkInput{{From: "laptop", To: "hub"}}})
+	assert.ErrorContains(t, err, "laptop can't dial hub, which listens on none of ws")
+}
+
+func TestCheckListeners(t *testing.T) {
+	nodes := testNodes()
+	if assert.NoError(t, checkListeners(nodes, topologyInput{})) {
+		assert.Equal(t, "quic", nodes[0].Listen[0].Transport, "listeners default to the topology transport")
+	}
+	nodes = testNodes()
+	assert.EqualError(t, checkListeners(nodes, topologyInput{Transport: "tcp"}), "server can't listen on both tcp and tls on port 2000")
+	nodes = testNodes()
+	nodes[1].Listen[1].Transport = "quic"
+	assert.EqualError(t, checkListeners(nodes, topologyInput{}), "server listens on quic twice")
+	nodes = testNodes()
+	nodes[0].Listen[0].Transport = "wss"
+	assert.EqualError(t, checkListeners(nodes, topologyInput{}), "hub can't listen on transport \"wss\"")
+}
+
+func TestFleetTransports(t *testing.T) {
+	nodes := testNodes()
+	assert.Equal(t, []string{"quic"}, fleetTransports(nodes, topologyInput{}), "phone only dials quic")
+	nodes[3].Transports = []string{"tcp", "tls"}
+	assert.Equal(t, []string{"tls"}, fleetTransports(nodes[2:], topologyInput{}))
+	assert.Empty(t, fleetTransports(nodes, topologyInput{}))
+}
+
+func TestCheckConnected(t *testing.T) {
+	nodes := testNodes()
+	if err := checkListeners(nodes, topologyInput{}); err != nil {
+		t.Fatal(err)
+	}
+	links, err := buildLinks(nodes, topologyInput{Mode: TOPOLOGY_EDGES, Links: []linkInput{
+		{From: "laptop", To: "hub"},
+		{From: "phone", To: "server"},
+	}})
+	if assert.NoError(t, err) {
+		assert.EqualError(t, checkConnected(nodes, links, nil), "the topology isn't connected, hub can't reach server, phone")
+		assert.NoError(t, checkConnected(nodes, links, []string{"tls://peer.example.org:443"}), "every node dials the public peers")
+	}
+	links = append(links, linkInput{From: "server", To: "hub", Transport: "quic"})
+	assert.NoError(t, checkConnected(nodes, links, nil))
+	assert.True(t, anyListens(nodes))
+
+	// devices behind NAT only meet through public peers
+	nodes = nodes[2:]
+	links, err = buildLinks(nodes, topologyInput{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, links)
+		assert.Error(t, checkConnected(nodes, links, nil))
+		assert.NoError(t, checkConnected(nodes, links, []string{"tls://peer.example.org:443"}))
+		assert.False(t, anyListens(nodes))
+	}
+}
+
+func TestListenAndPeerURIs(t *testing.T) {
+	nodes := testNodes()
+	if err := checkListeners(nodes, topologyInput{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"quic://0.0.0.0:2000", "tls://0.0.0.0:2000"}, listenURIs(nodes[1]))
+	assert.Equal(t, "tls://[2001:db8::2]:2001?priority=2", peerURI(linkInput{From: "laptop", To: "server", Transport: "tls", Priority: 2}, nodes[1]))
+}
+
+func TestListenInputs(t *testing.T) {
+	var n configInput
+	if assert.NoError(t, json.Unmarshal([]byte(`{"Name": "a", "Listen": {"Port": 1, "PublicHost": "a", "PublicPort": 2}}`), &n)) {
+		assert.Equal(t, listenInputs{{Port: 1, PublicHost: "a", PublicPort: 2}}, n.Listen, "a single listener")
+	}
+	n = configInput{}
+	if assert.NoError(t, json.Unmarshal([]byte(`{"Name": "a", "Listen": [{"Transport": "tls", "Port": 1}, {"Transport": "quic", "Port": 1}]}`), &n)) {
+		assert.Equal(t, listenInputs{{Transport: "tls", Port: 1}, {Transport: "quic", Port: 1}}, n.Listen)
+	}
+}
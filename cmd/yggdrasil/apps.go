@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"slices"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/apps"
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+)
+
+// assignAppAddresses assigns the addresses of the apps in the current manager config to the TUN interface.
+func (n *node) assignAppAddresses(logger *log.Logger) {
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+	n._assignAppAddresses(n.mcfg, logger)
+}
+
+// _assignAppAddresses assigns the addresses of the apps in mcfg to the TUN interface and removes
+// those of apps that are gone. The caller must hold n.reloadMutex.
+func (n *node) _assignAppAddresses(mcfg *mconfig.ManagerConfig, logger *log.Logger) {
+	if n.tun == nil || n.tun.Name() == "" {
+		if len(mcfg.Manager.Apps) > 0 {
+			logger.Warnf("App addresses can't be assigned without a TUN interface")
+		}
+		return
+	}
+	key := n.core.PublicKey()
+	var assigned []address.Address
+	for _, app := range mcfg.Manager.Apps {
+		addr := apps.Address(key, app.Name)
+		if !slices.Contains(n.appAddresses, addr) {
+			if err := apps.AddAddress(n.tun.Name(), app.IP(key)); err != nil {
+				logger.Errorf("Failed to assign the address of app %s: %v", app.Name, err)
+				continue
+			}
+			logger.Infof("Assigned address %s to app %s", app.IP(key), app.Name)
+		}
+		assigned = append(assigned, addr)
+	}
+	for _, addr := range n.appAddresses {
+		if slices.Contains(assigned, addr) {
+			continue
+		}
+		if err := apps.RemoveAddress(n.tun.Name(), addr[:]); err != nil {
+			logger.Errorf("Failed to remove app address %s: %v", net.IP(addr[:]), err)
+			assigned = append(assigned, addr) // retried on the next reload
+		}
+	}
+	n.appAddresses = assigned
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/skip2/go-qrcode"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/handshake"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// inviterDeviceName names the inviting node until the joining node has its config.
+const inviterDeviceName = "inviter"
+
+// joinConfig is the manager config of a joining node until it has joined,
+// it only allows the inviting node and expires along with the token.
+func joinConfig(token *handshake.Token) mconfig.ManagerConfig {
+	mcfg := mconfig.ManagerConfig{}
+	mcfg.Manager.Devices = []devices.Device{{
+		Name:      inviterDeviceName,
+		PublicKey: hex.EncodeToString(token.PublicKey),
+		AddedAt:   time.Now(),
+		ExpiresAt: token.Expires,
+	}}
+	return mcfg
+}
+
+// nodeName returns the name of this node as a device of other nodes.
+func nodeName(mcfg *mconfig.ManagerConfig) string {
+	if mcfg.Manager.Name != "" {
+		return mcfg.Manager.Name
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "yggdrasil"
+}
+
+// writeConfigFile replaces the contents of the config file at path, keeping its permissions.
+func writeConfigFile(path string, data []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, fi.Mode().Perm())
+}
+
+// printToken prints a token as text and as a QR code for the terminal.
+func printToken(token *handshake.Token) {
+	fmt.Println(token)
+	// the upper case form fits the more compact alphanumeric QR mode
+	if qr, err := qrcode.New(strings.ToUpper(token.String()), qrcode.Low); err == nil {
+		fmt.Print(qr.ToSmallString(false))
+	}
+}
+
+// invite prints a new token and opens the management service to unknown nodes until
+// a device has joined with it or it expires. The given peers are included in the token
+// so the joining node can reach this one.
+func (n *node) invite(ctx context.Context, path string, peers []string, lifetime time.Duration, logger *log.Logger) {
+	token, err := handshake.NewToken(n.core.PublicKey(), n.management.Port(), peers, lifetime)
+	if err != nil {
+		logger.Errorf("Failed to create invite token: %v", err)
+		return
+	}
+	if err := n.setPublicServices([]string{fmt.Sprintf("tcp/%d", token.Port)}, logger); err != nil {
+		logger.Errorf("Failed to open the management service: %v", err)
+		return
+	}
+	defer func() {
+		if err := n.setPublicServices(nil, logger); err != nil {
+			logger.Errorf("Failed to close the management service: %v", err)
+		}
+	}()
+	printToken(token)
+	logger.Infof("Accepting a new device with the invite token above until %s", token.Expires.Format(time.RFC3339))
+
+	inviter := handshake.NewInviter(token, func(name string, key ed25519.PublicKey) (json.RawMessage, error) {
+		return n.addDevice(path, name, key, logger)
+	})
+	n.management.Handle(handshake.JoinPath, management.Anyone, inviter)
+	defer n.management.Remove(handshake.JoinPath)
+	switch err := inviter.Wait(ctx); {
+	case err == nil:
+		logger.Infof("Stopped accepting new devices")
+	case errors.Is(err, handshake.ErrExpired):
+		logger.Infof("Invite token expired, stopped accepting new devices")
+	case !errors.Is(err, context.Canceled):
+		logger.Errorf("Failed to accept new devices: %v", err)
+	}
+}
+
+// addDevice adds a joining device to the config file at path and applies it,
+// returning the manager config for the device.
+func (n *node) addDevice(path string, name string, key ed25519.PublicKey, logger *log.Logger) (json.RawMessage, error) {
+	cfgBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := devices.Device{
+		Name:      name,
+		PublicKey: hex.EncodeToString(key),
+		AddedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+	if cfgBytes, err = mconfig.AddDevice(cfgBytes, d); err != nil {
+		return nil, err
+	}
+	mcfg := &mconfig.ManagerConfig{}
+	if err := mcfg.UnmarshalHJSON(cfgBytes); err != nil {
+		return nil, err
+	}
+	if err := writeConfigFile(path, cfgBytes); err != nil {
+		return nil, err
+	}
+	n.reloadMutex.Lock()
+	if mcfg, err = n._syncManagerConfig(mcfg, logger); err == nil {
+		if n.doc != nil {
+			n.syncConfig = cfgBytes
+		}
+		err = n._applyManagerConfig(mcfg, logger)
+	}
+	n.reloadMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Added device %s (%s)", d.Name, d.PublicKey)
+
+	self := devices.Device{
+		Name:      nodeName(mcfg),
+		PublicKey: hex.EncodeToString(n.core.PublicKey()),
+		Tags:      mcfg.Manager.Tags,
+		AddedAt:   d.AddedAt,
+	}
+	return json.Marshal(mcfg.ForDevice(self, d.PublicKey))
+}
+
+// join asks the node that created token to add this node, then writes the manager config
+// it returns to the config file at path and applies it. The peers from the token are
+// connected to right away and added to the config file once joined.
+func (n *node) join(ctx context.Context, path string, token *handshake.Token, name string, logger *log.Logger) {
+	if name == "" {
+		name = nodeName(n.mcfg)
+	}
+	for _, peer := range token.Peers {
+		u, err := url.Parse(peer)
+		if err == nil {
+			err = n.core.AddPeer(u, "")
+		}
+		if err != nil && !errors.Is(err, core.ErrLinkAlreadyConfigured) {
+			logger.Warnf("Failed to add peer %s from the invite token: %v", peer, err)
+		}
+	}
+	logger.Infof("Joining %s as %s", token.ManagementAddress(), name)
+	config, err := handshake.Join(ctx, token, n.core.PublicKey(), name)
+	if err != nil {
+		logger.Errorf("Failed to join: %v", err)
+		return
+	}
+	mcfg := &mconfig.ManagerConfig{}
+	if err := mcfg.UnmarshalHJSON(config); err != nil {
+		logger.Errorf("Received an invalid config: %v", err)
+		return
+	}
+	cfgBytes, err := os.ReadFile(path)
+	if err == nil {
+		cfgBytes, err = mconfig.SetManager(cfgBytes, mcfg)
+	}
+	if err == nil && len(token.Peers) > 0 {
+		cfgBytes, err = mconfig.AddPeers(cfgBytes, token.Peers)
+	}
+	if err == nil {
+		err = writeConfigFile(path, cfgBytes)
+	}
+	if err != nil {
+		logger.Errorf("Failed to write the received config: %v", err)
+		return
+	}
+	n.reloadMutex.Lock()
+	err = n._applyManagerConfig(mcfg, logger)
+	n.reloadMutex.Unlock()
+	if err != nil {
+		logger.Errorf("Failed to apply the received config: %v", err)
+		return
+	}
+	logger.Infof("Joined as %s with %d devices, config written to %s", mcfg.Manager.Name, len(mcfg.Manager.Devices), path)
+	n.startSync(ctx, path, logger)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/gologme/log"
+
+	"github.com/nermolov/yggdrasil-manager/src/lan"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// startLANLinks starts peering directly with devices on the LAN, if the manager config enables
+// it. The listen URIs of this node are advertised to the other devices.
+func (n *node) startLANLinks(ctx context.Context, listen []string, logger *log.Logger) {
+	n.reloadMutex.Lock()
+	enabled := n.mcfg.Manager.LANLinks
+	n.reloadMutex.Unlock()
+	if !enabled {
+		return
+	}
+	networks := func() []*net.IPNet {
+		if n.multicast == nil {
+			return nil
+		}
+		return lan.InterfaceNetworks(n.multicast.Interfaces())
+	}
+	optimizer := lan.NewOptimizer(n.core, n.devices, n.management.Port(), listen, networks, logger)
+	if n.admin != nil {
+		optimizer.SetupAdminHandlers(n.admin)
+	}
+	n.management.Handle(lan.EndpointsPath, management.Devices, optimizer)
+	go func() {
+		if err := optimizer.Run(ctx, management.Client(n.core.Address())); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Errorf("Failed to run LAN links: %v", err)
+		}
+	}()
+	logger.Infof("Peering directly with devices on the LAN")
+}
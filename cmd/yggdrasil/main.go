@@ -13,7 +13,9 @@ import (
 	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"suah.dev/protect"
 
@@ -22,10 +24,16 @@ import (
 	"github.com/hjson/hjson-go/v4"
 	"github.com/kardianos/minwinsvc"
 
+	"github.com/nermolov/yggdrasil-manager/src/apps"
+	"github.com/nermolov/yggdrasil-manager/src/confbundle"
 	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
 	"github.com/nermolov/yggdrasil-manager/src/dns"
+	"github.com/nermolov/yggdrasil-manager/src/document"
 	"github.com/nermolov/yggdrasil-manager/src/filter"
+	"github.com/nermolov/yggdrasil-manager/src/handshake"
 	"github.com/nermolov/yggdrasil-manager/src/ipv6rwc"
+	"github.com/nermolov/yggdrasil-manager/src/management"
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
@@ -37,11 +45,26 @@ import (
 )
 
 type node struct {
-	core      *core.Core
-	tun       *tun.TunAdapter
-	multicast *multicast.Multicast
-	admin     *admin.AdminSocket
-	dns       *dns.DnsManager
+	core       *core.Core
+	tun        *tun.TunAdapter
+	rwc        *ipv6rwc.ReadWriteCloser
+	multicast  *multicast.Multicast
+	admin      *admin.AdminSocket
+	dns        *dns.DnsManager
+	devices    *devices.Registry
+	management *management.Server
+	started    time.Time
+
+	reloadMutex    sync.Mutex
+	mcfg           *mconfig.ManagerConfig // the manager config currently applied
+	publicServices []string               // opened to any node while inviting a device
+	appAddresses   []address.Address      // assigned to the TUN interface for apps
+	expiryTimer    *time.Timer            // re-applies the manager config when the next device expires
+	signer         ed25519.PrivateKey     // signs changes to the config document
+	doc            *document.Document     // replicated config document, nil without sync
+	syncer         *document.Syncer
+	syncPath       string // config file the config document is written to
+	syncConfig     []byte // contents of the config file when it was last read or written
 }
 
 // The main function is responsible for configuring and starting Yggdrasil.
@@ -49,6 +72,8 @@ func main() {
 	genconf := flag.Bool("genconf", false, "print a new config to stdout")
 	useconf := flag.Bool("useconf", false, "read HJSON/JSON config from stdin")
 	useconffile := flag.String("useconffile", "", "read HJSON/JSON config from specified file path")
+	useconfbundle := flag.String("useconfbundle", "", "read an encrypted config bundle from genconfigs from specified file path, opened with -bundleidentity or the passphrase in "+confbundle.PassphraseEnv)
+	bundleidentity := flag.String("bundleidentity", "", "use in combination with -useconfbundle, age identity file to open the bundle with")
 	normaliseconf := flag.Bool("normaliseconf", false, "use in combination with either -useconf or -useconffile, outputs your configuration normalised")
 	exportkey := flag.Bool("exportkey", false, "use in combination with either -useconf or -useconffile, outputs your private key in PEM format")
 	confjson := flag.Bool("json", false, "print configuration from -genconf or -normaliseconf as JSON instead of HJSON")
@@ -60,6 +85,12 @@ func main() {
 	getpkey := flag.Bool("publickey", false, "use in combination with either -useconf or -useconffile, outputs your public key")
 	loglevel := flag.String("loglevel", "info", "loglevel to enable")
 	chuserto := flag.String("user", "", "user (and, optionally, group) to set UID/GID to")
+	testpolicy := flag.Bool("testpolicy", false, "use in combination with either -useconf or -useconffile, checks offline whether the device named by the first argument may reach the second on the service in the third, e.g. \"laptop self tcp/443\"")
+	invite := flag.Bool("invite", false, "use in combination with -useconffile, prints a token that lets one new device join this node with -join, adding it to the config")
+	invitetimeout := flag.Duration("invitetimeout", 10*time.Minute, "how long the token from -invite stays valid")
+	join := flag.String("join", "", "use in combination with -useconffile, joins the node that created the given -invite token and replaces the Manager section of the config with the one it sends")
+	name := flag.String("name", "", "name of this node when joining with -join, defaults to the hostname")
+	watchconf := flag.Bool("watchconf", false, "use in combination with -useconffile, reloads the filter when the config file changes")
 	flag.Parse()
 
 	done := make(chan struct{})
@@ -131,10 +162,33 @@ func main() {
 		if err := cfg.UnmarshalHJSON(cfgBytes); err != nil {
 			panic(err)
 		}
+		// a joining node gets its manager config from the inviting node
+		if *join == "" {
+			if err := mcfg.UnmarshalHJSON(cfgBytes); err != nil {
+				panic(err)
+			}
+		}
+		_ = f.Close()
+
+	case *useconfbundle != "":
+		bundle, err := os.ReadFile(*useconfbundle)
+		if err != nil {
+			panic(err)
+		}
+		identities, err := confbundle.Identities(*bundleidentity)
+		if err != nil {
+			panic(err)
+		}
+		cfgBytes, err := confbundle.Open(bundle, identities...)
+		if err != nil {
+			panic(err)
+		}
+		if err := cfg.UnmarshalHJSON(cfgBytes); err != nil {
+			panic(err)
+		}
 		if err := mcfg.UnmarshalHJSON(cfgBytes); err != nil {
 			panic(err)
 		}
-		_ = f.Close()
 
 	case *genconf:
 		cfg.AdminListen = ""
@@ -160,6 +214,22 @@ func main() {
 		return
 	}
 
+	if (*invite || *join != "") && *useconffile == "" {
+		fmt.Println("Error: -invite and -join require -useconffile")
+		return
+	}
+	if mcfg.Manager.Sync && *useconffile == "" {
+		fmt.Println("Error: Manager.Sync requires -useconffile")
+		return
+	}
+	var joinToken *handshake.Token
+	if *join != "" {
+		if joinToken, err = handshake.ParseToken(*join); err != nil {
+			panic(err)
+		}
+		mcfg = joinConfig(joinToken)
+	}
+
 	privateKey := ed25519.PrivateKey(cfg.PrivateKey)
 	publicKey := privateKey.Public().(ed25519.PublicKey)
 
@@ -183,6 +253,16 @@ func main() {
 		fmt.Println(hex.EncodeToString(publicKey))
 		return
 
+	case *testpolicy:
+		allowed, err := testPolicy(&mcfg, flag.Args())
+		if err != nil {
+			panic(err)
+		}
+		if !allowed {
+			os.Exit(1)
+		}
+		return
+
 	case *normaliseconf:
 		cfg.AdminListen = ""
 		if cfg.PrivateKeyPath != "" {
@@ -209,7 +289,8 @@ func main() {
 		return
 	}
 
-	n := &node{}
+	n := &node{signer: privateKey, started: time.Now()}
+	var allowedKeys []string
 
 	// Set up the Yggdrasil node itself.
 	{
@@ -235,7 +316,13 @@ func main() {
 				options = append(options, core.Peer{URI: peer, SourceInterface: intf})
 			}
 		}
-		for _, allowed := range cfg.AllowedPublicKeys {
+		// The core can't change its allowed keys after startup, expired devices
+		// are cut off by the tunnel filter until the next restart.
+		allowedKeys = mcfg.PeeringKeys(cfg.AllowedPublicKeys, time.Now())
+		if mcfg.Manager.PrivateMesh && len(cfg.AllowedPublicKeys) > 0 {
+			logger.Warnf("Ignoring AllowedPublicKeys in PrivateMesh mode, only devices may peer")
+		}
+		for _, allowed := range allowedKeys {
 			k, err := hex.DecodeString(allowed)
 			if err != nil {
 				panic(err)
@@ -295,17 +382,37 @@ func main() {
 			tun.InterfaceMTU(cfg.IfMTU),
 		}
 
-		filter, err := filter.NewFilter(mcfg.Manager.FilterAllowedPublicKeys)
+		if n.devices, err = devices.NewRegistry(mcfg.Manager.Devices); err != nil {
+			panic(err)
+		}
+		now := time.Now()
+		filterOptions := append(mcfg.FilterOptions(now), mcfg.AppAddresses(publicKey, now))
+		filter, err := filter.NewFilter(mcfg.AllowedPublicKeys(now), filterOptions...)
 		if err != nil {
 			panic(err)
 		}
+		filter.SetLogger(logger)
+		filter.SetNameResolver(n.devices.NameForIP)
+		if n.admin != nil {
+			filter.SetupAdminHandlers(n.admin)
+			n.devices.SetupAdminHandlers(n.admin)
+			apps.SetupAdminHandlers(n.admin, publicKey, func() []apps.App {
+				n.reloadMutex.Lock()
+				defer n.reloadMutex.Unlock()
+				return n.mcfg.Manager.Apps
+			})
+		}
 
-		if n.tun, err = tun.New(ipv6rwc.NewReadWriteCloser(n.core, filter), logger, options...); err != nil {
+		n.rwc = ipv6rwc.NewReadWriteCloser(n.core, filter)
+		if n.tun, err = tun.New(n.rwc, logger, options...); err != nil {
 			panic(err)
 		}
 		if n.admin != nil && n.tun != nil {
 			n.tun.SetupAdminHandlers(n.admin)
 		}
+		n.mcfg = &mcfg
+		n.scheduleDeviceExpiry(logger)
+		n.assignAppAddresses(logger)
 	}
 
 	// Force DNS resolution (on some platforms)
@@ -341,10 +448,56 @@ func main() {
 	if len(cfg.MulticastInterfaces) > 0 {
 		promises = append(promises, "mcast")
 	}
+	if *useconffile != "" || mcfg.Manager.PublicPeers > 0 {
+		promises = append(promises, "wpath") // the config file can be rewritten, or the peer index cached
+	}
 	if err := protect.Pledge(strings.Join(promises, " ")); err != nil {
 		panic(fmt.Sprintf("pledge: %v: %v", promises, err))
 	}
 
+	n.startManagement(ctx, cfg.AdminListen, logger)
+	if n.admin != nil {
+		n.setupManagementAdminHandlers()
+	}
+	n.startPeering(ctx, cfg, allowedKeys, logger)
+	n.startPublicPeers(ctx, cfg, *useconffile, logger)
+	n.startTraversal(ctx, logger)
+	n.startLANLinks(ctx, cfg.Listen, logger)
+	if *useconffile != "" {
+		n.startSync(ctx, *useconffile, logger)
+		if n.admin != nil {
+			n.setupRevokeAdminHandler(*useconffile, logger)
+		}
+	}
+	switch {
+	case *invite:
+		go n.invite(ctx, *useconffile, cfg.Peers, *invitetimeout, logger)
+	case joinToken != nil:
+		go n.join(ctx, *useconffile, joinToken, *name, logger)
+	}
+
+	// Reload the filter on SIGHUP, or when the config file changes if requested.
+	if *useconffile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		changed := make(chan struct{}, 1)
+		if *watchconf {
+			go watchConfigFile(ctx, *useconffile, changed)
+		}
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					signal.Stop(hup)
+					return
+				case <-hup:
+				case <-changed:
+				}
+				n.reloadFilter(*useconffile, logger)
+			}
+		}()
+	}
+
 	// Block until we are told to shut down.
 	<-ctx.Done()
 
@@ -354,6 +507,11 @@ func main() {
 	_ = n.tun.Stop()
 	n.dns.Cleanup()
 	n.core.Stop()
+	n.reloadMutex.Lock()
+	if n.expiryTimer != nil {
+		n.expiryTimer.Stop()
+	}
+	n.reloadMutex.Unlock()
 }
 
 func setLogLevel(loglevel string, logger *log.Logger) {
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/version"
+
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+type GetDeviceHealthRequest struct {
+	Device string `json:"device"`
+}
+type GetDeviceHealthResponse struct {
+	Health *management.Health `json:"health"`
+}
+
+// startManagement starts the management service on this node's address. Devices can query
+// its health, and admin devices can use the admin socket listening on adminListen remotely.
+func (n *node) startManagement(ctx context.Context, adminListen string, logger *log.Logger) {
+	n.management = management.NewServer(n.mcfg.ManagementPort(), n.authorize)
+	n.management.Handle(management.HealthPath, management.Devices, management.HealthHandler(n.health))
+	if adminListen != "" && adminListen != "none" {
+		n.management.Handle(management.AdminPath, management.Admins, management.AdminProxy(adminListen))
+	}
+	go func() {
+		if err := n.management.Run(ctx, n.core.Address()); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Errorf("Failed to run the management service: %v", err)
+		}
+	}()
+	logger.Infof("Management service listening on %s", management.URL(n.core.Address(), n.management.Port(), ""))
+}
+
+// authorize identifies the caller of a management request by its node address.
+func (n *node) authorize(addr address.Address) management.Caller {
+	caller := management.Caller{Address: addr}
+	d, ok := n.devices.LookupAddress(addr)
+	if !ok || !d.IsActive(time.Now()) {
+		return caller
+	}
+	caller.Device, caller.IsDevice = d, true
+	n.reloadMutex.Lock()
+	caller.IsAdmin = n.mcfg.IsAdmin(d)
+	n.reloadMutex.Unlock()
+	return caller
+}
+
+func (n *node) health() management.Health {
+	n.reloadMutex.Lock()
+	name, syncing := nodeName(n.mcfg), n.syncer != nil
+	n.reloadMutex.Unlock()
+	return management.Health{
+		Name:         name,
+		PublicKey:    hex.EncodeToString(n.core.PublicKey()),
+		Address:      n.core.Address().String(),
+		BuildName:    version.BuildName(),
+		BuildVersion: version.BuildVersion(),
+		Uptime:       int64(time.Since(n.started).Seconds()),
+		Peers:        len(n.core.GetPeers()),
+		Sessions:     len(n.core.GetSessions()),
+		Devices:      len(n.devices.Devices()),
+		Sync:         syncing,
+	}
+}
+
+func (n *node) setupManagementAdminHandlers() {
+	_ = n.admin.AddHandler(
+		"getDeviceHealth", "Query the health of a device through its management service", []string{"device"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetDeviceHealthRequest{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			d, ok := n.devices.Lookup(req.Device)
+			if !ok {
+				return nil, fmt.Errorf("unknown device %q", req.Device)
+			}
+			key, err := d.Key()
+			if err != nil {
+				return nil, err
+			}
+			addr := address.AddrForKey(key)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			health, err := management.GetHealth(ctx, management.Client(n.core.Address()), net.IP(addr[:]), n.management.Port())
+			if err != nil {
+				return nil, err
+			}
+			return &GetDeviceHealthResponse{Health: health}, nil
+		},
+	)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+
+	"github.com/nermolov/yggdrasil-manager/src/peering"
+)
+
+// startPeering reports who may peer with this node, which the core allows from allowedKeys,
+// and connects the relay peers of a private mesh while no device is peered.
+func (n *node) startPeering(ctx context.Context, cfg *config.NodeConfig, allowedKeys []string, logger *log.Logger) {
+	n.reloadMutex.Lock()
+	privateMesh, relays := n.mcfg.Manager.PrivateMesh, n.mcfg.Manager.RelayPeers
+	n.reloadMutex.Unlock()
+	peers := slices.Clone(cfg.Peers)
+	for _, interfacePeers := range cfg.InterfacePeers {
+		peers = append(peers, interfacePeers...)
+	}
+	supervisor := peering.NewSupervisor(n.core, n.devices, privateMesh, allowedKeys, peers, relays, logger)
+	if n.admin != nil {
+		supervisor.SetupAdminHandlers(n.admin)
+	}
+	if privateMesh {
+		logger.Infof("Private mesh mode, only devices may peer and %d relay peers are used as a last resort", len(relays))
+	}
+	go func() {
+		if err := supervisor.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Errorf("Failed to run the relay peers: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+
+	"github.com/nermolov/yggdrasil-manager/src/peerindex"
+	"github.com/nermolov/yggdrasil-manager/src/publicpeers"
+)
+
+// startPublicPeers starts picking public peers at runtime, if the manager config asks for any.
+// The index is cached next to the config file at path, if there is one.
+func (n *node) startPublicPeers(ctx context.Context, cfg *config.NodeConfig, path string, logger *log.Logger) {
+	n.reloadMutex.Lock()
+	options := n.mcfg.Manager
+	n.reloadMutex.Unlock()
+	if options.PublicPeers == 0 {
+		return
+	}
+	source := publicpeers.List(options.PublicPeerCandidates)
+	if len(options.PublicPeerCandidates) == 0 {
+		location, cacheFile := options.PublicPeerIndex, options.PublicPeerCacheFile
+		if location == "" {
+			location = peerindex.DefaultURL
+		}
+		if cacheFile == "" && path != "" {
+			cacheFile = path + ".peers"
+		}
+		source = publicpeers.Index(&http.Client{Timeout: 30 * time.Second}, location, options.PublicPeerCountries, cacheFile)
+	}
+	exclude := slices.Clone(cfg.Peers)
+	for _, interfacePeers := range cfg.InterfacePeers {
+		exclude = append(exclude, interfacePeers...)
+	}
+	rotator := publicpeers.NewRotator(n.core, options.PublicPeers, source, exclude, publicpeers.ProbeTransport, logger)
+	if n.admin != nil {
+		rotator.SetupAdminHandlers(n.admin)
+	}
+	go func() {
+		if err := rotator.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Errorf("Failed to pick public peers: %v", err)
+		}
+	}()
+	logger.Infof("Picking %d public peers at runtime", options.PublicPeers)
+}
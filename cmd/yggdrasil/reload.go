@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/gologme/log"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+)
+
+const configWatchInterval = 5 * time.Second
+
+// reloadFilter re-reads the manager config from path and swaps in the new devices and filter policy.
+// The running policy is kept if the config can't be read or is invalid.
+func (n *node) reloadFilter(path string, logger *log.Logger) {
+	cfgBytes, err := os.ReadFile(path)
+	if err != nil {
+		logger.Errorf("Failed to read config for filter reload: %v", err)
+		return
+	}
+	mcfg := mconfig.ManagerConfig{}
+	if err := mcfg.UnmarshalHJSON(cfgBytes); err != nil {
+		logger.Errorf("Failed to parse config for filter reload: %v", err)
+		return
+	}
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+	synced, err := n._syncManagerConfig(&mcfg, logger)
+	if err == nil && n.doc != nil {
+		n.syncConfig = cfgBytes
+	}
+	if err == nil {
+		err = n._applyManagerConfig(synced, logger)
+	}
+	if err != nil {
+		logger.Errorf("Failed to reload filter: %v", err)
+		return
+	}
+	logger.Infof("Reloaded filter with %d devices", len(mcfg.Manager.Devices))
+}
+
+// _applyManagerConfig updates the device registry and filter policy from mcfg as of now,
+// and makes it the current manager config. The caller must hold n.reloadMutex.
+func (n *node) _applyManagerConfig(mcfg *mconfig.ManagerConfig, logger *log.Logger) error {
+	now := time.Now()
+	options := append(mcfg.FilterOptions(now), filter.PublicServices(n.publicServices), mcfg.AppAddresses(n.core.PublicKey(), now))
+	if err := n.rwc.ReloadFilter(mcfg.AllowedPublicKeys(now), options...); err != nil {
+		return err
+	}
+	if err := n.devices.Update(mcfg.Manager.Devices); err != nil {
+		return err
+	}
+	n.mcfg = mcfg
+	n._scheduleDeviceExpiry(mcfg, now, logger)
+	n._dropRevokedPeers(mcfg, logger)
+	n._assignAppAddresses(mcfg, logger)
+	return nil
+}
+
+// scheduleDeviceExpiry arranges for the current manager config to be re-applied when its next device expires.
+func (n *node) scheduleDeviceExpiry(logger *log.Logger) {
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+	n._scheduleDeviceExpiry(n.mcfg, time.Now(), logger)
+}
+
+// setPublicServices changes the local services any node may reach, on top of the manager config.
+func (n *node) setPublicServices(services []string, logger *log.Logger) error {
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+	n.publicServices = services
+	return n._applyManagerConfig(n.mcfg, logger)
+}
+
+func (n *node) _scheduleDeviceExpiry(mcfg *mconfig.ManagerConfig, now time.Time, logger *log.Logger) {
+	if n.expiryTimer != nil {
+		n.expiryTimer.Stop()
+		n.expiryTimer = nil
+	}
+	next, ok := devices.NextExpiry(mcfg.Manager.Devices, now)
+	if !ok {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(next.Sub(now), func() {
+		n.reloadMutex.Lock()
+		defer n.reloadMutex.Unlock()
+		if n.expiryTimer != timer {
+			return // superseded by a reload
+		}
+		if err := n._applyManagerConfig(mcfg, logger); err != nil {
+			logger.Errorf("Failed to remove expired devices from filter: %v", err)
+			return
+		}
+		logger.Infof("Removed expired devices from filter")
+	})
+	n.expiryTimer = timer
+}
+
+// watchConfigFile polls path and signals changed whenever its modification time or size changes.
+func watchConfigFile(ctx context.Context, path string, changed chan<- struct{}) {
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+)
+
+type RevokeDeviceRequest struct {
+	Device string `json:"device"`
+}
+type RevokeDeviceResponse struct {
+	Revoked string `json:"revoked"`
+}
+
+// revoke permanently removes a device, given by name or hex public key, from the config
+// file at path and applies it. With sync the revocation is shared with all devices.
+func (n *node) revoke(path string, nameOrKey string, logger *log.Logger) (string, error) {
+	key := nameOrKey
+	if d, ok := n.devices.Lookup(nameOrKey); ok {
+		key = d.PublicKey
+	} else if keyBytes, err := hex.DecodeString(key); err != nil || len(keyBytes) != 32 {
+		return "", fmt.Errorf("%q is not a device name or public key", nameOrKey)
+	}
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+	cfgBytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if cfgBytes, err = mconfig.Revoke(cfgBytes, key); err != nil {
+		return "", err
+	}
+	mcfg := &mconfig.ManagerConfig{}
+	if err := mcfg.UnmarshalHJSON(cfgBytes); err != nil {
+		return "", err
+	}
+	// record the revocation in the config document first, so that the config file isn't
+	// changed if it can't be shared
+	if mcfg, err = n._syncManagerConfig(mcfg, logger); err != nil {
+		return "", err
+	}
+	if err := writeConfigFile(path, cfgBytes); err != nil {
+		return "", err
+	}
+	if n.doc != nil {
+		n.syncConfig = cfgBytes
+	}
+	if err := n._applyManagerConfig(mcfg, logger); err != nil {
+		return "", err
+	}
+	logger.Infof("Revoked device %s (%s)", nameOrKey, key)
+	return key, nil
+}
+
+// _dropRevokedPeers disconnects configured peerings with revoked keys. The core can't close inbound
+// or multicast peerings, they stay up until they drop or this node restarts, but the tunnel filter
+// drops all their traffic. The caller must hold n.reloadMutex.
+func (n *node) _dropRevokedPeers(mcfg *mconfig.ManagerConfig, logger *log.Logger) {
+	for _, p := range n.core.GetPeers() {
+		if p.Key == nil || !mcfg.IsRevoked(hex.EncodeToString(p.Key)) {
+			continue
+		}
+		var err error = core.ErrLinkNotConfigured
+		if !p.Inbound {
+			var u *url.URL
+			if u, err = url.Parse(p.URI); err == nil {
+				err = n.core.RemovePeer(u, "")
+			}
+		}
+		if errors.Is(err, core.ErrLinkNotConfigured) {
+			logger.Warnf("Peering with revoked key %s stays up until it drops or this node restarts, its traffic is filtered", hex.EncodeToString(p.Key))
+			continue
+		} else if err != nil {
+			logger.Errorf("Failed to remove peering with revoked key %s: %v", hex.EncodeToString(p.Key), err)
+			continue
+		}
+		logger.Infof("Removed peering with revoked key %s", hex.EncodeToString(p.Key))
+	}
+}
+
+func (n *node) setupRevokeAdminHandler(path string, logger *log.Logger) {
+	_ = n.admin.AddHandler(
+		"revokeDevice", "Permanently remove a device, by name or public key, from this node and with Sync from all devices", []string{"device"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &RevokeDeviceRequest{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if req.Device == "" {
+				return nil, errors.New("device is required")
+			}
+			key, err := n.revoke(path, req.Device, logger)
+			if err != nil {
+				return nil, err
+			}
+			return &RevokeDeviceResponse{Revoked: key}, nil
+		},
+	)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/gologme/log"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/document"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// syncStatePath returns the file the config document of mcfg is kept in.
+func syncStatePath(path string, mcfg *mconfig.ManagerConfig) string {
+	if mcfg.Manager.SyncStateFile != "" {
+		return mcfg.Manager.SyncStateFile
+	}
+	return path + ".sync"
+}
+
+// startSync loads the config document, records the current manager config in it and starts
+// syncing it with the other devices. Changes from other devices are written to the config
+// file at path and applied.
+func (n *node) startSync(ctx context.Context, path string, logger *log.Logger) {
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+	if n.syncer != nil || !n.mcfg.Manager.Sync {
+		return
+	}
+	statePath := syncStatePath(path, n.mcfg)
+	publicKey := n.core.PublicKey()
+	n.doc = document.New(publicKey)
+	if data, err := os.ReadFile(statePath); err == nil {
+		if n.doc, err = document.Unmarshal(publicKey, data); err != nil {
+			logger.Errorf("Failed to load the config document from %s: %v", statePath, err)
+			n.doc = nil
+			return
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		logger.Errorf("Failed to read the config document: %v", err)
+		return
+	}
+	n.syncPath = path
+	n.syncer = document.NewSyncer(n.doc, n.management.Port(), logger, func() {
+		n.syncFromDocument(logger)
+	})
+	if n.admin != nil {
+		n.syncer.SetupAdminHandlers(n.admin)
+	}
+	n.management.Handle(document.SyncPath, management.Devices, n.syncer)
+	mcfg, err := n._syncManagerConfig(n.mcfg, logger)
+	if err == nil {
+		err = n._writeManagerConfig(mcfg, logger)
+	}
+	if err != nil {
+		logger.Errorf("Failed to apply the config document: %v", err)
+	}
+	go func() {
+		if err := n.syncer.Run(ctx, management.Client(n.core.Address())); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Errorf("Failed to sync the config document: %v", err)
+		}
+	}()
+	logger.Infof("Syncing the config document with %d devices", len(n.mcfg.Manager.Devices))
+}
+
+// _syncManagerConfig records changes made to the parts of mcfg kept in the config document and
+// returns mcfg with those parts as they are in the document. Without sync mcfg is returned as is.
+// Once the config file has been synced, only the changes made to it since are recorded, so that
+// changes other devices made in the meantime aren't undone. The caller must hold n.reloadMutex.
+func (n *node) _syncManagerConfig(mcfg *mconfig.ManagerConfig, logger *log.Logger) (*mconfig.ManagerConfig, error) {
+	if n.doc == nil || !mcfg.Manager.Sync {
+		return mcfg, nil
+	}
+	var changed bool
+	var err error
+	synced := &mconfig.ManagerConfig{}
+	if n.syncConfig != nil && synced.UnmarshalHJSON(n.syncConfig) == nil && synced.Manager.Sync {
+		changed, err = n.doc.ImportChanges(synced.View(nodeName(synced)), mcfg.View(nodeName(mcfg)), n.signer)
+	} else {
+		changed, err = n.doc.Import(mcfg.View(nodeName(mcfg)), n.signer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		if err := n._saveDocument(mcfg); err != nil {
+			return nil, err
+		}
+		n.syncer.Trigger()
+	}
+	return mcfg.WithView(n.doc.View())
+}
+
+func (n *node) _saveDocument(mcfg *mconfig.ManagerConfig) error {
+	data, err := json.MarshalIndent(n.doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(syncStatePath(n.syncPath, mcfg), data, 0600)
+}
+
+// syncFromDocument writes the config document to the config file and applies it,
+// after another device changed it.
+func (n *node) syncFromDocument(logger *log.Logger) {
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+	// the config file may have been edited since it was last read,
+	// record those edits first so that they aren't overwritten
+	base := n.mcfg
+	if cfgBytes, err := os.ReadFile(n.syncPath); err == nil && !bytes.Equal(cfgBytes, n.syncConfig) {
+		edited := &mconfig.ManagerConfig{}
+		if err := edited.UnmarshalHJSON(cfgBytes); err == nil && edited.Manager.Sync {
+			if _, err := n._syncManagerConfig(edited, logger); err != nil {
+				logger.Errorf("Failed to record config file changes: %v", err)
+			} else {
+				base = edited
+			}
+		}
+	}
+	if err := n._saveDocument(base); err != nil {
+		logger.Errorf("Failed to save the config document: %v", err)
+	}
+	mcfg, err := base.WithView(n.doc.View())
+	if err == nil {
+		err = n._writeManagerConfig(mcfg, logger)
+	}
+	if err != nil {
+		logger.Errorf("Failed to apply the synced config document: %v", err)
+		return
+	}
+	logger.Infof("Applied the synced config document with %d devices", len(mcfg.Manager.Devices))
+}
+
+// _writeManagerConfig writes mcfg to the Manager section of the config file if it changed, and applies it.
+// The caller must hold n.reloadMutex.
+func (n *node) _writeManagerConfig(mcfg *mconfig.ManagerConfig, logger *log.Logger) error {
+	cfgBytes, err := os.ReadFile(n.syncPath)
+	if err != nil {
+		return err
+	}
+	current := &mconfig.ManagerConfig{}
+	if err := current.UnmarshalHJSON(cfgBytes); err != nil || !current.Equal(mcfg) {
+		if cfgBytes, err = mconfig.SetManager(cfgBytes, mcfg); err != nil {
+			return err
+		}
+		if err := writeConfigFile(n.syncPath, cfgBytes); err != nil {
+			return err
+		}
+	}
+	n.syncConfig = cfgBytes
+	return n._applyManagerConfig(mcfg, logger)
+}
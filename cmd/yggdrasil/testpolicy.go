@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+)
+
+// testPolicy reports whether device from may reach service on device to under the manager
+// policy, without starting the node. args are "<from> <to> <proto>[/<port>]", "self" names this node.
+func testPolicy(mcfg *mconfig.ManagerConfig, args []string) (bool, error) {
+	if len(args) != 3 {
+		return false, errors.New("expected arguments <from> <to> <proto>[/<port>]")
+	}
+	policy := mcfg.Policy()
+	if policy == nil {
+		return false, errors.New("the config has no Manager.Policy")
+	}
+	from, ok := mcfg.Subject(args[0])
+	if !ok {
+		return false, fmt.Errorf("unknown device %q", args[0])
+	}
+	to, ok := mcfg.Subject(args[1])
+	if !ok {
+		return false, fmt.Errorf("unknown device %q", args[1])
+	}
+	service, err := filter.ParseRule(args[2])
+	if err != nil {
+		return false, err
+	}
+	if service.PortStart != service.PortEnd {
+		return false, fmt.Errorf("expected a single port, got %q", args[2])
+	}
+	now := time.Now()
+	for _, d := range mcfg.Manager.Devices {
+		if (d.Name == args[0] || d.Name == args[1]) && !d.IsActive(now) {
+			fmt.Printf("denied: device %s expired at %s\n", d.Name, d.ExpiresAt.Format(time.RFC3339))
+			return false, nil
+		}
+	}
+	if i, ok := policy.Check(from, to, service); ok {
+		fmt.Printf("allowed: %s may reach %s on %s (policy entry %d)\n", args[0], args[1], service, i)
+		return true, nil
+	}
+	fmt.Printf("denied: no policy entry lets %s reach %s on %s\n", args[0], args[1], service)
+	return false, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gologme/log"
+
+	"github.com/nermolov/yggdrasil-manager/src/management"
+	"github.com/nermolov/yggdrasil-manager/src/traversal"
+)
+
+// startTraversal starts punching through NAT to the devices this node has a session with,
+// if the manager config enables it.
+func (n *node) startTraversal(ctx context.Context, logger *log.Logger) {
+	n.reloadMutex.Lock()
+	enabled, stunServers := n.mcfg.Manager.Traversal, n.mcfg.Manager.TraversalSTUNServers
+	n.reloadMutex.Unlock()
+	if !enabled {
+		return
+	}
+	traverser, err := traversal.NewTraverser(n.core, n.devices, n.management.Port(), stunServers, logger)
+	if err != nil {
+		logger.Errorf("Failed to set up NAT traversal: %v", err)
+		return
+	}
+	if n.admin != nil {
+		traverser.SetupAdminHandlers(n.admin)
+	}
+	n.management.Handle(traversal.PunchPath, management.Devices, traverser)
+	go func() {
+		if err := traverser.Run(ctx, management.Client(n.core.Address())); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Errorf("Failed to run NAT traversal: %v", err)
+		}
+	}()
+	logger.Infof("Punching through NAT to devices")
+}
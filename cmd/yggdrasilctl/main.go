@@ -16,6 +16,16 @@ import (
 	"suah.dev/protect"
 
 	"github.com/olekukonko/tablewriter"
+
+	"github.com/nermolov/yggdrasil-manager/src/apps"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/document"
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+	"github.com/nermolov/yggdrasil-manager/src/lan"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+	"github.com/nermolov/yggdrasil-manager/src/peering"
+	"github.com/nermolov/yggdrasil-manager/src/publicpeers"
+	"github.com/nermolov/yggdrasil-manager/src/traversal"
 	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
 	"github.com/yggdrasil-network/yggdrasil-go/src/core"
 	"github.com/yggdrasil-network/yggdrasil-go/src/multicast"
@@ -323,6 +333,257 @@ func run() int {
 		}
 		table.Render()
 
+	case "getfilterflows":
+		var resp filter.GetFilterFlowsResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"Proto", "Local Address", "Local Port", "Remote Device", "Remote Address", "Remote Port", "Age", "Expires"})
+		for _, f := range resp.Flows {
+			table.Append([]string{
+				f.Protocol,
+				f.LocalAddress,
+				fmt.Sprintf("%d", f.LocalPort),
+				f.RemoteName,
+				f.RemoteAddress,
+				fmt.Sprintf("%d", f.RemotePort),
+				(time.Duration(f.Age) * time.Second).String(),
+				(time.Duration(f.ExpiresIn) * time.Second).String(),
+			})
+		}
+		table.Render()
+
+	case "getfilterstats":
+		var resp filter.GetFilterStatsResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		reasons := []string{
+			filter.DropNotAllowed.String(),
+			filter.DropNoMatchingRule.String(),
+			filter.DropBadSource.String(),
+			filter.DropBlocked.String(),
+		}
+		dropCounts := func(drops map[string]uint64) []string {
+			counts := []string{}
+			for _, reason := range reasons {
+				counts = append(counts, fmt.Sprintf("%d", drops[reason]))
+			}
+			return counts
+		}
+		table.SetHeader([]string{"Device", "IP Address", "Dir", "Not Allowed", "No Rule", "Bad Source", "Blocked", "Last Drop"})
+		table.Append(append(append([]string{"Total", "", "In"}, dropCounts(resp.Inbound)...), "-"))
+		table.Append(append(append([]string{"Total", "", "Out"}, dropCounts(resp.Outbound)...), "-"))
+		for _, r := range resp.Remotes {
+			dir := "In"
+			if r.Direction == "out" {
+				dir = "Out"
+			}
+			row := append([]string{r.Name, r.IPAddress, dir}, dropCounts(r.Drops)...)
+			row = append(row, fmt.Sprintf("%s ago", (time.Duration(r.LastDrop)*time.Second).String()))
+			table.Append(row)
+		}
+		table.Render()
+
+	case "getdevices":
+		var resp devices.GetDevicesResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"Name", "IP Address", "Public Key", "Tags", "Added", "Expires", "Active"})
+		for _, d := range resp.Devices {
+			expires := "-"
+			if d.ExpiresAt != 0 {
+				expires = time.Unix(d.ExpiresAt, 0).Format(time.DateTime)
+			}
+			active := "No"
+			if d.Active {
+				active = "Yes"
+			}
+			table.Append([]string{
+				d.Name,
+				d.IPAddress,
+				d.PublicKey,
+				strings.Join(d.Tags, ", "),
+				time.Unix(d.AddedAt, 0).Format(time.DateTime),
+				expires,
+				active,
+			})
+		}
+		table.Render()
+
+	case "getapps":
+		var resp apps.GetAppsResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"Name", "IP Address", "Accept", "From"})
+		for _, a := range resp.Apps {
+			accept := "any"
+			if len(a.Accept) > 0 {
+				accept = strings.Join(a.Accept, ", ")
+			}
+			table.Append([]string{a.Name, a.IPAddress, accept, strings.Join(a.From, ", ")})
+		}
+		table.Render()
+
+	case "getsync":
+		var resp document.GetSyncResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"Device", "Public Key", "Last Sync", "Last Error"})
+		for _, p := range resp.Peers {
+			lastSync := "-"
+			if p.LastSync != 0 {
+				lastSync = time.Unix(p.LastSync, 0).Format(time.DateTime)
+			}
+			table.Append([]string{p.Name, p.PublicKey, lastSync, p.LastError})
+		}
+		table.Render()
+		deleted := 0
+		for _, e := range resp.Entries {
+			if e.Deleted {
+				deleted++
+			}
+		}
+		fmt.Printf("\nThe config document has %d entries (%d deleted), use -json to list them.\n", len(resp.Entries), deleted)
+
+	case "gettraversal":
+		var resp traversal.GetTraversalResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"Device", "State", "Endpoint", "Since", "Last Attempt", "Last Error"})
+		for _, d := range resp.Devices {
+			since, lastAttempt := "-", "-"
+			if d.Since != 0 {
+				since = time.Unix(d.Since, 0).Format(time.DateTime)
+			}
+			if d.LastAttempt != 0 {
+				lastAttempt = time.Unix(d.LastAttempt, 0).Format(time.DateTime)
+			}
+			table.Append([]string{d.Name, d.State, d.Endpoint, since, lastAttempt, d.LastError})
+		}
+		table.Render()
+		if resp.Endpoint != "" {
+			fmt.Printf("\nThe public endpoint of this node was last seen at %s.\n", resp.Endpoint)
+		}
+
+	case "getlanlinks":
+		var resp lan.GetLANLinksResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"Device", "Hops", "Hops Before", "Endpoint", "Since", "Last Attempt", "Last Error"})
+		for _, d := range resp.Devices {
+			hops, hopsBefore, since, lastAttempt := "-", "-", "-", "-"
+			if d.Hops != 0 {
+				hops = fmt.Sprint(d.Hops)
+			}
+			if d.HopsBefore != 0 {
+				hopsBefore = fmt.Sprint(d.HopsBefore)
+			}
+			if d.Since != 0 {
+				since = time.Unix(d.Since, 0).Format(time.DateTime)
+			}
+			if d.LastAttempt != 0 {
+				lastAttempt = time.Unix(d.LastAttempt, 0).Format(time.DateTime)
+			}
+			table.Append([]string{d.Name, hops, hopsBefore, d.Endpoint, since, lastAttempt, d.LastError})
+		}
+		table.Render()
+		if len(resp.Endpoints) > 0 {
+			fmt.Printf("\nThis node advertises %s.\n", strings.Join(resp.Endpoints, ", "))
+		}
+
+	case "getpeering":
+		var resp peering.GetPeeringResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"URI", "State", "Dir", "Key", "Allowed", "Reason"})
+		for _, p := range resp.Peers {
+			state, dir, allowed := "Down", "Out", "No"
+			if p.Up {
+				state = "Up"
+			}
+			if p.Inbound {
+				dir = "In"
+			}
+			if p.Allowed {
+				allowed = "Yes"
+			}
+			uristring := p.URI
+			if uri, err := url.Parse(p.URI); err == nil {
+				uri.RawQuery = ""
+				uristring = uri.String()
+			}
+			table.Append([]string{uristring, state, dir, p.PublicKey, allowed, p.Reason})
+		}
+		table.Render()
+		fmt.Printf("\nPeering mode is %s with %d keys in the allow list.\n", resp.Mode, resp.AllowedKeys)
+		if len(resp.Relays) > 0 {
+			state := "disconnected"
+			if resp.RelaysUp {
+				state = "connected"
+			}
+			fmt.Printf("The %d relay peers are %s", len(resp.Relays), state)
+			if resp.RelaysSince != 0 {
+				fmt.Printf(" since %s", time.Unix(resp.RelaysSince, 0).Format(time.DateTime))
+			}
+			fmt.Println(".")
+		}
+
+	case "getpublicpeers":
+		var resp publicpeers.GetPublicPeersResponse
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		table.SetHeader([]string{"URI", "Selected", "Since", "State", "RTT", "Last Error"})
+		for _, p := range resp.Peers {
+			selected, since, state, rtt := "No", "-", "Down", "-"
+			if p.Selected {
+				selected, since = "Yes", time.Unix(p.Since, 0).Format(time.DateTime)
+			}
+			if p.Up {
+				state = "Up"
+			}
+			if rttms := float64(p.Latency.Microseconds()) / 1000; rttms > 0 {
+				rtt = fmt.Sprintf("%.02fms", rttms)
+			}
+			table.Append([]string{p.URI, selected, since, state, rtt, p.LastError})
+		}
+		table.Render()
+		fmt.Printf("\nThis node keeps %d public peers", resp.Count)
+		if resp.LastRound != 0 {
+			fmt.Printf(", last picked at %s", time.Unix(resp.LastRound, 0).Format(time.DateTime))
+		}
+		fmt.Println(".")
+		if resp.SourceError != "" {
+			fmt.Printf("Candidates: %s\n", resp.SourceError)
+		}
+
+	case "getdevicehealth":
+		var resp struct {
+			Health management.Health `json:"health"`
+		}
+		if err := json.Unmarshal(recv.Response, &resp); err != nil {
+			panic(err)
+		}
+		h := resp.Health
+		table.Append([]string{"Name:", h.Name})
+		table.Append([]string{"Build name:", h.BuildName})
+		table.Append([]string{"Build version:", h.BuildVersion})
+		table.Append([]string{"IPv6 address:", h.Address})
+		table.Append([]string{"Public key:", h.PublicKey})
+		table.Append([]string{"Uptime:", (time.Duration(h.Uptime) * time.Second).String()})
+		table.Append([]string{"Peers:", fmt.Sprintf("%d", h.Peers)})
+		table.Append([]string{"Sessions:", fmt.Sprintf("%d", h.Sessions)})
+		table.Append([]string{"Devices:", fmt.Sprintf("%d", h.Devices)})
+		table.Append([]string{"Sync:", fmt.Sprintf("%t", h.Sync)})
+		table.Render()
+
 	case "addpeer", "removepeer":
 
 	default:
@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"net"
 	"regexp"
+	"slices"
+	"time"
 
 	"github.com/gologme/log"
 
 	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
 	"github.com/nermolov/yggdrasil-manager/src/filter"
+	"github.com/nermolov/yggdrasil-manager/src/handshake"
 	"github.com/nermolov/yggdrasil-manager/src/ipv6rwc"
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
@@ -29,6 +33,7 @@ type Yggdrasil struct {
 	iprwc     *ipv6rwc.ReadWriteCloser
 	config    *config.NodeConfig
 	mconfig   *mconfig.ManagerConfig
+	devices   *devices.Registry
 	multicast *multicast.Multicast
 	tun       *tun.TunAdapter // optional
 	log       MobileLogger
@@ -77,7 +82,13 @@ func (m *Yggdrasil) StartJSON(configjson []byte) error {
 				options = append(options, core.Peer{URI: peer, SourceInterface: intf})
 			}
 		}
-		for _, allowed := range m.config.AllowedPublicKeys {
+		allowedKeys := slices.DeleteFunc(slices.Clone(m.config.AllowedPublicKeys), m.mconfig.IsRevoked)
+		for _, key := range m.mconfig.DeviceKeys(time.Now()) {
+			if !slices.Contains(allowedKeys, key) {
+				allowedKeys = append(allowedKeys, key)
+			}
+		}
+		for _, allowed := range allowedKeys {
 			k, err := hex.DecodeString(allowed)
 			if err != nil {
 				panic(err)
@@ -120,10 +131,17 @@ func (m *Yggdrasil) StartJSON(configjson []byte) error {
 		}
 	}
 
-	filter, err := filter.NewFilter(m.mconfig.Manager.FilterAllowedPublicKeys)
+	var err error
+	if m.devices, err = devices.NewRegistry(m.mconfig.Manager.Devices); err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	filter, err := filter.NewFilter(m.mconfig.AllowedPublicKeys(now), m.mconfig.FilterOptions(now)...)
 	if err != nil {
 		panic(err)
 	}
+	filter.SetLogger(logger)
+	filter.SetNameResolver(m.devices.NameForIP)
 
 	mtu := m.config.IfMTU
 	m.iprwc = ipv6rwc.NewReadWriteCloser(m.core, filter)
@@ -134,6 +152,52 @@ func (m *Yggdrasil) StartJSON(configjson []byte) error {
 	return nil
 }
 
+// ReloadFilterJSON replaces the devices and tunnel filter policy with the ones from
+// the given JSON config, without restarting the node. Devices that expired since the
+// last call are also removed. This must be called AFTER Start.
+func (m *Yggdrasil) ReloadFilterJSON(configjson []byte) error {
+	mcfg := &mconfig.ManagerConfig{}
+	if err := mcfg.UnmarshalHJSON(configjson); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := m.iprwc.ReloadFilter(mcfg.AllowedPublicKeys(now), mcfg.FilterOptions(now)...); err != nil {
+		return err
+	}
+	if err := m.devices.Update(mcfg.Manager.Devices); err != nil {
+		return err
+	}
+	m.mconfig = mcfg
+	return nil
+}
+
+// ParseInviteJSON decodes an invite token, as text or scanned from its QR code, into
+// JSON with the public key, address and management port of the inviting node, the peers
+// it can be reached through and the expiry time. The secret is not included.
+func (m *Yggdrasil) ParseInviteJSON(token string) (string, error) {
+	t, err := handshake.ParseToken(token)
+	if err != nil {
+		return "", err
+	}
+	addr := address.AddrForKey(t.PublicKey)
+	res, err := json.Marshal(struct {
+		PublicKey string
+		Address   string
+		Port      uint16
+		Peers     []string
+		Expires   time.Time
+		Expired   bool
+	}{
+		PublicKey: hex.EncodeToString(t.PublicKey),
+		Address:   net.IP(addr[:]).String(),
+		Port:      t.Port,
+		Peers:     t.Peers,
+		Expires:   t.Expires,
+		Expired:   t.Expired(),
+	})
+	return string(res), err
+}
+
 // Send sends a packet to Yggdrasil. It should be a fully formed
 // IPv6 packet
 func (m *Yggdrasil) Send(p []byte) error {
@@ -0,0 +1,60 @@
+package integration
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nermolov/yggdrasil-manager/src/apps"
+)
+
+// TestAppAddresses serves two ports on an app address of node1, and expects node3 to reach
+// only the one the app accepts.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestAppAddresses(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	server, client := nodes[0], nodes[2]
+	app := apps.App{Name: "web", Accept: []string{"tcp/8080"}, From: []string{fmt.Sprintf("device-%x", client.PublicKey[:4])}}
+	appIP := app.IP(server.PublicKey)
+
+	runYggdrasilNode(t, server.Namespace, nodeConfig(server, map[string]any{"Apps": []apps.App{app}}))
+	// the app address is in the subnet of node1
+	runYggdrasilNode(t, client.Namespace, nodeConfig(client, map[string]any{"FilterTrustSubnets": true}))
+	time.Sleep(3 * time.Second)
+
+	setNetworkNamespace(server.Namespace)
+	for _, port := range []string{"8080", "8081"} {
+		ln, err := net.Listen("tcp", net.JoinHostPort(appIP.String(), port))
+		if err != nil {
+			t.Fatalf("The app address should be assigned: %v", err)
+		}
+		t.Cleanup(func() { _ = ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}()
+	}
+
+	dial := func(port string) error {
+		setNetworkNamespace(client.Namespace)
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(appIP.String(), port), 2*time.Second)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+	err := dial("8080")
+	if err != nil {
+		err = dial("8080")
+	}
+	assert.NoError(t, err, "node3 should reach the accepted service of the app")
+	assert.Error(t, dial("8081"), "node3 should not reach other services of the app")
+}
@@ -0,0 +1,146 @@
+package integration
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/stretchr/testify/assert"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/handshake"
+)
+
+// waitForToken returns the invite token printed by a node started with -invite.
+func waitForToken(t *testing.T, lines <-chan string) *handshake.Token {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, handshake.TokenPrefix) {
+				continue
+			}
+			token, err := handshake.ParseToken(line)
+			if err != nil {
+				t.Fatalf("Failed to parse invite token: %v", err)
+			}
+			return token
+		case <-timeout:
+			t.Fatal("Timed out waiting for the invite token")
+		}
+	}
+}
+
+// readManagerConfig parses the manager config from a node's config file, returning nil if it isn't valid yet.
+func readManagerConfig(path string) *mconfig.ManagerConfig {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	mcfg := &mconfig.ManagerConfig{}
+	if err := mcfg.UnmarshalHJSON(bs); err != nil {
+		return nil
+	}
+	return mcfg
+}
+
+func hasDevice(mcfg *mconfig.ManagerConfig, name string, node Node) bool {
+	for _, d := range mcfg.Manager.Devices {
+		if d.Name == name && d.PublicKey == hex.EncodeToString(node.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// canPing reports whether target answers any of a few pings from source,
+// the first may be lost while the path is looked up.
+func canPing(t *testing.T, source, target Node) bool {
+	setNetworkNamespace(source.Namespace)
+	pinger, err := probing.NewPinger(target.IPV6Address)
+	if err != nil {
+		t.Fatalf("Failed to create pinger from %s to %s: %v", source.Namespace, target.Namespace, err)
+	}
+	pinger.SetPrivileged(true)
+	pinger.Count = 5
+	pinger.Interval = 200 * time.Millisecond
+	pinger.Timeout = 2 * time.Second
+	if err := pinger.Run(); err != nil {
+		t.Fatalf("Could not run pinger from %s to %s: %v", source.Namespace, target.Namespace, err)
+	}
+	return pinger.Statistics().PacketsRecv > 0
+}
+
+// TestDeviceAddition runs the device addition handshake: node1 invites, node2 joins without
+// any manager config. Afterwards both have each other as devices and can reach each other.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestDeviceAddition(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	inviter, joiner := nodes[0], nodes[1]
+
+	inviterPath, inviterOut := runYggdrasilNodeFromFile(t, inviter.Namespace, nodeConfig(inviter, map[string]any{
+		"Name": inviter.Namespace,
+	}), "-invite", "-invitetimeout", "1m")
+	token := waitForToken(t, inviterOut)
+
+	joinerConfig := nodeConfig(joiner)
+	delete(joinerConfig, "Manager")
+	joinerPath, _ := runYggdrasilNodeFromFile(t, joiner.Namespace, joinerConfig, "-join", token.String(), "-name", "joiner")
+
+	var joinerCfg *mconfig.ManagerConfig
+	deadline := time.Now().Add(30 * time.Second)
+	for joinerCfg == nil && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		joinerCfg = readManagerConfig(joinerPath)
+	}
+	if joinerCfg == nil {
+		t.Fatal("Timed out waiting for node2 to join")
+	}
+	assert.Equal(t, "joiner", joinerCfg.Manager.Name)
+	assert.True(t, hasDevice(joinerCfg, inviter.Namespace, inviter), "the joiner should have the inviter as a device")
+
+	inviterCfg := readManagerConfig(inviterPath)
+	if assert.NotNil(t, inviterCfg) {
+		assert.True(t, hasDevice(inviterCfg, "joiner", joiner), "the inviter should have added the joiner")
+	}
+
+	assert.True(t, canPing(t, joiner, inviter), "node2 should reach node1 after joining")
+	assert.True(t, canPing(t, inviter, joiner), "node1 should reach node2 after joining")
+}
+
+// TestInviteWindowCloses ensures that unknown nodes can reach the management service
+// while an invite is open, and not once it has expired.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestInviteWindowCloses(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	inviter, unknown := nodes[0], nodes[1]
+
+	_, inviterOut := runYggdrasilNodeFromFile(t, inviter.Namespace, nodeConfig(inviter), "-invite", "-invitetimeout", "10s")
+	token := waitForToken(t, inviterOut)
+	// the unknown node may start connections to any node, so only the inviter's filter is tested
+	runYggdrasilNode(t, unknown.Namespace, nodeConfig(unknown, map[string]any{
+		"FilterConnectionTracking": true,
+	}))
+
+	setNetworkNamespace(unknown.Namespace)
+	var reached bool
+	for !reached && time.Now().Add(time.Second).Before(token.Expires) {
+		if conn, err := net.DialTimeout("tcp", token.ManagementAddress(), time.Second); err == nil {
+			reached = true
+			_ = conn.Close()
+		}
+	}
+	assert.True(t, reached, "the management service should be reachable while the invite is open")
+
+	time.Sleep(time.Until(token.Expires) + 2*time.Second)
+	setNetworkNamespace(unknown.Namespace)
+	conn, err := net.DialTimeout("tcp", token.ManagementAddress(), 2*time.Second)
+	if err == nil {
+		_ = conn.Close()
+	}
+	assert.Error(t, err, "the management service should be closed once the invite expired")
+}
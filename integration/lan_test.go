@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLANLinks gives node1 and node3 a LAN on their shared link but no beacons on it, so they
+// reach each other through node2, and expects them to peer directly over the LAN.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestLANLinks(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	first, second, relay := nodes[0], nodes[2], nodes[1]
+
+	addLinkAddress(t, first.Namespace, "10.13.0.1/24", "veth13")
+	addLinkAddress(t, second.Namespace, "10.13.0.3/24", "veth31")
+
+	runYggdrasilNode(t, relay.Namespace, nodeConfig(relay))
+	// either node may peer first
+	output := make(chan string, 100)
+	for _, n := range []Node{first, second} {
+		config := nodeConfig(n, map[string]any{"LANLinks": true})
+		config["Listen"] = []string{"tcp://0.0.0.0:12345"}
+		config["MulticastInterfaces"] = []map[string]any{
+			// the multicast module doesn't keep the order of the rules, so they can't overlap
+			{"Regex": "veth(13|31)", "Beacon": false, "Listen": true},
+			{"Regex": "veth(12|14|32|34)", "Beacon": true, "Listen": true},
+		}
+		_, lines := runYggdrasilNodeFromFile(t, n.Namespace, config)
+		go func() {
+			for line := range lines {
+				output <- line
+			}
+		}()
+	}
+	time.Sleep(3 * time.Second)
+
+	reachable := false
+	for range 5 {
+		if reachable = canPing(t, first, second); reachable {
+			break
+		}
+	}
+	if !assert.True(t, reachable, "node1 should reach node3 through node2") {
+		return
+	}
+	if !waitForLine(output, "is now peered directly over tcp://10.13.0.", 70*time.Second) {
+		t.Fatal("Timed out waiting for node1 and node3 to peer over the LAN")
+	}
+	assert.True(t, canPing(t, first, second), "node1 should reach node3 over the LAN link")
+}
@@ -2,16 +2,137 @@ package integration
 
 import (
 	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"golang.org/x/sys/unix"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 )
 
+const NODE_COUNT = 4
+
+// TUN_NAME is the interface name used by nodes started from tests
+const TUN_NAME = "ygg0"
+
+type Node struct {
+	Namespace               string
+	IPV6Address             string
+	IPV6SubnetAddress       string // first address of the node's routed subnet
+	PrivateKey              ed25519.PrivateKey
+	PublicKey               ed25519.PublicKey
+	FilterAllowedPublicKeys []ed25519.PublicKey
+}
+
+// allows reports whether source is in n's filter allow list.
+func (n Node) allows(source Node) bool {
+	for _, pk := range n.FilterAllowedPublicKeys {
+		if pk.Equal(source.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// generateEvenOddNodes generates NODE_COUNT nodes where even indexed nodes may talk
+// to each other and odd indexed nodes may talk to each other.
+func generateEvenOddNodes() []Node {
+	nodes := []Node{}
+
+	// initial config generation
+	for i := range NODE_COUNT {
+		pubkey, privkey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			panic(err)
+		}
+
+		subnet := address.SubnetForKey(pubkey)
+		subnetAddr := net.IP(append(subnet[:], 0, 0, 0, 0, 0, 0, 0, 1))
+
+		node := Node{
+			Namespace:         fmt.Sprintf("node%d", i+1),
+			PrivateKey:        privkey,
+			PublicKey:         pubkey,
+			IPV6Address:       net.IP(address.AddrForKey(pubkey)[:]).String(),
+			IPV6SubnetAddress: subnetAddr.String(),
+		}
+		nodes = append(nodes, node)
+	}
+
+	// add firewall rules
+	for i := range NODE_COUNT {
+		allowedKeys := []ed25519.PublicKey{}
+		for j := range NODE_COUNT {
+			if i == j {
+				continue
+			}
+			// allow even indexed nodes to talk to each other, block odd indexed nodes
+			if (i%2 == 0 && j%2 == 0) || (i%2 == 1 && j%2 == 1) {
+				allowedKeys = append(allowedKeys, nodes[j].PublicKey)
+			}
+		}
+		nodes[i].FilterAllowedPublicKeys = allowedKeys
+	}
+
+	return nodes
+}
+
+// nodeConfig builds the daemon config for a node, manager options are merged into the Manager section.
+func nodeConfig(node Node, managerOptions ...map[string]any) map[string]any {
+	manager := map[string]any{
+		"Devices": func() []map[string]any {
+			devices := []map[string]any{}
+			for _, pk := range node.FilterAllowedPublicKeys {
+				devices = append(devices, map[string]any{
+					"Name":      fmt.Sprintf("device-%x", pk[:4]),
+					"PublicKey": hex.EncodeToString(pk),
+					"AddedAt":   time.Now(),
+				})
+			}
+			return devices
+		}(),
+	}
+	for _, opts := range managerOptions {
+		for k, v := range opts {
+			manager[k] = v
+		}
+	}
+	return map[string]any{
+		"AdminListen": "none",
+		"IfName":      TUN_NAME,
+		"PrivateKey":  hex.EncodeToString(node.PrivateKey),
+		"Manager":     manager,
+	}
+}
+
+// addTunAddress assigns an additional address to the node's TUN interface.
+func addTunAddress(t *testing.T, namespace string, ip string) {
+	out, err := exec.Command("ip", "netns", "exec", namespace, "ip", "-6", "addr", "add", ip+"/128", "dev", TUN_NAME, "nodad").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to add address %s in %s: %v: %s", ip, namespace, err, out)
+	}
+}
+
+// addLinkAddress assigns an address to a veth link of the namespace until the test ends.
+func addLinkAddress(t *testing.T, namespace string, addr string, dev string) {
+	if out, err := exec.Command("ip", "netns", "exec", namespace, "ip", "addr", "add", addr, "dev", dev).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to add address %s in %s: %v: %s", addr, namespace, err, out)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command("ip", "netns", "exec", namespace, "ip", "addr", "del", addr, "dev", dev).Run()
+	})
+}
+
 func setNetworkNamespace(nsName string) {
 	nsPath := "/run/netns/" + nsName
 
@@ -34,30 +155,7 @@ func setNetworkNamespace(nsName string) {
 
 func runYggdrasilNode(t *testing.T, namespace string, config map[string]any) {
 	cmd := exec.CommandContext(t.Context(), "ip", "netns", "exec", namespace, "../yggdrasil", "-useconf")
-
-	// log stdout/stderr with prefix
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		t.Fatalf("Failed to get stdout pipe: %v", err)
-	}
-	go func(ns string, rdr io.Reader) {
-		scanner := bufio.NewScanner(rdr)
-		for scanner.Scan() {
-			t.Logf("[%s] %s", ns, scanner.Text())
-		}
-	}(namespace, stdout)
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		t.Fatalf("Failed to get stderr pipe: %v", err)
-	}
-
-	go func(ns string, rdr io.Reader) {
-		scanner := bufio.NewScanner(rdr)
-		for scanner.Scan() {
-			t.Logf("[%s] STDERR: %s", ns, scanner.Text())
-		}
-	}(namespace, stderr)
+	logOutput(t, namespace, cmd, nil)
 
 	// write config
 	stdin, err := cmd.StdinPipe()
@@ -82,3 +180,58 @@ func runYggdrasilNode(t *testing.T, namespace string, config map[string]any) {
 		t.Fatalf("Failed to start node %s: %v", namespace, err)
 	}
 }
+
+// runYggdrasilNodeFromFile writes config to a file and starts a node from it with extra arguments.
+// Returns the config file path and the lines the node writes to stdout.
+func runYggdrasilNodeFromFile(t *testing.T, namespace string, config map[string]any, args ...string) (string, <-chan string) {
+	path := filepath.Join(t.TempDir(), namespace+".json")
+	bs, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	if err := os.WriteFile(path, bs, 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	args = append([]string{"netns", "exec", namespace, "../yggdrasil", "-useconffile", path}, args...)
+	cmd := exec.CommandContext(t.Context(), "ip", args...)
+	lines := make(chan string, 100)
+	logOutput(t, namespace, cmd, lines)
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start node %s: %v", namespace, err)
+	}
+	return path, lines
+}
+
+// logOutput logs stdout/stderr of cmd with a prefix, stdout lines are also sent to lines if set.
+func logOutput(t *testing.T, namespace string, cmd *exec.Cmd, lines chan<- string) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stdout pipe: %v", err)
+	}
+	go func(ns string, rdr io.Reader) {
+		scanner := bufio.NewScanner(rdr)
+		for scanner.Scan() {
+			t.Logf("[%s] %s", ns, scanner.Text())
+			if lines != nil {
+				select {
+				case lines <- scanner.Text():
+				default:
+				}
+			}
+		}
+	}(namespace, stdout)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatalf("Failed to get stderr pipe: %v", err)
+	}
+
+	go func(ns string, rdr io.Reader) {
+		scanner := bufio.NewScanner(rdr)
+		for scanner.Scan() {
+			t.Logf("[%s] STDERR: %s", ns, scanner.Text())
+		}
+	}(namespace, stderr)
+}
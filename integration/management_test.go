@@ -0,0 +1,95 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// managementRequest sends a request from source to the management service of target.
+// Returns 0 if target can't be reached.
+func managementRequest(t *testing.T, source, target Node, method, path, body string) (int, []byte) {
+	setNetworkNamespace(source.Namespace)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(target.IPV6Address, "9777"), 2*time.Second)
+	if err != nil {
+		return 0, nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req, err := http.NewRequest(method, "http://"+conn.RemoteAddr().String()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Write(conn); err != nil {
+		return 0, nil
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, nil
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+	return res.StatusCode, resBody
+}
+
+// TestManagementService queries the health of node1 from node3, a device of node1, and uses
+// node1's admin socket remotely from node3, which is a management admin of node1.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestManagementService(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	server, admin, device := nodes[0], nodes[2], nodes[3]
+	adminKey := hex.EncodeToString(admin.PublicKey)
+
+	config := nodeConfig(server, map[string]any{
+		"Name":             server.Namespace,
+		"ManagementAdmins": []string{adminKey},
+	})
+	config["AdminListen"] = "unix://" + filepath.Join(t.TempDir(), "admin.sock")
+	runYggdrasilNode(t, server.Namespace, config)
+	runYggdrasilNode(t, admin.Namespace, nodeConfig(admin))
+	runYggdrasilNode(t, device.Namespace, nodeConfig(device))
+	time.Sleep(3 * time.Second)
+
+	var status int
+	var body []byte
+	for range 5 {
+		if status, body = managementRequest(t, admin, server, http.MethodGet, management.HealthPath, ""); status != 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if assert.Equal(t, http.StatusOK, status, "devices can query the health") {
+		var health management.Health
+		assert.NoError(t, json.Unmarshal(body, &health))
+		assert.Equal(t, server.Namespace, health.Name)
+		assert.Equal(t, hex.EncodeToString(server.PublicKey), health.PublicKey)
+		assert.Equal(t, 1, health.Devices)
+	}
+
+	status, body = managementRequest(t, admin, server, http.MethodPost, management.AdminPath, `{"request":"getself"}`)
+	if assert.Equal(t, http.StatusOK, status, "admins can use the admin socket") {
+		var res struct {
+			Status   string `json:"status"`
+			Response struct {
+				PublicKey string `json:"key"`
+			} `json:"response"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &res))
+		assert.Equal(t, "success", res.Status)
+		assert.Equal(t, hex.EncodeToString(server.PublicKey), res.Response.PublicKey)
+	}
+
+	status, _ = managementRequest(t, device, server, http.MethodGet, management.HealthPath, "")
+	assert.Equal(t, 0, status, "other nodes can't reach the management service")
+}
@@ -0,0 +1,80 @@
+package integration
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPrivateMesh runs node1 as a private mesh with node4 as its relay peer, and expects it to
+// accept the peering of its device node3 but not of node2, even though node2 is in its
+// AllowedPublicKeys.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestPrivateMesh(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	mesh, stranger, device, relay := nodes[0], nodes[1], nodes[2], nodes[3]
+
+	addLinkAddress(t, mesh.Namespace, "10.12.0.1/24", "veth12")
+	addLinkAddress(t, stranger.Namespace, "10.12.0.2/24", "veth21")
+	addLinkAddress(t, mesh.Namespace, "10.13.0.1/24", "veth13")
+	addLinkAddress(t, device.Namespace, "10.13.0.3/24", "veth31")
+	addLinkAddress(t, mesh.Namespace, "10.14.0.1/24", "veth14")
+	addLinkAddress(t, relay.Namespace, "10.14.0.4/24", "veth41")
+
+	// the relay only lets its devices peer too
+	relayConfig := nodeConfig(relay, map[string]any{
+		"Devices": []map[string]any{{"Name": "node1", "PublicKey": hex.EncodeToString(mesh.PublicKey), "AddedAt": time.Now()}},
+	})
+	relayConfig["Listen"] = []string{"tcp://0.0.0.0:12345"}
+	relayConfig["MulticastInterfaces"] = []any{}
+	runYggdrasilNode(t, relay.Namespace, relayConfig)
+
+	meshConfig := nodeConfig(mesh, map[string]any{
+		"PrivateMesh": true,
+		"RelayPeers":  []string{"tcp://10.14.0.4:12345"},
+	})
+	meshConfig["Listen"] = []string{"tcp://0.0.0.0:12345"}
+	meshConfig["AllowedPublicKeys"] = []string{hex.EncodeToString(stranger.PublicKey)}
+	meshConfig["MulticastInterfaces"] = []any{}
+	_, lines := runYggdrasilNodeFromFile(t, mesh.Namespace, meshConfig)
+
+	for _, p := range []struct {
+		node Node
+		peer string
+	}{{stranger, "tcp://10.12.0.1:12345"}, {device, "tcp://10.13.0.1:12345"}} {
+		config := nodeConfig(p.node)
+		config["Peers"] = []string{p.peer}
+		config["MulticastInterfaces"] = []any{}
+		runYggdrasilNode(t, p.node.Namespace, config)
+	}
+
+	var connected []string
+	deadline := time.After(15 * time.Second)
+collect:
+	for {
+		select {
+		case line := <-lines:
+			if _, link, ok := strings.Cut(line, " Connected "); ok {
+				_, remote, _ := strings.Cut(link, ": ")
+				connected = append(connected, remote)
+			}
+		case <-deadline:
+			break collect
+		}
+	}
+	hasPeer := func(n Node) bool {
+		for _, remote := range connected {
+			if strings.HasPrefix(remote, n.IPV6Address+"@") {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, hasPeer(relay), "node1 should connect to the relay while no device is peered")
+	assert.True(t, hasPeer(device), "node1 should accept the peering of its device")
+	assert.False(t, hasPeer(stranger), "node1 should not accept the peering of node2")
+	assert.True(t, canPing(t, mesh, device), "node1 should reach node3")
+}
@@ -0,0 +1,46 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPublicPeers gives node1 a local peer index listing node3 and an address nothing listens
+// on, and expects it to pick node3 as its public peer at runtime.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestPublicPeers(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	first, public := nodes[0], nodes[2]
+
+	addLinkAddress(t, first.Namespace, "10.12.0.1/24", "veth12")
+	addLinkAddress(t, first.Namespace, "10.13.0.1/24", "veth13")
+	addLinkAddress(t, public.Namespace, "10.13.0.3/24", "veth31")
+
+	publicConfig := nodeConfig(public)
+	publicConfig["Listen"] = []string{"tcp://0.0.0.0:12345"}
+	publicConfig["MulticastInterfaces"] = []any{}
+	runYggdrasilNode(t, public.Namespace, publicConfig)
+
+	index := filepath.Join(t.TempDir(), "peers.txt")
+	if err := os.WriteFile(index, []byte("tcp://10.12.0.2:12345\ntcp://10.13.0.3:12345\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := nodeConfig(first, map[string]any{
+		"PublicPeers":     1,
+		"PublicPeerIndex": index,
+	})
+	config["MulticastInterfaces"] = []any{}
+	path, lines := runYggdrasilNodeFromFile(t, first.Namespace, config)
+
+	if !waitForLine(lines, "Adding public peer tcp://10.13.0.3:12345", 15*time.Second) {
+		t.Fatal("Timed out waiting for node1 to pick node3")
+	}
+	time.Sleep(2 * time.Second)
+	assert.True(t, canPing(t, first, public), "node1 should reach node3 through the picked peer")
+	_, err := os.Stat(path + ".peers")
+	assert.NoError(t, err, "the index should be cached next to the config file")
+}
@@ -0,0 +1,67 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSubnetFirewall ensures that traffic between the routed subnets of nodes follows the
+// firewall rules when subnets are trusted.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestSubnetFirewall(t *testing.T) {
+	nodes := generateEvenOddNodes()
+
+	for i := range NODE_COUNT {
+		t.Logf("Starting node %s with trusted subnets", nodes[i].Namespace)
+
+		runYggdrasilNode(t, nodes[i].Namespace, nodeConfig(nodes[i], map[string]any{
+			"FilterTrustSubnets": true,
+		}))
+	}
+
+	// wait for nodes to discover each other
+	time.Sleep(3 * time.Second)
+
+	for i := range NODE_COUNT {
+		addTunAddress(t, nodes[i].Namespace, nodes[i].IPV6SubnetAddress)
+	}
+
+	t.Log("Pinging between node subnets to test firewall rules")
+
+	for sourceIdx := range nodes {
+		for targetIdx := range nodes {
+			if sourceIdx == targetIdx {
+				continue
+			}
+
+			setNetworkNamespace(nodes[sourceIdx].Namespace)
+
+			pinger, err := probing.NewPinger(nodes[targetIdx].IPV6SubnetAddress)
+			if err != nil {
+				t.Fatalf("Failed to create pinger from %s to %s: %v", nodes[sourceIdx].Namespace, nodes[targetIdx].Namespace, err)
+			}
+
+			pinger.SetPrivileged(true)
+			pinger.Source = nodes[sourceIdx].IPV6SubnetAddress
+			pinger.Count = 1
+			pinger.Timeout = 100 * time.Millisecond
+
+			t.Logf("Pinging from %s (%s) to %s (%s)", nodes[sourceIdx].Namespace, nodes[sourceIdx].IPV6SubnetAddress, nodes[targetIdx].Namespace, nodes[targetIdx].IPV6SubnetAddress)
+
+			err = pinger.Run()
+			if err != nil {
+				t.Fatalf("Could not run pinger from %s to %s: %v", nodes[sourceIdx].Namespace, nodes[targetIdx].Namespace, err)
+			}
+
+			stats := pinger.Statistics()
+			if nodes[targetIdx].allows(nodes[sourceIdx]) {
+				assert.Equal(t, pinger.Count, stats.PacketsRecv, "All packets should be received from %s to %s", nodes[sourceIdx].Namespace, nodes[targetIdx].Namespace)
+			} else {
+				assert.Equal(t, 0, stats.PacketsRecv, "No packets should be received from %s to %s", nodes[sourceIdx].Namespace, nodes[targetIdx].Namespace)
+			}
+		}
+	}
+}
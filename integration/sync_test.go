@@ -0,0 +1,109 @@
+package integration
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	mconfig "github.com/nermolov/yggdrasil-manager/src/config"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+// TestConfigSync adds a device to the config file of node1 and expects it to show up
+// in the config file of node3, which node1 syncs its config document with.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestConfigSync(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	first, second, added := nodes[0], nodes[2], nodes[1]
+
+	firstPath, _ := runYggdrasilNodeFromFile(t, first.Namespace, nodeConfig(first, map[string]any{
+		"Name": first.Namespace,
+		"Sync": true,
+	}), "-watchconf")
+	secondPath, _ := runYggdrasilNodeFromFile(t, second.Namespace, nodeConfig(second, map[string]any{
+		"Name": second.Namespace,
+		"Sync": true,
+	}), "-watchconf")
+	time.Sleep(2 * time.Second)
+
+	cfgBytes, err := os.ReadFile(firstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgBytes, err = mconfig.AddDevice(cfgBytes, devices.Device{
+		Name:      "added",
+		PublicKey: hex.EncodeToString(added.PublicKey),
+		AddedAt:   time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(firstPath, cfgBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if mcfg := readManagerConfig(secondPath); mcfg != nil && hasDevice(mcfg, "added", added) {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the added device to be synced to node3")
+}
+
+// TestRevocationSync revokes node2 on node1 and expects node3, which node1 syncs its config
+// document with, to stop exchanging traffic with node2.
+// Relies on `run-four-fully-connected-nodes.sh` to set up 4 network namespaces.
+func TestRevocationSync(t *testing.T) {
+	nodes := generateEvenOddNodes()
+	first, second, revoked := nodes[0], nodes[2], nodes[1]
+	device := func(name string, node Node) map[string]any {
+		return map[string]any{"Name": name, "PublicKey": hex.EncodeToString(node.PublicKey), "AddedAt": time.Now()}
+	}
+
+	firstPath, _ := runYggdrasilNodeFromFile(t, first.Namespace, nodeConfig(first, map[string]any{
+		"Name":    first.Namespace,
+		"Sync":    true,
+		"Devices": []map[string]any{device(second.Namespace, second), device(revoked.Namespace, revoked)},
+	}), "-watchconf")
+	secondPath, _ := runYggdrasilNodeFromFile(t, second.Namespace, nodeConfig(second, map[string]any{
+		"Name":    second.Namespace,
+		"Sync":    true,
+		"Devices": []map[string]any{device(first.Namespace, first), device(revoked.Namespace, revoked)},
+	}))
+	runYggdrasilNode(t, revoked.Namespace, nodeConfig(revoked, map[string]any{
+		"Devices": []map[string]any{device(first.Namespace, first), device(second.Namespace, second)},
+	}))
+	time.Sleep(2 * time.Second)
+	if !canPing(t, second, revoked) && !canPing(t, second, revoked) {
+		t.Fatal("node3 should reach node2 before the revocation")
+	}
+
+	cfgBytes, err := os.ReadFile(firstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfgBytes, err = mconfig.Revoke(cfgBytes, hex.EncodeToString(revoked.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(firstPath, cfgBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if mcfg := readManagerConfig(secondPath); mcfg != nil && mcfg.IsRevoked(hex.EncodeToString(revoked.PublicKey)) {
+			assert.False(t, hasDevice(mcfg, revoked.Namespace, revoked), "the revoked device should be removed")
+			time.Sleep(time.Second) // the file is written just before it's applied
+			assert.False(t, canPing(t, second, revoked), "node3 should no longer reach node2")
+			assert.False(t, canPing(t, revoked, second), "node2 should no longer reach node3")
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the revocation to be synced to node3")
+}
@@ -0,0 +1,101 @@
+package integration
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nermolov/yggdrasil-manager/src/traversal"
+)
+
+// waitForLine waits for a line containing substr.
+func waitForLine(lines <-chan string, substr string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, substr) {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// TestNATTraversal runs lan1 and lan2 behind separate NATs, peered only with a node on the
+// internet namespace, and expects them to punch through to each other and peer directly.
+// Once UDP through the NAT of lan1 is blocked, they keep reaching each other through the
+// internet node.
+// Relies on `configure-nat-namespaces.sh` to set up the NAT network namespaces.
+func TestNATTraversal(t *testing.T) {
+	if _, err := os.Stat("/run/netns/lan1"); err != nil {
+		t.Skip("NAT network namespaces are not set up")
+	}
+	nodes := generateEvenOddNodes()
+	first, second, public := nodes[0], nodes[2], nodes[1]
+	first.Namespace, second.Namespace, public.Namespace = "lan1", "lan2", "internet"
+
+	setNetworkNamespace(public.Namespace)
+	stun, err := net.ListenPacket("udp4", "203.0.113.1:3478")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Close()
+	go func() { _ = traversal.ServeSTUN(stun) }()
+
+	publicConfig := nodeConfig(public, map[string]any{
+		"Devices": []map[string]any{
+			{"Name": "lan1", "PublicKey": hex.EncodeToString(first.PublicKey), "AddedAt": time.Now()},
+			{"Name": "lan2", "PublicKey": hex.EncodeToString(second.PublicKey), "AddedAt": time.Now()},
+		},
+	})
+	publicConfig["Listen"] = []string{"tcp://0.0.0.0:12345"}
+	runYggdrasilNode(t, public.Namespace, publicConfig)
+
+	var output []<-chan string
+	for _, n := range []Node{first, second} {
+		config := nodeConfig(n, map[string]any{
+			"Traversal":            true,
+			"TraversalSTUNServers": []string{"203.0.113.1:3478"},
+		})
+		config["Peers"] = []string{"tcp://203.0.113.1:12345"}
+		_, lines := runYggdrasilNodeFromFile(t, n.Namespace, config)
+		output = append(output, lines)
+	}
+	time.Sleep(3 * time.Second)
+
+	// the session is what the devices punch for
+	reachable := false
+	for range 5 {
+		if reachable = canPing(t, first, second); reachable {
+			break
+		}
+	}
+	if !assert.True(t, reachable, "lan1 should reach lan2 through the internet node") {
+		return
+	}
+	if !waitForLine(output[0], "Peering directly with device", 60*time.Second) {
+		t.Fatal("Timed out waiting for lan1 and lan2 to peer directly")
+	}
+	assert.True(t, canPing(t, first, second), "lan1 should reach lan2 over the direct peering")
+
+	block := exec.Command("ip", "netns", "exec", "nat1", "nft", "-f", "-")
+	block.Stdin = strings.NewReader("table inet block { chain forward { type filter hook forward priority filter - 1; meta l4proto udp drop; } }")
+	if out, err := block.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to block UDP through nat1: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command("ip", "netns", "exec", "nat1", "nft", "delete", "table", "inet", "block").Run()
+	})
+	if !waitForLine(output[0], "Direct peering with device", 60*time.Second) {
+		t.Fatal("Timed out waiting for the direct peering to close")
+	}
+	assert.True(t, canPing(t, first, second), "lan1 should reach lan2 through the internet node again")
+}
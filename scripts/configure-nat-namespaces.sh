@@ -0,0 +1,85 @@
+#!/bin/bash
+
+# Creates two LANs behind NAT routers that are connected through an internet namespace.
+# The routers masquerade LAN traffic with nftables and drop unsolicited traffic from the
+# internet, like home routers do.
+
+# lan1 --- nat1 ---+
+#                  internet (203.0.113.1, 203.0.113.5)
+# lan2 --- nat2 ---+
+
+echo "-- Setting up network"
+
+NAMESPACES="internet nat1 nat2 lan1 lan2"
+
+# Cleanup any existing namespaces
+for ns in $NAMESPACES; do
+  ip netns delete $ns 2>/dev/null
+done
+
+for ns in $NAMESPACES; do
+  ip netns add $ns
+  ip netns exec $ns ip link set lo up
+done
+
+# internet <-> nat1, nat2
+ip link add inet-nat1 type veth peer name nat1-wan
+ip link set inet-nat1 netns internet up
+ip link set nat1-wan netns nat1 up
+ip netns exec internet ip addr add 203.0.113.1/30 dev inet-nat1
+ip netns exec nat1 ip addr add 203.0.113.2/30 dev nat1-wan
+
+ip link add inet-nat2 type veth peer name nat2-wan
+ip link set inet-nat2 netns internet up
+ip link set nat2-wan netns nat2 up
+ip netns exec internet ip addr add 203.0.113.5/30 dev inet-nat2
+ip netns exec nat2 ip addr add 203.0.113.6/30 dev nat2-wan
+
+ip netns exec internet sysctl -q -w net.ipv4.ip_forward=1
+
+# nat1, nat2 <-> lan1, lan2
+for i in 1 2; do
+  ip link add nat$i-lan type veth peer name lan$i-eth
+  ip link set nat$i-lan netns nat$i up
+  ip link set lan$i-eth netns lan$i up
+  ip netns exec nat$i ip addr add 10.0.$i.1/24 dev nat$i-lan
+  ip netns exec lan$i ip addr add 10.0.$i.2/24 dev lan$i-eth
+  ip netns exec lan$i ip route add default via 10.0.$i.1
+
+  if [ $i = 1 ]; then gateway=203.0.113.1; else gateway=203.0.113.5; fi
+  ip netns exec nat$i ip route add default via $gateway
+  ip netns exec nat$i sysctl -q -w net.ipv4.ip_forward=1
+  ip netns exec nat$i nft -f - <<EOF
+table inet nat$i {
+  chain postrouting {
+    type nat hook postrouting priority srcnat;
+    oifname "nat$i-wan" masquerade
+  }
+  chain input {
+    type filter hook input priority filter; policy drop;
+    iifname "lo" accept
+    iifname "nat$i-lan" accept
+    ct state established,related accept
+  }
+  chain forward {
+    type filter hook forward priority filter; policy drop;
+    iifname "nat$i-lan" accept
+    ct state established,related accept
+  }
+}
+EOF
+done
+
+echo "Set up complete, press Ctrl+C to clean up."
+
+cleanup() {
+  echo "-- Cleaning up network"
+  for ns in $NAMESPACES; do
+    ip netns delete $ns
+  done
+  exit 0
+}
+
+trap cleanup SIGINT
+
+while true; do sleep 1; done
@@ -0,0 +1,170 @@
+// Package acl compiles tag based access policies into per-device filter rules.
+package acl
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+)
+
+const (
+	selectorAny    = "*"
+	selectorSelf   = "self"
+	selectorTagPfx = "tag:"
+)
+
+// Entry grants the devices matching From access to services on the devices matching To,
+// e.g. "tag:servers accept tcp/443 from tag:laptops".
+type Entry struct {
+	To     []string `comment:"Devices offering the services: device names, \"tag:<tag>\", \"self\" for this node or \"*\" for any device"`
+	Accept []string `comment:"Services accepted, e.g. \"tcp/443\", \"udp/5353\", \"tcp/8000-8080\", \"icmp\" or \"any\""`
+	From   []string `comment:"Devices allowed to connect: device names, \"tag:<tag>\", \"self\" or \"*\""`
+}
+
+// Subject is a device (or this node) as seen by the policy.
+type Subject struct {
+	Name string
+	Tags []string
+	Self bool
+}
+
+type selector struct {
+	any  bool
+	self bool
+	tag  string
+	name string
+}
+
+func (s selector) matches(subject Subject) bool {
+	switch {
+	case s.any:
+		return true
+	case s.self:
+		return subject.Self
+	case s.tag != "":
+		return slices.Contains(subject.Tags, s.tag)
+	default:
+		return subject.Name != "" && subject.Name == s.name
+	}
+}
+
+type entry struct {
+	to     []selector
+	from   []selector
+	accept []filter.Rule
+}
+
+// Policy is a compiled list of entries.
+type Policy struct {
+	entries []entry
+}
+
+// Compile validates entries against the known devices and this node, which may also be
+// referred to by its name. Unknown device names and tags are errors, as they are most likely typos.
+func Compile(entries []Entry, known []devices.Device, self Subject) (*Policy, error) {
+	names := map[string]struct{}{}
+	tags := map[string]struct{}{}
+	if self.Name != "" {
+		names[self.Name] = struct{}{}
+	}
+	for _, t := range self.Tags {
+		tags[t] = struct{}{}
+	}
+	for _, d := range known {
+		if d.Name == selectorAny || d.Name == selectorSelf || strings.HasPrefix(d.Name, selectorTagPfx) {
+			return nil, fmt.Errorf("device name %q is reserved in policies", d.Name)
+		}
+		names[d.Name] = struct{}{}
+		for _, t := range d.Tags {
+			tags[t] = struct{}{}
+		}
+	}
+	parseSelectors := func(field string, ss []string) ([]selector, error) {
+		if len(ss) == 0 {
+			return nil, fmt.Errorf("%s is empty", field)
+		}
+		selectors := make([]selector, 0, len(ss))
+		for _, s := range ss {
+			switch {
+			case s == selectorAny:
+				selectors = append(selectors, selector{any: true})
+			case s == selectorSelf:
+				selectors = append(selectors, selector{self: true})
+			case strings.HasPrefix(s, selectorTagPfx):
+				tag := strings.TrimPrefix(s, selectorTagPfx)
+				if _, ok := tags[tag]; !ok {
+					return nil, fmt.Errorf("%s: unknown tag %q", field, tag)
+				}
+				selectors = append(selectors, selector{tag: tag})
+			default:
+				if _, ok := names[s]; !ok {
+					return nil, fmt.Errorf("%s: unknown device %q", field, s)
+				}
+				selectors = append(selectors, selector{name: s})
+			}
+		}
+		return selectors, nil
+	}
+	p := &Policy{entries: make([]entry, 0, len(entries))}
+	for i, e := range entries {
+		var c entry
+		var err error
+		if c.to, err = parseSelectors("To", e.To); err != nil {
+			return nil, fmt.Errorf("policy entry %d: %w", i, err)
+		}
+		if c.from, err = parseSelectors("From", e.From); err != nil {
+			return nil, fmt.Errorf("policy entry %d: %w", i, err)
+		}
+		if len(e.Accept) == 0 {
+			return nil, fmt.Errorf("policy entry %d: Accept is empty", i)
+		}
+		for _, s := range e.Accept {
+			r, err := filter.ParseRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("policy entry %d: %w", i, err)
+			}
+			c.accept = append(c.accept, r)
+		}
+		p.entries = append(p.entries, c)
+	}
+	return p, nil
+}
+
+func matchesAny(selectors []selector, subject Subject) bool {
+	for _, s := range selectors {
+		if s.matches(subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns the services on to that from may reach.
+func (p *Policy) Rules(from, to Subject) []filter.Rule {
+	var rules []filter.Rule
+	for _, e := range p.entries {
+		if matchesAny(e.to, to) && matchesAny(e.from, from) {
+			rules = append(rules, e.accept...)
+		}
+	}
+	return rules
+}
+
+// Check reports whether from may reach service on to, along with the index of the
+// first entry granting access.
+func (p *Policy) Check(from, to Subject, service filter.Rule) (int, bool) {
+	for i, e := range p.entries {
+		if !matchesAny(e.to, to) || !matchesAny(e.from, from) {
+			continue
+		}
+		for _, r := range e.accept {
+			if r.Covers(service) {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
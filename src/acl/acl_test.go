@@ -0,0 +1,76 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+)
+
+func TestCompile(t *testing.T) {
+	known := []devices.Device{{Name: "laptop", Tags: []string{"laptops"}}}
+	_, err := Compile([]Entry{{To: []string{"self"}, Accept: []string{"tcp/22"}, From: []string{"tag:laptops"}}}, known, Subject{Self: true})
+	assert.NoError(t, err)
+
+	invalid := map[string]Entry{
+		"unknown tag":    {To: []string{"self"}, Accept: []string{"tcp/22"}, From: []string{"tag:phones"}},
+		"unknown device": {To: []string{"server"}, Accept: []string{"tcp/22"}, From: []string{"*"}},
+		"bad port":       {To: []string{"self"}, Accept: []string{"tcp/99999"}, From: []string{"*"}},
+		"no services":    {To: []string{"self"}, From: []string{"*"}},
+		"no targets":     {Accept: []string{"tcp/22"}, From: []string{"*"}},
+	}
+	for name, e := range invalid {
+		_, err := Compile([]Entry{e}, known, Subject{Self: true})
+		assert.Error(t, err, name)
+	}
+
+	_, err = Compile(nil, []devices.Device{{Name: "self"}}, Subject{Self: true})
+	assert.Error(t, err, "reserved device names are rejected")
+}
+
+func TestPolicy(t *testing.T) {
+	known := []devices.Device{
+		{Name: "laptop", Tags: []string{"laptops"}},
+		{Name: "phone", Tags: []string{"phones"}},
+		{Name: "nas", Tags: []string{"servers"}},
+	}
+	p, err := Compile([]Entry{
+		{To: []string{"tag:servers"}, Accept: []string{"tcp/443", "tcp/8000-8080"}, From: []string{"tag:laptops"}},
+		{To: []string{"*"}, Accept: []string{"icmp"}, From: []string{"*"}},
+		{To: []string{"nas"}, Accept: []string{"udp/5353"}, From: []string{"phone"}},
+	}, known, Subject{Tags: []string{"servers"}, Self: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := Subject{Name: "laptop", Tags: []string{"laptops"}}
+	phone := Subject{Name: "phone", Tags: []string{"phones"}}
+	nas := Subject{Name: "nas", Tags: []string{"servers"}}
+	self := Subject{Tags: []string{"servers"}, Self: true}
+	rule := func(s string) filter.Rule {
+		r, _ := filter.ParseRule(s)
+		return r
+	}
+
+	i, ok := p.Check(laptop, nas, rule("tcp/443"))
+	assert.True(t, ok)
+	assert.Equal(t, 0, i)
+	_, ok = p.Check(laptop, self, rule("tcp/8080"))
+	assert.True(t, ok, "tags match this node")
+	_, ok = p.Check(laptop, nas, rule("tcp/22"))
+	assert.False(t, ok)
+	_, ok = p.Check(nas, laptop, rule("tcp/443"))
+	assert.False(t, ok, "access is one way")
+
+	_, ok = p.Check(phone, nas, rule("udp/5353"))
+	assert.True(t, ok)
+	_, ok = p.Check(phone, self, rule("udp/5353"))
+	assert.False(t, ok, "device names don't match this node")
+	i, ok = p.Check(phone, laptop, rule("icmp"))
+	assert.True(t, ok)
+	assert.Equal(t, 1, i)
+
+	assert.Equal(t, []filter.Rule{rule("tcp/443"), rule("tcp/8000-8080"), rule("icmp")}, p.Rules(laptop, self))
+	assert.Equal(t, []filter.Rule{rule("icmp")}, p.Rules(Subject{}, self))
+}
@@ -0,0 +1,39 @@
+//go:build linux
+
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// AddAddress assigns ip to the interface named ifname, so that local applications can bind it.
+// Duplicate address detection is skipped, as the address is unique to this node.
+func AddAddress(ifname string, ip net.IP) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifname, err)
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, Flags: syscall.IFA_F_NODAD}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("failed to add address %s: %w", ip, err)
+	}
+	return nil
+}
+
+// RemoveAddress removes an address added by AddAddress.
+func RemoveAddress(ifname string, ip net.IP) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifname, err)
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}}
+	if err := netlink.AddrDel(link, addr); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove address %s: %w", ip, err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package apps
+
+import (
+	"fmt"
+	"net"
+)
+
+// AddAddress is not supported on this platform, app addresses must be assigned manually.
+func AddAddress(ifname string, ip net.IP) error {
+	return fmt.Errorf("can't add address %s, app addresses must be assigned to %s manually on this platform", ip, ifname)
+}
+
+// RemoveAddress is not supported on this platform.
+func RemoveAddress(ifname string, ip net.IP) error {
+	return nil
+}
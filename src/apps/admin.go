@@ -0,0 +1,44 @@
+package apps
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetAppsRequest struct{}
+type GetAppsResponse struct {
+	Apps []AppEntry `json:"apps"`
+}
+
+type AppEntry struct {
+	Name      string   `json:"name"`
+	IPAddress string   `json:"address"`
+	Accept    []string `json:"accept,omitempty"`
+	From      []string `json:"from"`
+}
+
+// SetupAdminHandlers adds the getApps handler, listing the apps returned by list
+// with their addresses on the node with the given key.
+func SetupAdminHandlers(a *admin.AdminSocket, key ed25519.PublicKey, list func() []App) {
+	_ = a.AddHandler(
+		"getApps", "Show local apps and their addresses", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetAppsRequest{}
+			res := &GetAppsResponse{Apps: []AppEntry{}}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			for _, app := range list() {
+				res.Apps = append(res.Apps, AppEntry{
+					Name:      app.Name,
+					IPAddress: app.IP(key).String(),
+					Accept:    app.Accept,
+					From:      app.From,
+				})
+			}
+			return res, nil
+		},
+	)
+}
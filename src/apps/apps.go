@@ -0,0 +1,98 @@
+// Package apps gives local applications their own addresses in the node's routed subnet,
+// each with its own access rules.
+//
+// The address of an app is the node's 300::/64 subnet prefix followed by an interface identifier
+// derived from the app name, so it is stable and any device can compute it from the node's key.
+package apps
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+)
+
+const (
+	selectorAny    = "*"
+	selectorTagPfx = "tag:"
+)
+
+type App struct {
+	Name   string   `comment:"Unique name of the app, its address is derived from it and this node's key"`
+	Accept []string `json:",omitempty" comment:"Services of the app devices may reach, e.g. \"tcp/443\". Defaults to all services."`
+	From   []string `comment:"Devices allowed to reach the app: device names, \"tag:<tag>\" or \"*\" for any device"`
+}
+
+// Address returns the address of the app named name on the node with the given key.
+func Address(key ed25519.PublicKey, name string) address.Address {
+	var addr address.Address
+	subnet := address.SubnetForKey(key)
+	copy(addr[:], subnet[:])
+	id := sha256.Sum256([]byte("yggdrasil-manager app " + name))
+	copy(addr[len(subnet):], id[:])
+	return addr
+}
+
+// IP returns the address of the app on the node with the given key.
+func (a *App) IP(key ed25519.PublicKey) net.IP {
+	addr := Address(key, a.Name)
+	return net.IP(addr[:])
+}
+
+// Allows reports whether the device may reach the app.
+func (a *App) Allows(d devices.Device) bool {
+	for _, s := range a.From {
+		if tag, ok := strings.CutPrefix(s, selectorTagPfx); ok && slices.Contains(d.Tags, tag) || s == selectorAny || s == d.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks apps for missing fields, duplicate names, invalid rules and unknown device
+// names and tags, as they are most likely typos.
+func Validate(apps []App, known []devices.Device) error {
+	names := map[string]struct{}{}
+	tags := map[string]struct{}{}
+	for _, d := range known {
+		names[d.Name] = struct{}{}
+		for _, t := range d.Tags {
+			tags[t] = struct{}{}
+		}
+	}
+	seen := make(map[string]struct{}, len(apps))
+	for i, a := range apps {
+		if a.Name == "" {
+			return fmt.Errorf("app %d has no name", i)
+		}
+		if _, ok := seen[a.Name]; ok {
+			return fmt.Errorf("duplicate app name %q", a.Name)
+		}
+		seen[a.Name] = struct{}{}
+		if len(a.From) == 0 {
+			return fmt.Errorf("app %q: From is empty", a.Name)
+		}
+		for _, s := range a.From {
+			if tag, ok := strings.CutPrefix(s, selectorTagPfx); ok {
+				if _, ok := tags[tag]; !ok {
+					return fmt.Errorf("app %q: unknown tag %q", a.Name, tag)
+				}
+			} else if _, ok := names[s]; !ok && s != selectorAny {
+				return fmt.Errorf("app %q: unknown device %q", a.Name, s)
+			}
+		}
+		for _, s := range a.Accept {
+			if _, err := filter.ParseRule(s); err != nil {
+				return fmt.Errorf("app %q: %w", a.Name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package apps
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+func TestAddress(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(nil)
+	web, mail := Address(key, "web"), Address(key, "mail")
+	assert.Equal(t, web, Address(key, "web"), "addresses are stable")
+	assert.NotEqual(t, web, mail)
+
+	var snet address.Subnet
+	copy(snet[:], web[:])
+	assert.Equal(t, *address.SubnetForKey(key), snet, "addresses are in the node subnet")
+	assert.False(t, web.IsValid(), "addresses aren't node addresses")
+}
+
+func TestValidate(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(nil)
+	laptop := devices.Device{Name: "laptop", PublicKey: hex.EncodeToString(key), Tags: []string{"admins"}, AddedAt: time.Now()}
+	known := []devices.Device{laptop}
+
+	assert.NoError(t, Validate([]App{
+		{Name: "web", Accept: []string{"tcp/443"}, From: []string{"*"}},
+		{Name: "ssh", Accept: []string{"tcp/22"}, From: []string{"tag:admins"}},
+		{Name: "db", From: []string{"laptop"}},
+	}, known))
+	for _, apps := range [][]App{
+		{{Accept: []string{"tcp/443"}, From: []string{"*"}}},
+		{{Name: "web", From: []string{"*"}}, {Name: "web", From: []string{"*"}}},
+		{{Name: "web"}},
+		{{Name: "web", From: []string{"phone"}}},
+		{{Name: "web", From: []string{"tag:servers"}}},
+		{{Name: "web", Accept: []string{"tcp/0"}, From: []string{"*"}}},
+	} {
+		assert.Error(t, Validate(apps, known), "%+v", apps)
+	}
+
+	assert.True(t, (&App{From: []string{"tag:admins"}}).Allows(laptop))
+	assert.True(t, (&App{From: []string{"*"}}).Allows(laptop))
+	assert.False(t, (&App{From: []string{"phone"}}).Allows(laptop))
+}
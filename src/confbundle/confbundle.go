@@ -0,0 +1,108 @@
+// Package confbundle seals configs into bundles that can be passed around to provision devices
+// without their private keys sitting in plaintext on shared storage.
+//
+// A bundle is an ASCII-armored age file, so it can also be opened with the age tool. It is
+// sealed either to the age recipient (X25519 public key) of the device, or to a passphrase.
+package confbundle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// PassphraseEnv is the environment variable a passphrase to open bundles is read from.
+const PassphraseEnv = "YGGDRASIL_BUNDLE_PASSPHRASE"
+
+// maxSize limits the size of an opened bundle.
+const maxSize = 16 << 20
+
+// Recipient returns the recipient a bundle is sealed to, an age recipient like "age1..." if
+// set, or else the passphrase.
+func Recipient(recipient, passphrase string) (age.Recipient, error) {
+	switch {
+	case recipient != "" && passphrase != "":
+		return nil, errors.New("a bundle is sealed to either a recipient or a passphrase")
+	case recipient != "":
+		recipients, err := age.ParseRecipients(strings.NewReader(recipient))
+		if err != nil {
+			return nil, err
+		}
+		if len(recipients) != 1 {
+			return nil, fmt.Errorf("expected a single recipient, got %d", len(recipients))
+		}
+		return recipients[0], nil
+	case passphrase != "":
+		return age.NewScryptRecipient(passphrase)
+	}
+	return nil, errors.New("a bundle needs a recipient or a passphrase")
+}
+
+// Seal encrypts a config to the recipient.
+func Seal(config []byte, recipient age.Recipient) ([]byte, error) {
+	var out bytes.Buffer
+	armored := armor.NewWriter(&out)
+	w, err := age.Encrypt(armored, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(config); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Open decrypts a bundle with one of the identities. Bundles that aren't armored are read too.
+func Open(bundle []byte, identities ...age.Identity) ([]byte, error) {
+	var src io.Reader = bytes.NewReader(bundle)
+	if bytes.HasPrefix(bytes.TrimSpace(bundle), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(bundle)))
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config bundle: %w", err)
+	}
+	return io.ReadAll(io.LimitReader(r, maxSize))
+}
+
+// Identities returns the identities to open bundles with: those in identityFile, an age
+// identity file, if set, and the passphrase in the PassphraseEnv environment variable.
+func Identities(identityFile string) ([]age.Identity, error) {
+	identities := []age.Identity{}
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		parsed, err := age.ParseIdentities(bufio.NewReader(f))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity file %s: %w", identityFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identity to open the config bundle with, set an identity file or %s", PassphraseEnv)
+	}
+	return identities, nil
+}
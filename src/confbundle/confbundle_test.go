@@ -0,0 +1,75 @@
+package confbundle
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+var config = []byte(`{"PrivateKey": "secret", "Peers": []}`)
+
+func TestRecipient(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := Recipient(identity.Recipient().String(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	bundle, err := Seal(config, recipient)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, bytes.Contains(bundle, []byte("secret")))
+	assert.True(t, bytes.HasPrefix(bundle, []byte("-----BEGIN AGE ENCRYPTED FILE-----")))
+
+	opened, err := Open(bundle, identity)
+	if assert.NoError(t, err) {
+		assert.Equal(t, config, opened)
+	}
+	other, _ := age.GenerateX25519Identity()
+	_, err = Open(bundle, other)
+	assert.ErrorContains(t, err, "failed to open config bundle")
+
+	_, err = Recipient("age1invalid", "")
+	assert.Error(t, err)
+	_, err = Recipient(identity.Recipient().String(), "passphrase")
+	assert.Error(t, err, "only one of recipient and passphrase")
+	_, err = Recipient("", "")
+	assert.Error(t, err)
+}
+
+func TestIdentities(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(identityFile, []byte("# device key\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recipient, _ := Recipient("", "correct horse")
+	bundle, err := Seal(config, recipient)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Setenv(PassphraseEnv, "")
+	_, err = Identities("")
+	assert.ErrorContains(t, err, "no identity")
+
+	t.Setenv(PassphraseEnv, "correct horse")
+	identities, err := Identities(identityFile)
+	if assert.NoError(t, err) {
+		assert.Len(t, identities, 2)
+		opened, err := Open(bundle, identities...)
+		if assert.NoError(t, err) {
+			assert.Equal(t, config, opened, "the passphrase opens the bundle")
+		}
+	}
+}
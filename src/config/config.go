@@ -1,17 +1,62 @@
 package config
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/hjson/hjson-go/v4"
+
+	"github.com/nermolov/yggdrasil-manager/src/acl"
+	"github.com/nermolov/yggdrasil-manager/src/apps"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/document"
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+	"github.com/nermolov/yggdrasil-manager/src/management"
 )
 
 type ManagerConfig struct {
 	Manager managerConfigOptions `comment:"yggdrasil-manager specific configuration options."`
+
+	policy *acl.Policy // compiled from Manager.Policy, nil if there is none
 }
 
 type managerConfigOptions struct {
-	FilterAllowedPublicKeys []string `comment:"List of peer public keys to allow ipv6 traffic to/from on the tunnel. Traffic can still be routed for nodes not included in this list."`
+	Devices                  []devices.Device    `comment:"Devices managed together with this node. Devices that haven't expired may peer with this node and send/receive ipv6 traffic on the tunnel. Traffic can still be routed for nodes not included in this list."`
+	Name                     string              `json:",omitempty" comment:"Name of this node, used when it is added to the Devices of other nodes. Defaults to the hostname."`
+	Tags                     []string            `json:",omitempty" comment:"Tags of this node, used to match the Policy."`
+	Policy                   []acl.Entry         `json:",omitempty" comment:"Optional tag based access policy. If set, devices may only reach the local services granted to them by an entry matching this node, and connection tracking is enabled so this node can reach services on other devices. Can't be combined with FilterRules."`
+	Apps                     []apps.App          `json:",omitempty" comment:"Local apps with their own address in this node's 300::/64 subnet, derived from the app name. Only the devices in From may reach an app address, on its Accept services. The addresses are assigned to the TUN interface on Linux."`
+	RevokedKeys              []string            `json:",omitempty" comment:"Hex public keys of revoked devices. They are never allowed, even if they are still listed in Devices or FilterAllowedPublicKeys. With Sync, revocations are shared with all devices and can't be undone."`
+	FilterAllowedPublicKeys  []string            `json:",omitempty" comment:"Deprecated, use Devices instead. Additional peer public keys to allow ipv6 traffic to/from on the tunnel."`
+	FilterRules              map[string][]string `json:",omitempty" comment:"Optional per-device service rules, keyed by device name or hex public key. Each rule is \"<proto>[/<port>[-<port>]]\" where proto is tcp, udp, icmp or any, e.g. \"tcp/22\" or \"udp/5353\". Listed devices may only reach matching local services, devices without rules have full access."`
+	FilterTrustSubnets       bool                `json:",omitempty" comment:"If true, traffic to/from the routed 300::/64 subnet of an allowed device is treated like traffic to/from its address. Otherwise subnet traffic is dropped."`
+	FilterConnectionTracking bool                `json:",omitempty" comment:"If true, locally initiated TCP, UDP and ICMPv6 echo flows may be sent to any key and their return traffic is allowed, even when the remote key is not an allowed device."`
+	FilterRejectLocal        bool                `json:",omitempty" comment:"If true, local applications sending to a filtered destination get an immediate ICMPv6 \"administratively prohibited\" error instead of timing out."`
+	FilterRejectRemote       bool                `json:",omitempty" comment:"If true, remote nodes sending filtered traffic get an ICMPv6 \"administratively prohibited\" error. Errors are rate limited."`
+	ManagementPort           uint16              `json:",omitempty" comment:"TCP port of the management service on this node's address, through which devices sync, join and query each other. Must be the same on all devices. Defaults to 9777."`
+	ManagementAdmins         []string            `json:",omitempty" comment:"Devices, by name, hex public key or \"tag:<tag>\", that may use the admin API of this node remotely through the management service."`
+	Sync                     bool                `json:",omitempty" comment:"If true, Devices, Name, Tags and Policy are kept in a config document replicated between all devices. Changes made on any device are synced to the others through the management service and written back to this file. Requires -useconffile and enables connection tracking."`
+	SyncStateFile            string              `json:",omitempty" comment:"File the config document is kept in. Defaults to the config file path with \".sync\" appended."`
+	Traversal                bool                `json:",omitempty" comment:"If true, this node punches through NAT to peer directly with the devices it has a session with, swapping public UDP endpoints with them through the management service. Both devices must enable it. Traffic keeps going through the other peers until a direct peering is up and if punching fails."`
+	TraversalSTUNServers     []string            `json:",omitempty" comment:"STUN servers, as \"<host>:<port>\", used to learn the public UDP endpoint of this node for Traversal. Defaults to public STUN servers of Google and Cloudflare."`
+	LANLinks                 bool                `json:",omitempty" comment:"If true, this node peers directly with devices on its LAN, the networks of the multicast interfaces, that it reaches through other nodes. Devices advertise the Listen addresses they can be peered with through the management service, only when they enable it too."`
+	PrivateMesh              bool                `json:",omitempty" comment:"If true, only devices may peer with this node: the peering allow list is filled from Devices and AllowedPublicKeys is ignored. Public peers are only connected as RelayPeers."`
+	RelayPeers               []string            `json:",omitempty" comment:"Public peer URIs used as last-resort relays in PrivateMesh mode. They are only connected while no device is peered with this node, e.g. to reach devices behind NAT."`
+	PublicPeers              int                 `json:",omitempty" comment:"Number of public peers this node picks at runtime, by their latency over the peering transport. They are re-evaluated every 5 minutes, and a peer is only swapped out once it has stayed down or clearly slower than a candidate for several rounds. Can't be combined with PrivateMesh."`
+	PublicPeerCandidates     []string            `json:",omitempty" comment:"Public peer URIs the PublicPeers are picked from. If empty, they are picked from the online peers in PublicPeerIndex."`
+	PublicPeerIndex          string              `json:",omitempty" comment:"URL of the public peer index page or of the JSON format of the public-peers repository, or the path of a local copy of either or of a file listing one peer URI per line. Defaults to https://publicpeers.neilalexander.dev/."`
+	PublicPeerCountries      []string            `json:",omitempty" comment:"Country sections of PublicPeerIndex to pick from, e.g. [\"germany\"]. Defaults to all sections."`
+	PublicPeerCacheFile      string              `json:",omitempty" comment:"File the last PublicPeerIndex that was read is kept in, used when the index can't be read. Defaults to the config file path with \".peers\" appended."`
 }
 
 func (mcfg *ManagerConfig) UnmarshalHJSON(data []byte) error {
@@ -22,8 +67,305 @@ func (mcfg *ManagerConfig) UnmarshalHJSON(data []byte) error {
 }
 
 func (mcfg *ManagerConfig) postprocessConfig() error {
-	if len(mcfg.Manager.FilterAllowedPublicKeys) == 0 {
-		return errors.New("Manager.FilterAllowedPublicKeys is a required field")
+	if len(mcfg.Manager.Devices) == 0 && len(mcfg.Manager.FilterAllowedPublicKeys) == 0 && len(mcfg.Manager.RevokedKeys) == 0 {
+		return errors.New("Manager.Devices is a required field")
+	}
+	if err := devices.Validate(mcfg.Manager.Devices); err != nil {
+		return fmt.Errorf("Manager.Devices: %w", err)
+	}
+	if _, ok := mcfg.device(mcfg.Manager.Name); ok && mcfg.Manager.Name != "" {
+		return fmt.Errorf("Manager.Name %q is also used by a device", mcfg.Manager.Name)
+	}
+	for _, k := range mcfg.Manager.RevokedKeys {
+		if keyBytes, err := hex.DecodeString(k); err != nil || len(keyBytes) != 32 {
+			return fmt.Errorf("Manager.RevokedKeys: %q is not a public key", k)
+		}
+	}
+	if len(mcfg.Manager.Policy) > 0 {
+		if len(mcfg.Manager.FilterRules) > 0 {
+			return errors.New("Manager.Policy and Manager.FilterRules can't be used together")
+		}
+		policy, err := acl.Compile(mcfg.Manager.Policy, mcfg.Manager.Devices, mcfg.self())
+		if err != nil {
+			return fmt.Errorf("Manager.Policy: %w", err)
+		}
+		mcfg.policy = policy
+	}
+	if err := apps.Validate(mcfg.Manager.Apps, mcfg.Manager.Devices); err != nil {
+		return fmt.Errorf("Manager.Apps: %w", err)
+	}
+	for _, admin := range mcfg.Manager.ManagementAdmins {
+		if _, ok := mcfg.device(admin); ok || strings.HasPrefix(admin, "tag:") {
+			continue
+		}
+		if keyBytes, err := hex.DecodeString(admin); err != nil || len(keyBytes) != 32 {
+			return fmt.Errorf("Manager.ManagementAdmins: %q is not a device name, public key or tag", admin)
+		}
+	}
+	for _, server := range mcfg.Manager.TraversalSTUNServers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("Manager.TraversalSTUNServers: %w", err)
+		}
 	}
+	if len(mcfg.Manager.RelayPeers) > 0 && !mcfg.Manager.PrivateMesh {
+		return errors.New("Manager.RelayPeers requires Manager.PrivateMesh, use Peers otherwise")
+	}
+	for _, peer := range mcfg.Manager.RelayPeers {
+		if _, err := url.Parse(peer); err != nil {
+			return fmt.Errorf("Manager.RelayPeers: %w", err)
+		}
+	}
+	if mcfg.Manager.PublicPeers < 0 {
+		return errors.New("Manager.PublicPeers can't be negative")
+	}
+	if mcfg.Manager.PublicPeers > 0 && mcfg.Manager.PrivateMesh {
+		return errors.New("Manager.PublicPeers can't be combined with Manager.PrivateMesh, use RelayPeers")
+	}
+	for _, peer := range mcfg.Manager.PublicPeerCandidates {
+		if _, err := url.Parse(peer); err != nil {
+			return fmt.Errorf("Manager.PublicPeerCandidates: %w", err)
+		}
+	}
+	for nameOrKey := range mcfg.Manager.FilterRules {
+		if _, ok := mcfg.device(nameOrKey); ok {
+			continue
+		}
+		if keyBytes, err := hex.DecodeString(nameOrKey); err != nil || len(keyBytes) != 32 {
+			return fmt.Errorf("Manager.FilterRules: %q is not a device name or public key", nameOrKey)
+		}
+	}
+	// revocation wins over stale device entries
+	if len(mcfg.Manager.RevokedKeys) > 0 {
+		filterRules := maps.Clone(mcfg.Manager.FilterRules)
+		for nameOrKey := range filterRules {
+			if d, ok := mcfg.device(nameOrKey); ok && mcfg.IsRevoked(d.PublicKey) || mcfg.IsRevoked(nameOrKey) {
+				delete(filterRules, nameOrKey)
+			}
+		}
+		mcfg.Manager.FilterRules = filterRules
+	}
+	mcfg.Manager.Devices = slices.DeleteFunc(slices.Clone(mcfg.Manager.Devices), func(d devices.Device) bool {
+		return mcfg.IsRevoked(d.PublicKey)
+	})
 	return nil
 }
+
+// Equal reports whether both configs have the same options.
+func (mcfg *ManagerConfig) Equal(other *ManagerConfig) bool {
+	a, errA := json.Marshal(mcfg.Manager)
+	b, errB := json.Marshal(other.Manager)
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// device finds a device by name or hex public key.
+func (mcfg *ManagerConfig) device(nameOrKey string) (devices.Device, bool) {
+	for _, d := range mcfg.Manager.Devices {
+		if d.Name == nameOrKey || d.PublicKey == nameOrKey {
+			return d, true
+		}
+	}
+	return devices.Device{}, false
+}
+
+// Subject returns the policy subject for a device name, or this node for "self".
+func (mcfg *ManagerConfig) Subject(name string) (acl.Subject, bool) {
+	if name == "self" || (name != "" && name == mcfg.Manager.Name) {
+		return mcfg.self(), true
+	}
+	for _, d := range mcfg.Manager.Devices {
+		if d.Name == name {
+			return acl.Subject{Name: d.Name, Tags: d.Tags}, true
+		}
+	}
+	return acl.Subject{}, false
+}
+
+func (mcfg *ManagerConfig) self() acl.Subject {
+	return acl.Subject{Name: mcfg.Manager.Name, Tags: mcfg.Manager.Tags, Self: true}
+}
+
+// Policy returns the compiled access policy, or nil if the config has none.
+func (mcfg *ManagerConfig) Policy() *acl.Policy {
+	return mcfg.policy
+}
+
+// ManagementPort returns the port of the management service.
+func (mcfg *ManagerConfig) ManagementPort() uint16 {
+	if mcfg.Manager.ManagementPort != 0 {
+		return mcfg.Manager.ManagementPort
+	}
+	return management.DefaultPort
+}
+
+// managementRule returns the rule for the management service every device may reach.
+func (mcfg *ManagerConfig) managementRule() filter.Rule {
+	r, _ := filter.ParseRule(fmt.Sprintf("tcp/%d", mcfg.ManagementPort()))
+	return r
+}
+
+// IsAdmin reports whether a device may use the admin API of this node remotely.
+func (mcfg *ManagerConfig) IsAdmin(d devices.Device) bool {
+	for _, admin := range mcfg.Manager.ManagementAdmins {
+		if tag, ok := strings.CutPrefix(admin, "tag:"); ok && slices.Contains(d.Tags, tag) || admin == d.Name || admin == d.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// View returns the parts of the config kept in the config document.
+func (mcfg *ManagerConfig) View(name string) document.View {
+	if mcfg.Manager.Name != "" {
+		name = mcfg.Manager.Name
+	}
+	return document.View{
+		Name:    name,
+		Tags:    mcfg.Manager.Tags,
+		Devices: mcfg.Manager.Devices,
+		Policy:  mcfg.Manager.Policy,
+		Revoked: mcfg.Manager.RevokedKeys,
+	}
+}
+
+// WithView returns a copy of the config with the parts kept in the config document replaced by v.
+func (mcfg *ManagerConfig) WithView(v document.View) (*ManagerConfig, error) {
+	out := &ManagerConfig{Manager: mcfg.Manager}
+	out.Manager.Name, out.Manager.Tags = v.Name, v.Tags
+	out.Manager.Devices, out.Manager.Policy, out.Manager.RevokedKeys = v.Devices, v.Policy, v.Revoked
+	if err := out.postprocessConfig(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// policyRules returns the local services each allowed key may reach under the policy.
+// Keys without any services are left out.
+func (mcfg *ManagerConfig) policyRules(now time.Time) map[string][]filter.Rule {
+	self := mcfg.self()
+	rules := map[string][]filter.Rule{}
+	for _, d := range mcfg.Manager.Devices {
+		if !d.IsActive(now) {
+			continue
+		}
+		// every device may reach the management service, even without grants
+		rules[d.PublicKey] = append(mcfg.policy.Rules(acl.Subject{Name: d.Name, Tags: d.Tags}, self), mcfg.managementRule())
+	}
+	for _, k := range mcfg.Manager.FilterAllowedPublicKeys {
+		if _, ok := rules[k]; ok || mcfg.IsRevoked(k) {
+			continue
+		}
+		if r := mcfg.policy.Rules(acl.Subject{}, self); len(r) > 0 {
+			rules[k] = r
+		}
+	}
+	return rules
+}
+
+// AppAddresses returns the filter options for the apps of the node with the given key at the given time.
+// Expired devices can't reach any app.
+func (mcfg *ManagerConfig) AppAddresses(self ed25519.PublicKey, now time.Time) filter.AppAddresses {
+	addrs := make(filter.AppAddresses, 0, len(mcfg.Manager.Apps))
+	for _, a := range mcfg.Manager.Apps {
+		addr := filter.AppAddress{Address: apps.Address(self, a.Name), Keys: []string{}, Rules: a.Accept}
+		for _, d := range mcfg.Manager.Devices {
+			if d.IsActive(now) && a.Allows(d) {
+				addr.Keys = append(addr.Keys, d.PublicKey)
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// IsRevoked reports whether a hex public key has been revoked.
+func (mcfg *ManagerConfig) IsRevoked(key string) bool {
+	return slices.Contains(mcfg.Manager.RevokedKeys, key)
+}
+
+// DeviceKeys returns the hex public keys of the devices that are active at the given time.
+func (mcfg *ManagerConfig) DeviceKeys(now time.Time) []string {
+	return devices.ActiveKeys(mcfg.Manager.Devices, now)
+}
+
+// AllowedPublicKeys returns the hex public keys of the devices that are active at the given time,
+// followed by any keys from the deprecated FilterAllowedPublicKeys list. Revoked keys are left out.
+// With a policy, only keys granted access to a local service are returned.
+func (mcfg *ManagerConfig) AllowedPublicKeys(now time.Time) []string {
+	if mcfg.policy != nil {
+		keys := []string{}
+		for k := range mcfg.policyRules(now) {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	keys := mcfg.DeviceKeys(now)
+	seen := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		seen[k] = struct{}{}
+	}
+	for _, k := range mcfg.Manager.FilterAllowedPublicKeys {
+		if _, ok := seen[k]; !ok && !mcfg.IsRevoked(k) {
+			seen[k] = struct{}{}
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// PeeringKeys returns the hex public keys allowed to peer with this node, given the
+// AllowedPublicKeys of the node config. In PrivateMesh mode they are the keys of the devices
+// that are active at the given time, otherwise allowed is followed by those. Revoked keys are
+// left out.
+func (mcfg *ManagerConfig) PeeringKeys(allowed []string, now time.Time) []string {
+	keys := []string{}
+	if !mcfg.Manager.PrivateMesh {
+		keys = slices.DeleteFunc(slices.Clone(allowed), mcfg.IsRevoked)
+	}
+	for _, key := range mcfg.DeviceKeys(now) {
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// FilterOptions returns the tunnel filter setup options for the config at the given time.
+// Rules are resolved to public keys, rules for expired devices are left out.
+// A policy is compiled into per-key rules and enables connection tracking.
+// Devices that have rules may also reach the management service. With Sync, connection
+// tracking is enabled so that this node can reach theirs. Revoked keys are blocked.
+func (mcfg *ManagerConfig) FilterOptions(now time.Time) []filter.SetupOption {
+	rules := filter.Rules{}
+	connectionTracking := mcfg.Manager.FilterConnectionTracking || mcfg.Manager.Sync
+	if mcfg.policy != nil {
+		for k, rs := range mcfg.policyRules(now) {
+			for _, r := range rs {
+				rules[k] = append(rules[k], r.String())
+			}
+		}
+		connectionTracking = true
+	}
+	for nameOrKey, r := range mcfg.Manager.FilterRules {
+		if d, ok := mcfg.device(nameOrKey); ok {
+			if d.IsActive(now) {
+				rules[d.PublicKey] = append(rules[d.PublicKey], r...)
+			}
+			continue
+		}
+		rules[nameOrKey] = append(rules[nameOrKey], r...)
+	}
+	if mcfg.policy == nil {
+		for k := range rules {
+			rules[k] = append(rules[k], mcfg.managementRule().String())
+		}
+	}
+	return []filter.SetupOption{
+		rules,
+		filter.TrustSubnets(mcfg.Manager.FilterTrustSubnets),
+		filter.ConnectionTracking(connectionTracking),
+		filter.RejectLocal(mcfg.Manager.FilterRejectLocal),
+		filter.RejectRemote(mcfg.Manager.FilterRejectRemote),
+		filter.BlockedKeys(mcfg.Manager.RevokedKeys),
+	}
+}
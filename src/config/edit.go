@@ -0,0 +1,200 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/hjson/hjson-go/v4"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+// editConfig applies edit to the parsed contents of a config file and encodes the result,
+// keeping comments and key order. JSON input is encoded as JSON again.
+// The edited config must still be valid.
+func editConfig(data []byte, edit func(root *hjson.Node) error) ([]byte, error) {
+	var root hjson.Node
+	if err := hjson.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if err := edit(&root); err != nil {
+		return nil, err
+	}
+	var out []byte
+	var err error
+	if json.Valid(data) {
+		out, err = json.MarshalIndent(root, "", "  ")
+	} else {
+		out, err = hjson.Marshal(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := new(ManagerConfig).UnmarshalHJSON(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// toNode converts v to the generic form used by hjson.Node trees.
+func toNode(v any) (*hjson.Node, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	node := new(hjson.Node)
+	if err := hjson.Unmarshal(bs, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// AddDevice appends d to the Manager.Devices of a config file, creating the list in configs
+// from before there were devices.
+func AddDevice(data []byte, d devices.Device) ([]byte, error) {
+	return editConfig(data, func(root *hjson.Node) error {
+		if root.NK("Manager") == nil {
+			if _, _, err := root.SetKey("Manager", hjson.NewOrderedMap()); err != nil {
+				return err
+			}
+		}
+		manager := root.NKC("Manager")
+		if manager == nil {
+			return fmt.Errorf("Manager is not an object")
+		}
+		if manager.NK("Devices") == nil {
+			if _, _, err := manager.SetKey("Devices", []any{}); err != nil {
+				return err
+			}
+		}
+		list := manager.NKC("Devices")
+		if list == nil {
+			return fmt.Errorf("Manager.Devices is not a list")
+		}
+		node, err := toNode(d)
+		if err != nil {
+			return err
+		}
+		return list.Append(node.Value)
+	})
+}
+
+// SetManager replaces the Manager section of a config file.
+func SetManager(data []byte, mcfg *ManagerConfig) ([]byte, error) {
+	return editConfig(data, func(root *hjson.Node) error {
+		node, err := toNode(mcfg.Manager)
+		if err != nil {
+			return err
+		}
+		_, _, err = root.SetKey("Manager", node.Value)
+		return err
+	})
+}
+
+// AddPeers appends the peer URIs that aren't configured yet to the Peers of a config file.
+func AddPeers(data []byte, peers []string) ([]byte, error) {
+	return editConfig(data, func(root *hjson.Node) error {
+		if root.NK("Peers") == nil {
+			if _, _, err := root.SetKey("Peers", []any{}); err != nil {
+				return err
+			}
+		}
+		list := root.NKC("Peers")
+		if list == nil {
+			return fmt.Errorf("Peers is not a list")
+		}
+		existing := map[any]struct{}{}
+		for i := range list.Len() {
+			if _, v, err := list.AtIndex(i); err == nil {
+				existing[v] = struct{}{}
+			}
+		}
+		for _, p := range peers {
+			if _, ok := existing[p]; ok {
+				continue
+			}
+			existing[p] = struct{}{}
+			if err := list.Append(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Revoke adds a hex public key to the Manager.RevokedKeys of a config file, and removes the device
+// with that key from Manager.Devices, Manager.FilterAllowedPublicKeys and Manager.FilterRules.
+func Revoke(data []byte, key string) ([]byte, error) {
+	return editConfig(data, func(root *hjson.Node) error {
+		manager := root.NK("Manager")
+		if manager == nil {
+			return fmt.Errorf("config has no Manager section")
+		}
+		var name string
+		if list := manager.NK("Devices"); list != nil {
+			for i := list.Len() - 1; i >= 0; i-- {
+				d := list.NI(i)
+				if k, _, _ := d.AtKey("PublicKey"); k == key {
+					if n, _, _ := d.AtKey("Name"); n != nil {
+						name, _ = n.(string)
+					}
+					if _, _, err := list.DeleteIndex(i); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if list := manager.NK("FilterAllowedPublicKeys"); list != nil {
+			for i := list.Len() - 1; i >= 0; i-- {
+				if _, k, _ := list.AtIndex(i); k == key {
+					if _, _, err := list.DeleteIndex(i); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if rules := manager.NK("FilterRules"); rules != nil {
+			for _, k := range []string{key, name} {
+				if k != "" {
+					_, _, _ = rules.DeleteKey(k)
+				}
+			}
+		}
+		if manager.NK("RevokedKeys") == nil {
+			if _, _, err := manager.SetKey("RevokedKeys", []any{}); err != nil {
+				return err
+			}
+		}
+		revoked := manager.NKC("RevokedKeys")
+		if revoked == nil {
+			return fmt.Errorf("Manager.RevokedKeys is not a list")
+		}
+		for i := range revoked.Len() {
+			if _, k, _ := revoked.AtIndex(i); k == key {
+				return nil
+			}
+		}
+		return revoked.Append(key)
+	})
+}
+
+// ForDevice returns the config for another device joining this node: this node is added to
+// the devices and the device itself is removed, taking over its name and tags.
+// Only the settings shared by the whole fleet are passed on, everything else is local to this node.
+func (mcfg *ManagerConfig) ForDevice(self devices.Device, deviceKey string) *ManagerConfig {
+	out := &ManagerConfig{}
+	out.Manager.Devices = []devices.Device{self}
+	for _, d := range mcfg.Manager.Devices {
+		if d.PublicKey == deviceKey {
+			out.Manager.Name, out.Manager.Tags = d.Name, slices.Clone(d.Tags)
+			continue
+		}
+		out.Manager.Devices = append(out.Manager.Devices, d)
+	}
+	out.Manager.Policy = slices.Clone(mcfg.Manager.Policy)
+	out.Manager.RevokedKeys = slices.Clone(mcfg.Manager.RevokedKeys)
+	out.Manager.ManagementPort = mcfg.Manager.ManagementPort
+	out.Manager.Sync = mcfg.Manager.Sync
+	return out
+}
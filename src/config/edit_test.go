@@ -0,0 +1,157 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+func newDevice(name string) devices.Device {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	return devices.Device{Name: name, PublicKey: hex.EncodeToString(pub), AddedAt: time.Now().UTC().Truncate(time.Second)}
+}
+
+func TestAddDevice(t *testing.T) {
+	laptop, phone := newDevice("laptop"), newDevice("phone")
+	input := `{
+  # keep this comment
+  IfName: auto
+  Manager: {
+    Devices: [
+      {
+        Name: laptop
+        PublicKey: ` + laptop.PublicKey + `
+        AddedAt: ` + laptop.AddedAt.Format(time.RFC3339) + `
+      }
+    ]
+  }
+}`
+	out, err := AddDevice([]byte(input), phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(out), "# keep this comment")
+	mcfg := ManagerConfig{}
+	if assert.NoError(t, mcfg.UnmarshalHJSON(out)) {
+		assert.Equal(t, []devices.Device{laptop, phone}, mcfg.Manager.Devices)
+	}
+
+	_, err = AddDevice(out, phone)
+	assert.Error(t, err, "duplicate devices are rejected")
+}
+
+func TestAddDeviceBaselineConfig(t *testing.T) {
+	phone := newDevice("phone")
+	allowed := newDevice("allowed")
+	for _, input := range []string{
+		`{"IfName": "auto", "Manager": {"FilterAllowedPublicKeys": ["` + allowed.PublicKey + `"]}}`,
+		`{"IfName": "auto"}`,
+	} {
+		out, err := AddDevice([]byte(input), phone)
+		if assert.NoError(t, err, input) {
+			mcfg := ManagerConfig{}
+			if assert.NoError(t, mcfg.UnmarshalHJSON(out)) {
+				assert.Equal(t, []devices.Device{phone}, mcfg.Manager.Devices)
+			}
+		}
+	}
+}
+
+func TestSetManager(t *testing.T) {
+	self, joiner, other := newDevice("self"), newDevice("joiner"), newDevice("other")
+	mcfg := ManagerConfig{}
+	mcfg.Manager.Name = "self"
+	mcfg.Manager.Devices = []devices.Device{joiner, other}
+	mcfg.Manager.FilterRules = map[string][]string{"other": {"tcp/22"}}
+	mcfg.Manager.Sync, mcfg.Manager.ManagementPort = true, 9000
+	mcfg.Manager.PublicPeerCacheFile, mcfg.Manager.Traversal, mcfg.Manager.LANLinks = "/var/lib/peers", true, true
+	mcfg.Manager.PrivateMesh, mcfg.Manager.RelayPeers = true, []string{"tls://relay.example.org:443"}
+	mcfg.Manager.FilterConnectionTracking, mcfg.Manager.FilterRejectLocal = true, true
+	forJoiner := mcfg.ForDevice(self, joiner.PublicKey)
+	assert.Equal(t, "joiner", forJoiner.Manager.Name)
+	assert.Equal(t, []devices.Device{self, other}, forJoiner.Manager.Devices)
+	assert.True(t, forJoiner.Manager.Sync)
+	assert.Equal(t, uint16(9000), forJoiner.Manager.ManagementPort)
+	expected := ManagerConfig{}
+	expected.Manager.Name, expected.Manager.Devices = "joiner", forJoiner.Manager.Devices
+	expected.Manager.Sync, expected.Manager.ManagementPort = true, 9000
+	assert.Equal(t, expected.Manager, forJoiner.Manager, "settings local to this node aren't passed on")
+
+	out, err := SetManager([]byte(`{"IfName": "auto"}`), forJoiner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(string(out), "{\n  \"IfName\""), "JSON stays JSON")
+	parsed := ManagerConfig{}
+	if assert.NoError(t, parsed.UnmarshalHJSON(out)) {
+		assert.Equal(t, forJoiner.Manager.Devices, parsed.Manager.Devices)
+	}
+}
+
+func TestAddPeers(t *testing.T) {
+	manager := `
+  Manager: {
+    Devices: [
+      {
+        Name: laptop
+        PublicKey: ` + newDevice("laptop").PublicKey + `
+        AddedAt: 2024-01-01T00:00:00Z
+      }
+    ]
+  }
+}`
+	out, err := AddPeers([]byte("{\n  Peers: [\n    \"tls://a:1\" # keep this comment\n  ]"+manager), []string{"tls://a:1", "tls://b:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(out), "# keep this comment")
+	assert.Equal(t, 1, strings.Count(string(out), "tls://a:1"))
+	assert.Contains(t, string(out), "tls://b:2")
+
+	out, err = AddPeers([]byte("{"+manager), []string{"tls://b:2"})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "tls://b:2")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	laptop, phone := newDevice("laptop"), newDevice("phone")
+	mcfg := ManagerConfig{}
+	mcfg.Manager.Devices = []devices.Device{laptop, phone}
+	mcfg.Manager.FilterAllowedPublicKeys = []string{phone.PublicKey}
+	mcfg.Manager.FilterRules = map[string][]string{"phone": {"tcp/22"}, "laptop": {"tcp/22"}}
+	stale, err := SetManager([]byte(`{"IfName": "auto"}`), &mcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := Revoke(stale, phone.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := ManagerConfig{}
+	if assert.NoError(t, revoked.UnmarshalHJSON(out)) {
+		assert.Equal(t, []devices.Device{laptop}, revoked.Manager.Devices)
+		assert.Equal(t, []string{phone.PublicKey}, revoked.Manager.RevokedKeys)
+		assert.Empty(t, revoked.Manager.FilterAllowedPublicKeys)
+		assert.Equal(t, map[string][]string{"laptop": {"tcp/22"}}, revoked.Manager.FilterRules)
+	}
+
+	// a stale device entry doesn't undo the revocation
+	mcfg.Manager.RevokedKeys = []string{phone.PublicKey}
+	if assert.NoError(t, mcfg.postprocessConfig()) {
+		assert.Equal(t, []devices.Device{laptop}, mcfg.Manager.Devices)
+		assert.Equal(t, []string{laptop.PublicKey}, mcfg.AllowedPublicKeys(time.Now()))
+	}
+
+	out, err = Revoke(out, laptop.PublicKey)
+	assert.NoError(t, err, "the last device can be revoked")
+	_, err = Revoke(out, laptop.PublicKey)
+	assert.NoError(t, err, "revoking twice is harmless")
+}
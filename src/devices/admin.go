@@ -0,0 +1,64 @@
+package devices
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetDevicesRequest struct{}
+type GetDevicesResponse struct {
+	Devices []DeviceEntry `json:"devices"`
+}
+
+type DeviceEntry struct {
+	Name      string   `json:"name"`
+	PublicKey string   `json:"key"`
+	IPAddress string   `json:"address"`
+	Tags      []string `json:"tags,omitempty"`
+	AddedAt   int64    `json:"added_at"`
+	ExpiresAt int64    `json:"expires_at,omitempty"`
+	Active    bool     `json:"active"`
+}
+
+func (r *Registry) getDevicesHandler(req *GetDevicesRequest, res *GetDevicesResponse) error {
+	now := time.Now()
+	for _, d := range r.Devices() {
+		key, _ := d.Key()
+		addr := address.AddrForKey(ed25519.PublicKey(key))
+		entry := DeviceEntry{
+			Name:      d.Name,
+			PublicKey: d.PublicKey,
+			IPAddress: net.IP(addr[:]).String(),
+			Tags:      d.Tags,
+			AddedAt:   d.AddedAt.Unix(),
+			Active:    d.IsActive(now),
+		}
+		if !d.ExpiresAt.IsZero() {
+			entry.ExpiresAt = d.ExpiresAt.Unix()
+		}
+		res.Devices = append(res.Devices, entry)
+	}
+	return nil
+}
+
+func (r *Registry) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getDevices", "Show devices known to the manager", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetDevicesRequest{}
+			res := &GetDevicesResponse{Devices: []DeviceEntry{}}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := r.getDevicesHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
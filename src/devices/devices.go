@@ -0,0 +1,170 @@
+// Package devices keeps track of the named devices known to the manager.
+package devices
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+type Device struct {
+	Name      string    `comment:"Unique, human readable device name"`
+	PublicKey string    `comment:"Hex encoded public key of the device"`
+	Tags      []string  `json:",omitempty" comment:"Tags used to group devices"`
+	AddedAt   time.Time `comment:"Time the device was added"`
+	ExpiresAt time.Time `json:",omitzero" comment:"If set, the device is no longer allowed after this time"`
+}
+
+// Key decodes the device public key.
+func (d *Device) Key() (ed25519.PublicKey, error) {
+	keyBytes, err := hex.DecodeString(d.PublicKey)
+	if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("device %q has an invalid public key", d.Name)
+	}
+	return ed25519.PublicKey(keyBytes), nil
+}
+
+// IsActive reports whether the device hasn't expired at the given time.
+func (d *Device) IsActive(now time.Time) bool {
+	return d.ExpiresAt.IsZero() || now.Before(d.ExpiresAt)
+}
+
+// Validate checks a device list for missing fields, invalid keys and duplicates.
+func Validate(devices []Device) error {
+	names := make(map[string]struct{}, len(devices))
+	keys := make(map[string]struct{}, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		if d.Name == "" {
+			return fmt.Errorf("device %d has no name", i)
+		}
+		if _, err := d.Key(); err != nil {
+			return err
+		}
+		if _, ok := names[d.Name]; ok {
+			return fmt.Errorf("duplicate device name %q", d.Name)
+		}
+		if _, ok := keys[d.PublicKey]; ok {
+			return fmt.Errorf("device %q has the same public key as another device", d.Name)
+		}
+		names[d.Name], keys[d.PublicKey] = struct{}{}, struct{}{}
+	}
+	return nil
+}
+
+// Registry indexes devices by name, key, address and subnet. It can be updated at runtime.
+type Registry struct {
+	mutex    sync.RWMutex
+	devices  []Device
+	byName   map[string]*Device
+	byKey    map[string]*Device
+	byAddr   map[address.Address]*Device
+	bySubnet map[address.Subnet]*Device
+}
+
+func NewRegistry(devices []Device) (*Registry, error) {
+	r := new(Registry)
+	if err := r.Update(devices); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Update replaces the devices in the registry.
+func (r *Registry) Update(devices []Device) error {
+	if err := Validate(devices); err != nil {
+		return err
+	}
+	devices = append([]Device(nil), devices...)
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+	byName := make(map[string]*Device, len(devices))
+	byKey := make(map[string]*Device, len(devices))
+	byAddr := make(map[address.Address]*Device, len(devices))
+	bySubnet := make(map[address.Subnet]*Device, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		key, _ := d.Key()
+		byName[d.Name] = d
+		byKey[d.PublicKey] = d
+		byAddr[*address.AddrForKey(key)] = d
+		bySubnet[*address.SubnetForKey(key)] = d
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.devices, r.byName, r.byKey, r.byAddr, r.bySubnet = devices, byName, byKey, byAddr, bySubnet
+	return nil
+}
+
+// Devices returns all devices, sorted by name.
+func (r *Registry) Devices() []Device {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]Device(nil), r.devices...)
+}
+
+// Lookup finds a device by name or hex public key.
+func (r *Registry) Lookup(nameOrKey string) (Device, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if d, ok := r.byName[nameOrKey]; ok {
+		return *d, true
+	}
+	if d, ok := r.byKey[nameOrKey]; ok {
+		return *d, true
+	}
+	return Device{}, false
+}
+
+// LookupAddress finds the device with the given node address.
+func (r *Registry) LookupAddress(addr address.Address) (Device, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if d, ok := r.byAddr[addr]; ok {
+		return *d, true
+	}
+	return Device{}, false
+}
+
+// NameForIP returns the name of the device owning an address or subnet address.
+func (r *Registry) NameForIP(ip address.Address) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if d, ok := r.byAddr[ip]; ok {
+		return d.Name, true
+	}
+	var snet address.Subnet
+	copy(snet[:], ip[:])
+	if d, ok := r.bySubnet[snet]; ok {
+		return d.Name, true
+	}
+	return "", false
+}
+
+// ActiveKeys returns the hex public keys of devices that haven't expired at the given time.
+func ActiveKeys(devices []Device, now time.Time) []string {
+	keys := []string{}
+	for i := range devices {
+		if devices[i].IsActive(now) {
+			keys = append(keys, devices[i].PublicKey)
+		}
+	}
+	return keys
+}
+
+// NextExpiry returns the earliest expiry after now, if any device has one.
+func NextExpiry(devices []Device, now time.Time) (time.Time, bool) {
+	var next time.Time
+	for i := range devices {
+		if e := devices[i].ExpiresAt; !e.IsZero() && e.After(now) && (next.IsZero() || e.Before(next)) {
+			next = e
+		}
+	}
+	return next, !next.IsZero()
+}
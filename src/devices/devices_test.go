@@ -0,0 +1,83 @@
+package devices
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+func newDevice(name string) Device {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	return Device{Name: name, PublicKey: hex.EncodeToString(pub), AddedAt: time.Now()}
+}
+
+func TestValidate(t *testing.T) {
+	laptop, phone := newDevice("laptop"), newDevice("phone")
+	assert.NoError(t, Validate([]Device{laptop, phone}))
+
+	dupName := phone
+	dupName.Name = "laptop"
+	assert.Error(t, Validate([]Device{laptop, dupName}))
+
+	dupKey := phone
+	dupKey.PublicKey = laptop.PublicKey
+	assert.Error(t, Validate([]Device{laptop, dupKey}))
+
+	badKey := phone
+	badKey.PublicKey = "abcd"
+	assert.Error(t, Validate([]Device{badKey}))
+
+	assert.Error(t, Validate([]Device{{PublicKey: laptop.PublicKey}}))
+}
+
+func TestRegistry(t *testing.T) {
+	laptop := newDevice("laptop")
+	r, err := NewRegistry([]Device{laptop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := laptop.Key()
+	name, ok := r.NameForIP(*address.AddrForKey(key))
+	assert.True(t, ok)
+	assert.Equal(t, "laptop", name)
+
+	var subnetAddr address.Address
+	subnet := address.SubnetForKey(key)
+	copy(subnetAddr[:], subnet[:])
+	subnetAddr[15] = 1
+	name, ok = r.NameForIP(subnetAddr)
+	assert.True(t, ok)
+	assert.Equal(t, "laptop", name)
+	_, ok = r.LookupAddress(subnetAddr)
+	assert.False(t, ok, "only node addresses identify a device")
+	d, ok := r.LookupAddress(*address.AddrForKey(key))
+	assert.True(t, ok)
+	assert.Equal(t, laptop, d)
+
+	_, ok = r.Lookup(laptop.PublicKey)
+	assert.True(t, ok)
+
+	assert.Error(t, r.Update([]Device{laptop, laptop}), "invalid updates are rejected")
+	assert.NoError(t, r.Update(nil))
+	_, ok = r.Lookup("laptop")
+	assert.False(t, ok)
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	permanent, expiring, expired := newDevice("a"), newDevice("b"), newDevice("c")
+	expiring.ExpiresAt = now.Add(time.Hour)
+	expired.ExpiresAt = now.Add(-time.Hour)
+	devices := []Device{permanent, expiring, expired}
+
+	assert.Equal(t, []string{permanent.PublicKey, expiring.PublicKey}, ActiveKeys(devices, now))
+	next, ok := NextExpiry(devices, now)
+	assert.True(t, ok)
+	assert.Equal(t, expiring.ExpiresAt, next)
+	_, ok = NextExpiry(devices, now.Add(2*time.Hour))
+	assert.False(t, ok)
+}
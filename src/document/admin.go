@@ -0,0 +1,69 @@
+package document
+
+import (
+	"encoding/json"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetSyncRequest struct{}
+type GetSyncResponse struct {
+	Entries []SyncEntry `json:"entries"`
+	Peers   []SyncPeer  `json:"peers"`
+}
+
+type SyncEntry struct {
+	Key        string `json:"key"`
+	Version    uint64 `json:"version"`
+	Author     string `json:"author"`
+	AuthorName string `json:"author_name,omitempty"`
+	Deleted    bool   `json:"deleted"`
+}
+
+type SyncPeer struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"key"`
+	LastSync  int64  `json:"last_sync,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (s *Syncer) getSyncHandler(req *GetSyncRequest, res *GetSyncResponse) error {
+	for _, e := range s.doc.Entries() {
+		name, _ := s.doc.AuthorName(e.Author)
+		res.Entries = append(res.Entries, SyncEntry{
+			Key:        e.Key,
+			Version:    e.Version,
+			Author:     e.Author,
+			AuthorName: name,
+			Deleted:    e.Deleted(),
+		})
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, d := range s.doc.View().Devices {
+		state := s.peers[d.PublicKey]
+		peer := SyncPeer{Name: d.Name, PublicKey: d.PublicKey, LastError: state.lastError}
+		if !state.lastSync.IsZero() {
+			peer.LastSync = state.lastSync.Unix()
+		}
+		res.Peers = append(res.Peers, peer)
+	}
+	return nil
+}
+
+func (s *Syncer) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getSync", "Show the replicated config document and when it was last synced with each device", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetSyncRequest{}
+			res := &GetSyncResponse{Entries: []SyncEntry{}, Peers: []SyncPeer{}}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := s.getSyncHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
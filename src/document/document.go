@@ -0,0 +1,590 @@
+// Package document implements the config document replicated between all devices of a user,
+// see architecture/yggdrasil.tldr.
+//
+// The document is a last-writer-wins map of entries, each signed by the device that wrote it.
+// Entries are ordered by a Lamport clock, ties are broken by author key, so merging is
+// commutative, associative and idempotent and all devices converge on the same document no
+// matter the order they receive changes in. Deleted entries are kept as tombstones so that
+// deletions win over older writes.
+//
+// Entries from authors that aren't devices in the document yet are kept aside and applied once
+// their author is added, so it doesn't matter whether a device is added before or after its
+// own entries arrive.
+//
+// Revoked device keys are recorded in permanent entries that can't be deleted. Entries written
+// by a revoked key are rejected, and the device is left out of the document even if a stale
+// replica still writes its device entry.
+package document
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nermolov/yggdrasil-manager/src/acl"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+const (
+	devicePrefix  = "device/"  // followed by the hex public key of the device
+	revokedPrefix = "revoked/" // followed by the revoked hex public key
+	policyKey     = "policy"
+)
+
+// maxVersion bounds entry versions, so that the clock can't be pushed to wrap around.
+// It is far beyond any number of writes, and still exact in JSON numbers read as floats.
+// Revocations are exempt: they are permanent, so their versions never decide anything, and
+// they don't move the clock. A device can't keep itself from being revoked by moving it.
+const maxVersion = 1 << 53
+
+// maxClockSkew bounds how far ahead of the local clock merged entries may be, so that a single
+// entry can't push the clock to maxVersion and stop all local writes. A replica catching up on
+// a fleet's whole history is still far below it.
+const maxClockSkew = 1 << 24
+
+// maxPending limits the entries kept aside for authors that aren't devices in the document.
+const maxPending = 4096
+
+// Revocation is the value of a revoked key entry.
+type Revocation struct {
+	RevokedAt time.Time
+}
+
+// Entry is a single signed value of the document.
+type Entry struct {
+	Key       string
+	Value     json.RawMessage `json:",omitempty"` // empty once deleted
+	Version   uint64          // Lamport clock of the change
+	Author    string          // hex public key of the device that made the change
+	Signature []byte
+}
+
+// revocation reports whether the entry revokes a key.
+func (e *Entry) revocation() bool {
+	return strings.HasPrefix(e.Key, revokedPrefix)
+}
+
+// Deleted reports whether the entry is a tombstone.
+func (e *Entry) Deleted() bool {
+	return len(e.Value) == 0
+}
+
+func (e *Entry) signedData() []byte {
+	bs, _ := json.Marshal(struct {
+		Key     string
+		Value   json.RawMessage `json:",omitempty"`
+		Version uint64
+	}{e.Key, e.Value, e.Version})
+	return bs
+}
+
+func (e *Entry) sign(key ed25519.PrivateKey) {
+	e.Author = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	e.Signature = ed25519.Sign(key, e.signedData())
+}
+
+// verify checks the signature and that the value fits the key.
+func (e *Entry) verify() error {
+	author, err := hex.DecodeString(e.Author)
+	if err != nil || len(author) != ed25519.PublicKeySize {
+		return fmt.Errorf("entry %q has an invalid author", e.Key)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(author), e.signedData(), e.Signature) {
+		return fmt.Errorf("entry %q has an invalid signature", e.Key)
+	}
+	if e.Deleted() {
+		if strings.HasPrefix(e.Key, revokedPrefix) {
+			return fmt.Errorf("entry %q deletes a revocation", e.Key)
+		}
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(e.Key, devicePrefix):
+		var d devices.Device
+		if err := json.Unmarshal(e.Value, &d); err != nil {
+			return fmt.Errorf("entry %q: %w", e.Key, err)
+		}
+		if d.PublicKey != strings.TrimPrefix(e.Key, devicePrefix) {
+			return fmt.Errorf("entry %q holds device %q with another key", e.Key, d.Name)
+		}
+		return devices.Validate([]devices.Device{d})
+	case strings.HasPrefix(e.Key, revokedPrefix):
+		var r Revocation
+		if err := json.Unmarshal(e.Value, &r); err != nil {
+			return fmt.Errorf("entry %q: %w", e.Key, err)
+		}
+		if key, err := hex.DecodeString(strings.TrimPrefix(e.Key, revokedPrefix)); err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("entry %q revokes an invalid key", e.Key)
+		}
+		return nil
+	case e.Key == policyKey:
+		var policy []acl.Entry
+		if err := json.Unmarshal(e.Value, &policy); err != nil {
+			return fmt.Errorf("entry %q: %w", e.Key, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown entry %q", e.Key)
+}
+
+// newer reports whether e wins over other.
+func (e *Entry) newer(other *Entry) bool {
+	if e.Version != other.Version {
+		return e.Version > other.Version
+	}
+	if e.Author != other.Author {
+		return e.Author > other.Author
+	}
+	return bytes.Compare(e.Value, other.Value) > 0
+}
+
+// pendingKey identifies an entry kept aside, only the newest per key and author is kept.
+type pendingKey struct {
+	key, author string
+}
+
+// Document is the local replica of the config document.
+type Document struct {
+	mutex   sync.RWMutex
+	self    string // hex public key of this device, always allowed to write
+	entries map[string]Entry
+	pending map[pendingKey]Entry // entries from authors that aren't devices in the document
+	clock   uint64
+}
+
+// New returns an empty document for the device with the given public key.
+func New(self ed25519.PublicKey) *Document {
+	return &Document{
+		self:    hex.EncodeToString(self),
+		entries: map[string]Entry{},
+		pending: map[pendingKey]Entry{},
+	}
+}
+
+type documentState struct {
+	Entries []Entry
+	Pending []Entry `json:",omitempty"`
+}
+
+// Unmarshal loads a document saved with MarshalJSON. Every entry must be validly signed.
+func Unmarshal(self ed25519.PublicKey, data []byte) (*Document, error) {
+	var state documentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	d := New(self)
+	for i, entries := range [][]Entry{state.Entries, state.Pending} {
+		for _, e := range entries {
+			if err := normalize(&e); err != nil {
+				return nil, err
+			}
+			if err := e.verify(); err != nil {
+				return nil, err
+			}
+			if e.Version > maxVersion && !e.revocation() {
+				return nil, fmt.Errorf("entry %q has version %d, above the limit of %d", e.Key, e.Version, maxVersion)
+			}
+			if i == 0 {
+				d._apply(e)
+			} else {
+				d._addPending(e)
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *Document) MarshalJSON() ([]byte, error) {
+	d.mutex.RLock()
+	pending := make([]Entry, 0, len(d.pending))
+	for _, e := range d.pending {
+		pending = append(pending, e)
+	}
+	d.mutex.RUnlock()
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Key != pending[j].Key {
+			return pending[i].Key < pending[j].Key
+		}
+		return pending[i].Author < pending[j].Author
+	})
+	return json.Marshal(documentState{Entries: d.Entries(), Pending: pending})
+}
+
+// Entries returns all entries including tombstones, sorted by key.
+func (d *Document) Entries() []Entry {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	entries := make([]Entry, 0, len(d.entries))
+	for _, e := range d.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// normalize compacts the value, so that equal values compare equal.
+func normalize(e *Entry) error {
+	if len(e.Value) == 0 || string(e.Value) == "null" {
+		e.Value = nil
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, e.Value); err != nil {
+		return fmt.Errorf("entry %q: %w", e.Key, err)
+	}
+	e.Value = buf.Bytes()
+	return nil
+}
+
+func (d *Document) _apply(e Entry) bool {
+	if e.Version > d.clock && !e.revocation() {
+		d.clock = e.Version
+	}
+	if cur, ok := d.entries[e.Key]; ok && !e.newer(&cur) {
+		return false
+	}
+	d.entries[e.Key] = e
+	return true
+}
+
+// _set writes value under key with the next clock value, value nil deletes the entry.
+// Nothing is written if the entry already holds the value.
+func (d *Document) _set(key string, value any, signer ed25519.PrivateKey) (bool, error) {
+	e := Entry{Key: key}
+	if value != nil {
+		bs, err := json.Marshal(value)
+		if err != nil {
+			return false, err
+		}
+		e.Value = bs
+	}
+	if err := normalize(&e); err != nil {
+		return false, err
+	}
+	if cur, ok := d.entries[key]; ok && bytes.Equal(cur.Value, e.Value) {
+		return false, nil
+	} else if !ok && e.Deleted() {
+		return false, nil
+	}
+	switch {
+	case d.clock < maxVersion:
+		e.Version = d.clock + 1
+	case e.revocation():
+		e.Version = maxVersion
+	default:
+		return false, fmt.Errorf("entry %q can't be written, the clock reached the version limit", key)
+	}
+	e.sign(signer)
+	if err := e.verify(); err != nil {
+		return false, err
+	}
+	return d._apply(e), nil
+}
+
+// _authorized reports whether a hex public key may write entries: this device and
+// the devices in the document may, unless they have been revoked.
+func (d *Document) _authorized(author string) bool {
+	if d._revoked(author) {
+		return false
+	}
+	if author == d.self {
+		return true
+	}
+	e, ok := d.entries[devicePrefix+author]
+	return ok && !e.Deleted()
+}
+
+func (d *Document) _revoked(key string) bool {
+	_, ok := d.entries[revokedPrefix+key]
+	return ok
+}
+
+// _addPending keeps an entry aside until its author is a device in the document,
+// reporting false if there is no room left.
+func (d *Document) _addPending(e Entry) bool {
+	pk := pendingKey{e.Key, e.Author}
+	if cur, ok := d.pending[pk]; ok {
+		if e.newer(&cur) {
+			d.pending[pk] = e
+		}
+		return true
+	}
+	if len(d.pending) >= maxPending {
+		return false
+	}
+	d.pending[pk] = e
+	return true
+}
+
+// _applyPending applies the entries kept aside whose authors have been added since, until no more
+// can be applied, and drops those that are outdated or from revoked authors. Reports whether the
+// document changed.
+func (d *Document) _applyPending() bool {
+	changed := false
+	for progress := true; progress; {
+		progress = false
+		// apply revocations first, so nothing written by a revoked key gets in
+		keys := slices.SortedFunc(maps.Keys(d.pending), func(a, b pendingKey) int {
+			if ra, rb := strings.HasPrefix(a.key, revokedPrefix), strings.HasPrefix(b.key, revokedPrefix); ra != rb {
+				if ra {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Or(strings.Compare(a.key, b.key), strings.Compare(a.author, b.author))
+		})
+		for _, pk := range keys {
+			e := d.pending[pk]
+			if cur, ok := d.entries[e.Key]; (ok && !e.newer(&cur)) || d._revoked(e.Author) {
+				delete(d.pending, pk)
+				continue
+			}
+			if !d._authorized(e.Author) {
+				continue
+			}
+			delete(d.pending, pk)
+			if d._apply(e) {
+				changed = true
+			}
+			progress = true
+		}
+	}
+	return changed
+}
+
+// Merge applies the entries of another replica that are newer than the local ones and
+// reports whether the document changed. Entries with invalid signatures, or with versions
+// more than maxClockSkew ahead of the local clock, are skipped and counted in the returned error. Entries from authors that aren't devices in the
+// document are counted too, but kept aside and applied once a later merge or import adds their
+// author, so the result doesn't depend on the order entries arrive in.
+func (d *Document) Merge(entries []Entry) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	limit := min(d.clock+maxClockSkew, maxVersion)
+	var merged []pendingKey
+	var errs []error
+	for _, e := range entries {
+		if err := normalize(&e); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if cur, ok := d.entries[e.Key]; ok && !e.newer(&cur) {
+			continue
+		}
+		if err := e.verify(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch {
+		case e.Version > limit && !e.revocation():
+			errs = append(errs, fmt.Errorf("entry %q has version %d, too far ahead of the local clock at %d", e.Key, e.Version, d.clock))
+		case d._revoked(e.Author):
+			errs = append(errs, fmt.Errorf("entry %q was written by revoked device %s", e.Key, e.Author))
+		case !d._addPending(e):
+			errs = append(errs, fmt.Errorf("entry %q was dropped, too many entries from unknown devices", e.Key))
+		default:
+			merged = append(merged, pendingKey{e.Key, e.Author})
+		}
+	}
+	changed := d._applyPending()
+	for _, pk := range merged {
+		if _, ok := d.pending[pk]; ok {
+			errs = append(errs, fmt.Errorf("entry %q was written by unknown device %s", pk.key, pk.author))
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// View is the part of a manager config held by the document, as seen by one device.
+type View struct {
+	Name    string           // name of the device itself
+	Tags    []string         // tags of the device itself
+	Devices []devices.Device // all other devices
+	Policy  []acl.Entry
+	Revoked []string // revoked hex public keys, sorted
+}
+
+// View returns the document contents as seen by this device. Devices that claim
+// a name already taken by a device added earlier get their key appended to it.
+// Revoked devices are left out.
+func (d *Document) View() View {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var all []devices.Device
+	var v View
+	for key, e := range d.entries {
+		if e.Deleted() {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(key, devicePrefix):
+			var dev devices.Device
+			if err := json.Unmarshal(e.Value, &dev); err == nil && !d._revoked(dev.PublicKey) {
+				all = append(all, dev)
+			}
+		case strings.HasPrefix(key, revokedPrefix):
+			v.Revoked = append(v.Revoked, strings.TrimPrefix(key, revokedPrefix))
+		case key == policyKey:
+			_ = json.Unmarshal(e.Value, &v.Policy)
+		}
+	}
+	slices.Sort(v.Revoked)
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].AddedAt.Equal(all[j].AddedAt) {
+			return all[i].AddedAt.Before(all[j].AddedAt)
+		}
+		return all[i].PublicKey < all[j].PublicKey
+	})
+	names := map[string]struct{}{}
+	for _, dev := range all {
+		if _, taken := names[dev.Name]; taken {
+			dev.Name = dev.Name + "-" + dev.PublicKey[:8]
+		}
+		names[dev.Name] = struct{}{}
+		if dev.PublicKey == d.self {
+			v.Name, v.Tags = dev.Name, dev.Tags
+			continue
+		}
+		v.Devices = append(v.Devices, dev)
+	}
+	sort.Slice(v.Devices, func(i, j int) bool {
+		return v.Devices[i].Name < v.Devices[j].Name
+	})
+	return v
+}
+
+// Import writes the changes needed for the document to match v, signed with the key of
+// this device, and reports whether there were any. Devices missing from v are deleted.
+// Revocations are only ever added, and revoked devices are ignored, in v and in the document.
+func (d *Document) Import(v View, signer ed25519.PrivateKey) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d._import(nil, v, signer)
+}
+
+// ImportChanges writes the changes made from base, the view the document was last synced to,
+// to v, and reports whether there were any. Unlike Import, only what changed between base and
+// v is written, so changes other devices made to the document since base are kept: a device
+// missing from both was added by another device, and isn't deleted.
+func (d *Document) ImportChanges(base, v View, signer ed25519.PrivateKey) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d._import(&base, v, signer)
+}
+
+// sameJSON reports whether a and b encode to the same JSON.
+func sameJSON(a, b any) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// _import writes v to the document, only the changes from base if it's set.
+func (d *Document) _import(base *View, v View, signer ed25519.PrivateKey) (bool, error) {
+	changed := false
+	set := func(key string, value any) error {
+		c, err := d._set(key, value, signer)
+		changed = changed || c
+		return err
+	}
+
+	for _, key := range v.Revoked {
+		if d._revoked(key) {
+			continue
+		}
+		if err := set(revokedPrefix+key, Revocation{RevokedAt: time.Now().UTC().Truncate(time.Second)}); err != nil {
+			return changed, err
+		}
+	}
+
+	self := devices.Device{Name: v.Name, PublicKey: d.self, Tags: v.Tags, AddedAt: time.Now().UTC().Truncate(time.Second)}
+	e, ok := d.entries[devicePrefix+d.self]
+	if ok && !e.Deleted() {
+		var cur devices.Device
+		if err := json.Unmarshal(e.Value, &cur); err == nil {
+			self.AddedAt = cur.AddedAt
+		}
+	}
+	if base == nil || !ok || e.Deleted() || v.Name != base.Name || !slices.Equal(v.Tags, base.Tags) {
+		if err := set(devicePrefix+d.self, self); err != nil {
+			return changed, err
+		}
+	}
+
+	keep := map[string]struct{}{devicePrefix + d.self: {}}
+	synced := map[string]devices.Device{}
+	if base != nil {
+		for _, dev := range base.Devices {
+			synced[devicePrefix+dev.PublicKey] = dev
+		}
+	}
+	for _, dev := range v.Devices {
+		if d._revoked(dev.PublicKey) {
+			continue
+		}
+		key := devicePrefix + dev.PublicKey
+		keep[key] = struct{}{}
+		if old, ok := synced[key]; ok && sameJSON(old, dev) {
+			continue // unchanged locally, another device may have changed it since
+		}
+		if err := set(key, dev); err != nil {
+			return changed, err
+		}
+	}
+	for key, e := range d.entries {
+		if _, ok := keep[key]; ok || !strings.HasPrefix(key, devicePrefix) || e.Deleted() {
+			continue
+		}
+		if _, ok := synced[key]; base != nil && !ok {
+			continue // added by another device since base
+		}
+		if d._revoked(strings.TrimPrefix(key, devicePrefix)) {
+			continue // left out anyway, and deleting it may not be possible if it moved the clock
+		}
+		if err := set(key, nil); err != nil {
+			return changed, err
+		}
+	}
+
+	if base == nil || !(len(base.Policy) == 0 && len(v.Policy) == 0 || sameJSON(base.Policy, v.Policy)) {
+		var policy any
+		if len(v.Policy) > 0 {
+			policy = v.Policy
+		}
+		if err := set(policyKey, policy); err != nil {
+			return changed, err
+		}
+	}
+	// devices added here may have written entries that were kept aside
+	if d._applyPending() {
+		changed = true
+	}
+	return changed, nil
+}
+
+// AuthorName returns the name of the device with the given hex public key, if it's in the document.
+func (d *Document) AuthorName(author string) (string, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	e, ok := d.entries[devicePrefix+author]
+	if !ok || e.Deleted() {
+		return "", false
+	}
+	var dev devices.Device
+	if err := json.Unmarshal(e.Value, &dev); err != nil {
+		return "", false
+	}
+	return dev.Name, true
+}
@@ -0,0 +1,363 @@
+package document
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nermolov/yggdrasil-manager/src/acl"
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+type testDevice struct {
+	devices.Device
+	signer ed25519.PrivateKey
+	doc    *Document
+}
+
+func newTestDevice(name string, addedAt time.Time) *testDevice {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	return &testDevice{
+		Device: devices.Device{Name: name, PublicKey: hex.EncodeToString(pub), AddedAt: addedAt},
+		signer: priv,
+		doc:    New(pub),
+	}
+}
+
+func (d *testDevice) set(t *testing.T, others []devices.Device, policy []acl.Entry) {
+	t.Helper()
+	if _, err := d.doc.Import(View{Name: d.Name, Devices: others, Policy: policy}, d.signer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exchange(t *testing.T, a, b *testDevice) {
+	t.Helper()
+	_, err := b.doc.Merge(a.doc.Entries())
+	assert.NoError(t, err)
+	_, err = a.doc.Merge(b.doc.Entries())
+	assert.NoError(t, err)
+}
+
+func TestConvergence(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	laptop, phone, nas := newTestDevice("laptop", start), newTestDevice("phone", start.Add(time.Hour)), newTestDevice("nas", start.Add(2*time.Hour))
+	laptop.set(t, []devices.Device{phone.Device, nas.Device}, nil)
+	phone.set(t, []devices.Device{laptop.Device, nas.Device}, nil)
+	nas.set(t, []devices.Device{laptop.Device, phone.Device}, nil)
+	exchange(t, laptop, phone)
+	exchange(t, phone, nas)
+
+	// concurrent changes on two devices
+	policy := []acl.Entry{{To: []string{"tag:servers"}, Accept: []string{"tcp/443"}, From: []string{"*"}}}
+	server := nas.Device
+	server.Tags = []string{"servers"}
+	laptop.set(t, []devices.Device{phone.Device, server}, policy)
+	phone.Name = "tablet"
+	phone.set(t, []devices.Device{laptop.Device, nas.Device}, nil)
+
+	// merging in any order gives the same document
+	exchange(t, laptop, nas)
+	exchange(t, nas, phone)
+	exchange(t, laptop, phone)
+	assert.Equal(t, laptop.doc.Entries(), phone.doc.Entries())
+	assert.Equal(t, laptop.doc.Entries(), nas.doc.Entries())
+	assert.Equal(t, []devices.Device{server, phone.Device}, laptop.doc.View().Devices)
+	assert.Equal(t, policy, phone.doc.View().Policy)
+
+	// a deletion wins over the writes it has seen
+	phone.set(t, []devices.Device{laptop.Device}, policy)
+	exchange(t, phone, laptop)
+	exchange(t, laptop, nas)
+	v := laptop.doc.View()
+	assert.Equal(t, "laptop", v.Name)
+	assert.Equal(t, []devices.Device{phone.Device}, v.Devices)
+	assert.Equal(t, policy, v.Policy)
+	assert.Equal(t, laptop.doc.Entries(), nas.doc.Entries())
+
+	// the removed device can't add itself back
+	nas.set(t, []devices.Device{laptop.Device, phone.Device}, policy)
+	_, err := laptop.doc.Merge(nas.doc.Entries())
+	assert.Error(t, err)
+	assert.Equal(t, []devices.Device{phone.Device}, laptop.doc.View().Devices)
+
+	changed, err := laptop.doc.Merge(phone.doc.Entries())
+	assert.NoError(t, err)
+	assert.False(t, changed, "merging is idempotent")
+	changed, err = laptop.doc.Import(v, laptop.signer)
+	assert.NoError(t, err)
+	assert.False(t, changed, "importing the current view changes nothing")
+}
+
+func TestMergeRejects(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	laptop, phone, stranger := newTestDevice("laptop", start), newTestDevice("phone", start), newTestDevice("stranger", start)
+	laptop.set(t, []devices.Device{phone.Device}, nil)
+	stranger.set(t, []devices.Device{laptop.Device}, nil)
+
+	changed, err := laptop.doc.Merge(stranger.doc.Entries())
+	assert.Error(t, err, "entries from unknown devices are rejected")
+	assert.False(t, changed)
+
+	phone.set(t, []devices.Device{laptop.Device}, nil)
+	entries := phone.doc.Entries()
+	for i := range entries {
+		entries[i].Value = json.RawMessage(`{"Name":"evil","PublicKey":"` + entries[i].Key[len(devicePrefix):] + `","AddedAt":"2024-01-01T00:00:00Z"}`)
+	}
+	changed, err = laptop.doc.Merge(entries)
+	assert.Error(t, err, "tampered entries are rejected")
+	assert.False(t, changed)
+
+	// a device added by a known device is accepted along with its own entries
+	nas := newTestDevice("nas", start)
+	phone.set(t, []devices.Device{laptop.Device, nas.Device}, nil)
+	nas.set(t, []devices.Device{laptop.Device, phone.Device}, []acl.Entry{{To: []string{"self"}, Accept: []string{"tcp/22"}, From: []string{"*"}}})
+	_, err = phone.doc.Merge(nas.doc.Entries())
+	assert.NoError(t, err)
+	_, err = laptop.doc.Merge(phone.doc.Entries())
+	assert.NoError(t, err)
+	assert.Len(t, laptop.doc.View().Policy, 1)
+}
+
+func TestMergeLimits(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	laptop, phone := newTestDevice("laptop", start), newTestDevice("phone", start)
+	laptop.set(t, []devices.Device{phone.Device}, nil)
+	phone.set(t, []devices.Device{laptop.Device}, nil)
+
+	value, _ := json.Marshal(phone.Device)
+	for _, version := range []uint64{math.MaxUint64, maxVersion, laptop.doc.clock + maxClockSkew + 1} {
+		forged := Entry{Key: devicePrefix + phone.PublicKey, Value: value, Version: version}
+		forged.sign(phone.signer)
+		changed, err := laptop.doc.Merge([]Entry{forged})
+		assert.ErrorContains(t, err, "too far ahead of the local clock", "version %d", version)
+		assert.False(t, changed)
+		assert.Less(t, laptop.doc.clock, uint64(maxClockSkew))
+	}
+	within := Entry{Key: devicePrefix + phone.PublicKey, Value: value, Version: laptop.doc.clock + maxClockSkew}
+	within.sign(phone.signer)
+	changed, err := laptop.doc.Merge([]Entry{within})
+	assert.NoError(t, err, "entries within the skew are merged")
+	assert.True(t, changed)
+
+	// the clock still moves forward, so local writes win over older entries
+	exchange(t, laptop, phone)
+	phone.Tags = []string{"phones"}
+	laptop.set(t, []devices.Device{phone.Device}, nil)
+	exchange(t, laptop, phone)
+	assert.Equal(t, []string{"phones"}, phone.doc.View().Tags)
+}
+
+// TestMergeOrder merges the entries of a new device and the entry adding it in every order,
+// which must all give the same document.
+func TestMergeOrder(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	laptop, phone, admin := newTestDevice("laptop", start), newTestDevice("phone", start), newTestDevice("admin", start.Add(time.Hour))
+	phone.set(t, []devices.Device{laptop.Device}, nil)
+	laptop.set(t, []devices.Device{phone.Device, admin.Device}, nil)
+	admin.set(t, []devices.Device{laptop.Device, phone.Device}, []acl.Entry{{To: []string{"self"}, Accept: []string{"tcp/22"}, From: []string{"*"}}})
+	var entries []Entry
+	for _, e := range laptop.doc.Entries() {
+		if e.Key == devicePrefix+admin.PublicKey {
+			entries = append(entries, e) // the grant
+		}
+	}
+	entries = append(entries, admin.doc.Entries()...)
+	initial, _ := json.Marshal(phone.doc)
+
+	var expected []Entry
+	var permute func(n int)
+	permute = func(n int) {
+		if n == 1 {
+			doc, err := Unmarshal(phone.signer.Public().(ed25519.PublicKey), initial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				_, _ = doc.Merge([]Entry{e})
+			}
+			if expected == nil {
+				expected = doc.Entries()
+			}
+			assert.Equal(t, expected, doc.Entries(), "merge order %v", entries)
+			return
+		}
+		for i := range n {
+			permute(n - 1)
+			if n%2 == 0 {
+				entries[i], entries[n-1] = entries[n-1], entries[i]
+			} else {
+				entries[0], entries[n-1] = entries[n-1], entries[0]
+			}
+		}
+	}
+	permute(len(entries))
+	assert.Len(t, expected, 4)
+
+	// entries kept aside survive restarts
+	_, err := phone.doc.Merge(admin.doc.Entries())
+	assert.Error(t, err, "the admin isn't a device yet")
+	data, _ := json.Marshal(phone.doc)
+	loaded, err := Unmarshal(phone.signer.Public().(ed25519.PublicKey), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := loaded.Merge(entries[:1])
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, expected, loaded.Entries())
+	assert.Len(t, loaded.View().Policy, 1)
+}
+
+// TestImportChanges edits the config of a device while another device adds a device, the local
+// edit must not undo the remote change.
+func TestImportChanges(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	laptop, phone, nas := newTestDevice("laptop", start), newTestDevice("phone", start), newTestDevice("nas", start.Add(time.Hour))
+	laptop.set(t, []devices.Device{phone.Device}, nil)
+	phone.set(t, []devices.Device{laptop.Device}, nil)
+	exchange(t, laptop, phone)
+	synced := laptop.doc.View() // as last written to the config file of the laptop
+
+	// the phone adds the nas, while the config file of the laptop is edited
+	phone.set(t, []devices.Device{laptop.Device, nas.Device}, nil)
+	exchange(t, phone, laptop)
+	edited := synced
+	edited.Tags = []string{"laptops"}
+	edited.Policy = []acl.Entry{{To: []string{"tag:laptops"}, Accept: []string{"tcp/22"}, From: []string{"phone"}}}
+	changed, err := laptop.doc.ImportChanges(synced, edited, laptop.signer)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	exchange(t, laptop, phone)
+	for _, d := range []*testDevice{laptop, phone} {
+		v := d.doc.View()
+		assert.Len(t, v.Devices, 2, "the nas is kept on %s", d.Name)
+		assert.Equal(t, edited.Policy, v.Policy)
+	}
+	assert.Equal(t, []string{"laptops"}, phone.doc.View().Devices[0].Tags)
+
+	// devices removed locally are still deleted
+	removed := laptop.doc.View()
+	removed.Devices = slices.DeleteFunc(slices.Clone(removed.Devices), func(d devices.Device) bool { return d.Name == "nas" })
+	_, err = laptop.doc.ImportChanges(laptop.doc.View(), removed, laptop.signer)
+	assert.NoError(t, err)
+	assert.Equal(t, []devices.Device{phone.Device}, laptop.doc.View().Devices)
+}
+
+func TestViewNameConflict(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	laptop, first, second := newTestDevice("laptop", start), newTestDevice("phone", start), newTestDevice("phone", start.Add(time.Minute))
+	laptop.set(t, []devices.Device{second.Device, first.Device}, nil)
+	v := laptop.doc.View()
+	if assert.Len(t, v.Devices, 2) {
+		assert.Equal(t, "phone", v.Devices[0].Name)
+		assert.Equal(t, "phone-"+second.PublicKey[:8], v.Devices[1].Name)
+	}
+	assert.NoError(t, devices.Validate(v.Devices))
+}
+
+func TestUnmarshal(t *testing.T) {
+	laptop, phone := newTestDevice("laptop", time.Now().UTC().Truncate(time.Second)), newTestDevice("phone", time.Now().UTC().Truncate(time.Second))
+	laptop.set(t, []devices.Device{phone.Device}, nil)
+	data, err := json.MarshalIndent(laptop.doc, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Unmarshal(laptop.signer.Public().(ed25519.PublicKey), data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, laptop.doc.Entries(), loaded.Entries())
+		assert.Equal(t, laptop.doc.View(), loaded.View())
+	}
+
+	data[len(data)/2] ^= 1
+	_, err = Unmarshal(laptop.signer.Public().(ed25519.PublicKey), data)
+	assert.Error(t, err)
+}
+
+func TestRevocation(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	laptop, phone, nas := newTestDevice("laptop", start), newTestDevice("phone", start), newTestDevice("nas", start)
+	laptop.set(t, []devices.Device{phone.Device, nas.Device}, nil)
+	phone.set(t, []devices.Device{laptop.Device, nas.Device}, nil)
+	nas.set(t, []devices.Device{laptop.Device, phone.Device}, nil)
+	exchange(t, laptop, phone)
+	exchange(t, laptop, nas)
+	stale := nas.doc.Entries()
+
+	if _, err := laptop.doc.Import(View{Name: "laptop", Devices: []devices.Device{nas.Device}, Revoked: []string{phone.PublicKey}}, laptop.signer); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, laptop, nas)
+	assert.Equal(t, []string{phone.PublicKey}, nas.doc.View().Revoked)
+	assert.Equal(t, []devices.Device{laptop.Device}, nas.doc.View().Devices)
+
+	// the revoked device and stale copies can't bring it back
+	value, _ := json.Marshal(phone.Device)
+	forged := Entry{Key: devicePrefix + phone.PublicKey, Value: value, Version: 1000}
+	forged.sign(phone.signer)
+	_, err := nas.doc.Merge([]Entry{forged})
+	assert.Error(t, err)
+	_, _ = nas.doc.Merge(stale)
+	nas.set(t, []devices.Device{laptop.Device, phone.Device}, nil)
+	assert.Equal(t, []devices.Device{laptop.Device}, nas.doc.View().Devices)
+	assert.Equal(t, []string{phone.PublicKey}, nas.doc.View().Revoked, "revocations are never removed")
+
+	tombstone := Entry{Key: revokedPrefix + phone.PublicKey, Version: 1000}
+	tombstone.sign(nas.signer)
+	_, err = laptop.doc.Merge([]Entry{tombstone})
+	assert.Error(t, err, "revocations can't be deleted")
+
+	data, _ := json.Marshal(laptop.doc)
+	loaded, err := Unmarshal(laptop.signer.Public().(ed25519.PublicKey), data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{phone.PublicKey}, loaded.View().Revoked, "revocations survive restarts")
+	}
+}
+
+// TestRevocationAtClockLimit revokes a device that pushed the clock to the version limit,
+// which stops all other writes but must not keep it from being revoked.
+func TestRevocationAtClockLimit(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	laptop, phone, nas := newTestDevice("laptop", start), newTestDevice("phone", start), newTestDevice("nas", start)
+	laptop.set(t, []devices.Device{phone.Device, nas.Device}, nil)
+	phone.set(t, []devices.Device{laptop.Device, nas.Device}, nil)
+	exchange(t, laptop, phone)
+
+	// a replica that took in the entry of the nas at the limit, e.g. before the skew bound
+	value, _ := json.Marshal(nas.Device)
+	pinned := Entry{Key: devicePrefix + nas.PublicKey, Value: value, Version: maxVersion}
+	pinned.sign(nas.signer)
+	state := documentState{Entries: append(laptop.doc.Entries(), pinned)}
+	data, _ := json.Marshal(state)
+	doc, err := Unmarshal(laptop.signer.Public().(ed25519.PublicKey), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop.doc = doc
+	assert.Equal(t, uint64(maxVersion), laptop.doc.clock)
+	_, err = laptop.doc.Import(View{Name: "laptop", Devices: []devices.Device{phone.Device}}, laptop.signer)
+	assert.ErrorContains(t, err, "version limit", "other writes are stuck")
+
+	changed, err := laptop.doc.Import(View{Name: "laptop", Devices: []devices.Device{phone.Device}, Revoked: []string{nas.PublicKey}}, laptop.signer)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{nas.PublicKey}, laptop.doc.View().Revoked)
+	assert.Equal(t, []devices.Device{phone.Device}, laptop.doc.View().Devices)
+
+	// and it merges into replicas with a normal clock, without moving it
+	_, err = phone.doc.Merge(laptop.doc.Entries())
+	assert.ErrorContains(t, err, "too far ahead", "the pinned entry of the nas is rejected")
+	assert.Equal(t, []string{nas.PublicKey}, phone.doc.View().Revoked)
+	assert.Equal(t, []devices.Device{laptop.Device}, phone.doc.View().Devices)
+	assert.Less(t, phone.doc.clock, uint64(maxClockSkew))
+
+	data, _ = json.Marshal(laptop.doc)
+	_, err = Unmarshal(laptop.signer.Public().(ed25519.PublicKey), data)
+	assert.NoError(t, err, "the revocation survives restarts")
+}
@@ -0,0 +1,196 @@
+package document
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// SyncPath is where devices exchange the document on the management service.
+const SyncPath = "/sync"
+
+const (
+	syncInterval    = 30 * time.Second
+	maxDocumentSize = 4 << 20
+)
+
+// syncMessage is sent both ways, each side merges the entries of the other.
+type syncMessage struct {
+	Entries []Entry
+}
+
+// peerState is the outcome of the last sync with a device.
+type peerState struct {
+	lastSync  time.Time
+	lastError string
+}
+
+// Syncer gossips the document with the other devices in it. Every device periodically sends
+// its entries to the management service of every other active device, which merges them and
+// answers with its own.
+type Syncer struct {
+	doc      *Document
+	port     uint16
+	onChange func()
+	logger   *log.Logger
+	trigger  chan struct{}
+
+	mutex sync.Mutex
+	peers map[string]peerState // by hex public key
+}
+
+// NewSyncer creates a syncer for doc, syncing with the management service on port of the
+// other devices. onChange is called after entries from another device changed the document,
+// it must not block for long.
+func NewSyncer(doc *Document, port uint16, logger *log.Logger, onChange func()) *Syncer {
+	return &Syncer{
+		doc:      doc,
+		port:     port,
+		onChange: onChange,
+		logger:   logger,
+		trigger:  make(chan struct{}, 1),
+		peers:    map[string]peerState{},
+	}
+}
+
+// Trigger starts a sync round soon, e.g. after a local change.
+func (s *Syncer) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// deviceForIP returns the hex key of the active device with the given address.
+func (s *Syncer) deviceForIP(ip net.IP) (string, bool) {
+	now := time.Now()
+	for _, d := range s.doc.View().Devices {
+		key, err := d.Key()
+		if err != nil || !d.IsActive(now) {
+			continue
+		}
+		if addr := address.AddrForKey(key); ip.Equal(net.IP(addr[:])) {
+			return d.PublicKey, true
+		}
+	}
+	return "", false
+}
+
+func (s *Syncer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != SyncPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.deviceForIP(net.ParseIP(host)); !ok {
+		http.Error(w, "not a device in the document", http.StatusForbidden)
+		return
+	}
+	var msg syncMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDocumentSize)).Decode(&msg); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	s.merge(host, msg.Entries)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(syncMessage{Entries: s.doc.Entries()})
+}
+
+func (s *Syncer) merge(from string, entries []Entry) {
+	changed, err := s.doc.Merge(entries)
+	if err != nil {
+		s.logger.Warnf("Skipped document entries from %s: %v", from, err)
+	}
+	if changed {
+		s.onChange()
+		s.Trigger() // pass the changes on
+	}
+}
+
+// Run syncs with the other devices using client until ctx is done. Requests from the other
+// devices are served by mounting the syncer on SyncPath of the management service.
+func (s *Syncer) Run(ctx context.Context, client *http.Client) error {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		s.syncAll(ctx, client)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-s.trigger:
+		}
+	}
+}
+
+// syncAll exchanges the document with every other active device.
+func (s *Syncer) syncAll(ctx context.Context, client *http.Client) {
+	now := time.Now()
+	for _, d := range s.doc.View().Devices {
+		key, err := d.Key()
+		if err != nil || !d.IsActive(now) {
+			continue
+		}
+		addr := address.AddrForKey(key)
+		err = s.syncWith(ctx, client, net.IP(addr[:]))
+		if ctx.Err() != nil {
+			return
+		}
+		state := peerState{lastSync: now}
+		s.mutex.Lock()
+		if err != nil {
+			state = s.peers[d.PublicKey]
+			state.lastError = err.Error()
+			s.logger.Debugf("Failed to sync the document with %s: %v", d.Name, err)
+		}
+		s.peers[d.PublicKey] = state
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Syncer) syncWith(ctx context.Context, client *http.Client, ip net.IP) error {
+	body, err := json.Marshal(syncMessage{Entries: s.doc.Entries()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, management.URL(ip, s.port, SyncPath), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("sync rejected (%d): %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var msg syncMessage
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxDocumentSize)).Decode(&msg); err != nil {
+		return err
+	}
+	s.merge(ip.String(), msg.Entries)
+	return nil
+}
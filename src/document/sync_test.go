@@ -0,0 +1,53 @@
+package document
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+func TestSyncerServeHTTP(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	laptop, phone, stranger := newTestDevice("laptop", start), newTestDevice("phone", start), newTestDevice("stranger", start)
+	laptop.set(t, []devices.Device{phone.Device}, nil)
+	phone.set(t, []devices.Device{laptop.Device}, nil)
+	changes := 0
+	syncer := NewSyncer(laptop.doc, management.DefaultPort, log.New(nil, "", 0), func() { changes++ })
+
+	post := func(from *testDevice) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(syncMessage{Entries: from.doc.Entries()})
+		req := httptest.NewRequest(http.MethodPost, SyncPath, strings.NewReader(string(body)))
+		key, _ := from.Key()
+		addr := address.AddrForKey(key)
+		req.RemoteAddr = net.JoinHostPort(net.IP(addr[:]).String(), "40000")
+		rec := httptest.NewRecorder()
+		syncer.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, post(stranger).Code)
+
+	phone.Name = "tablet"
+	phone.set(t, []devices.Device{laptop.Device}, nil)
+	rec := post(phone)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		var msg syncMessage
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msg))
+		_, err := phone.doc.Merge(msg.Entries)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, changes)
+	assert.Equal(t, laptop.doc.Entries(), phone.doc.Entries())
+	assert.Equal(t, "tablet", laptop.doc.View().Devices[0].Name)
+}
@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetFilterFlowsRequest struct{}
+type GetFilterFlowsResponse struct {
+	Flows []FlowEntry `json:"flows"`
+}
+
+type FlowEntry struct {
+	Protocol      string  `json:"protocol"`
+	LocalAddress  string  `json:"local_address"`
+	LocalPort     uint16  `json:"local_port"`
+	RemoteAddress string  `json:"remote_address"`
+	RemoteName    string  `json:"remote_name,omitempty"`
+	RemotePort    uint16  `json:"remote_port"`
+	Age           float64 `json:"age"`
+	ExpiresIn     float64 `json:"expires_in"`
+}
+
+type GetFilterStatsRequest struct{}
+type GetFilterStatsResponse struct {
+	Inbound  map[string]uint64 `json:"inbound"`
+	Outbound map[string]uint64 `json:"outbound"`
+	Remotes  []DropStatsEntry  `json:"remotes"`
+}
+
+type DropStatsEntry struct {
+	IPAddress string            `json:"address"`
+	Name      string            `json:"name,omitempty"`
+	Direction string            `json:"direction"`
+	Drops     map[string]uint64 `json:"drops"`
+	LastDrop  float64           `json:"last_drop"` // seconds ago
+}
+
+func dropCountsMap(counts [numDropReasons]uint64) map[string]uint64 {
+	m := make(map[string]uint64, numDropReasons)
+	for reason, count := range counts {
+		m[DropReason(reason).String()] = count
+	}
+	return m
+}
+
+func (f *Filter) getFilterStatsHandler(req *GetFilterStatsRequest, res *GetFilterStatsResponse) error {
+	stats := f.DropStats()
+	res.Inbound = dropCountsMap(stats.Inbound)
+	res.Outbound = dropCountsMap(stats.Outbound)
+	res.Remotes = make([]DropStatsEntry, 0, len(stats.Remotes))
+	sort.Slice(stats.Remotes, func(i, j int) bool {
+		return stats.Remotes[i].LastDrop.After(stats.Remotes[j].LastDrop)
+	})
+	for _, r := range stats.Remotes {
+		dir := "in"
+		if r.Outbound {
+			dir = "out"
+		}
+		res.Remotes = append(res.Remotes, DropStatsEntry{
+			IPAddress: net.IP(r.Remote[:]).String(),
+			Name:      f.nameFor(r.Remote),
+			Direction: dir,
+			Drops:     dropCountsMap(r.Counts),
+			LastDrop:  time.Since(r.LastDrop).Seconds(),
+		})
+	}
+	return nil
+}
+
+func (f *Filter) getFilterFlowsHandler(req *GetFilterFlowsRequest, res *GetFilterFlowsResponse) error {
+	if !f.ConnectionTrackingEnabled() {
+		return errors.New("connection tracking is not enabled")
+	}
+	flows := f.Flows()
+	res.Flows = make([]FlowEntry, 0, len(flows))
+	for _, fl := range flows {
+		res.Flows = append(res.Flows, FlowEntry{
+			Protocol:      fl.Protocol,
+			LocalAddress:  net.IP(fl.LocalAddress[:]).String(),
+			LocalPort:     fl.LocalPort,
+			RemoteAddress: net.IP(fl.RemoteAddress[:]).String(),
+			RemoteName:    f.nameFor(fl.RemoteAddress),
+			RemotePort:    fl.RemotePort,
+			Age:           fl.Age.Seconds(),
+			ExpiresIn:     fl.ExpiresIn.Seconds(),
+		})
+	}
+	sort.SliceStable(res.Flows, func(i, j int) bool {
+		return res.Flows[i].Age < res.Flows[j].Age
+	})
+	return nil
+}
+
+func (f *Filter) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getFilterFlows", "Show flows tracked by the tunnel filter", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetFilterFlowsRequest{}
+			res := &GetFilterFlowsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := f.getFilterFlowsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getFilterStats", "Show packets dropped by the tunnel filter by remote address and reason", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetFilterStatsRequest{}
+			res := &GetFilterStatsResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := f.getFilterStatsHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
@@ -0,0 +1,61 @@
+package filter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+var benchmarkKeyCounts = []int{1, 10, 100, 1000, 10000}
+
+func randomHexKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		k := make([]byte, ed25519.PublicKeySize)
+		_, _ = rand.Read(k)
+		keys[i] = hex.EncodeToString(k)
+	}
+	return keys
+}
+
+// BenchmarkFilter measures the per-packet cost of checking allowed and denied
+// packets, which should stay flat as the number of allowed keys grows.
+func BenchmarkFilter(b *testing.B) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	for _, count := range benchmarkKeyCounts {
+		keys := randomHexKeys(count)
+		f, err := NewFilter(keys, TrustSubnets(true))
+		if err != nil {
+			b.Fatal(err)
+		}
+		lastKey, _ := hex.DecodeString(keys[count-1])
+		allowed := withAddrs(buildPacket(protoTCP, 40000, 22), address.AddrForKey(lastKey), localAddr)
+		unknown, _, _ := ed25519.GenerateKey(nil)
+		denied := withAddrs(buildPacket(protoTCP, 40000, 22), address.AddrForKey(unknown), localAddr)
+		lastSubnet := address.SubnetForKey(lastKey)
+		var subnetAddr address.Address
+		copy(subnetAddr[:], lastSubnet[:])
+		allowedSubnet := withAddrs(buildPacket(protoTCP, 40000, 22), &subnetAddr, localAddr)
+
+		b.Run(fmt.Sprintf("allowed/keys=%d", count), func(b *testing.B) {
+			for b.Loop() {
+				f.IsInboundAllowed(allowed)
+			}
+		})
+		b.Run(fmt.Sprintf("denied/keys=%d", count), func(b *testing.B) {
+			for b.Loop() {
+				f.IsInboundAllowed(denied)
+			}
+		})
+		b.Run(fmt.Sprintf("subnet/keys=%d", count), func(b *testing.B) {
+			for b.Loop() {
+				f.IsInboundAllowed(allowedSubnet)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+const (
+	tcpFlowTimeout         = 30 * time.Minute
+	tcpClosingFlowTimeout  = 10 * time.Second
+	udpFlowTimeout         = 1 * time.Minute
+	icmpFlowTimeout        = 30 * time.Second
+	conntrackSweepInterval = 30 * time.Second
+)
+
+// flowKey identifies a flow from the local node's point of view.
+// For ICMPv6 echo flows both ports hold the echo identifier.
+type flowKey struct {
+	protocol   uint8
+	local      address.Address
+	remote     address.Address
+	localPort  uint16
+	remotePort uint16
+}
+
+type flow struct {
+	created time.Time
+	expires time.Time
+	timeout time.Duration
+}
+
+// extend pushes back the expiry of f. Timeouts only ever shrink over the life of a flow,
+// so a closing TCP connection isn't revived by its final ACKs.
+func (f *flow) extend(now time.Time, timeout time.Duration) {
+	if timeout < f.timeout {
+		f.timeout = timeout
+	}
+	f.expires = now.Add(f.timeout)
+}
+
+// connTracker records flows initiated by the local node so that their return traffic
+// can be let through. Expired flows are removed lazily on lookup and by periodic sweeps.
+type connTracker struct {
+	mutex     sync.Mutex
+	flows     map[flowKey]*flow
+	lastSweep time.Time
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		flows:     make(map[flowKey]*flow),
+		lastSweep: time.Now(),
+	}
+}
+
+// flowFor returns the flow key and timeout for a packet, local being the
+// source address for outbound packets and the destination for inbound ones.
+// Returns false for packets that can't be tracked.
+func flowFor(bs []byte, info packetInfo, outbound bool) (flowKey, time.Duration, bool) {
+	var key flowKey
+	var timeout time.Duration
+	key.protocol = info.protocol
+	if outbound {
+		copy(key.local[:], bs[8:24])
+		copy(key.remote[:], bs[24:40])
+		key.localPort, key.remotePort = info.srcPort, info.dstPort
+	} else {
+		copy(key.local[:], bs[24:40])
+		copy(key.remote[:], bs[8:24])
+		key.localPort, key.remotePort = info.dstPort, info.srcPort
+	}
+	switch info.protocol {
+	case protoTCP:
+		timeout = tcpFlowTimeout
+		if info.tcpFlags&(tcpFlagFIN|tcpFlagRST) != 0 {
+			timeout = tcpClosingFlowTimeout
+		}
+	case protoUDP:
+		timeout = udpFlowTimeout
+	case protoICMPv6:
+		// outbound flows are started by echo requests and answered by echo replies
+		if (outbound && info.icmpType != icmpEchoRequest) || (!outbound && info.icmpType != icmpEchoReply) {
+			return key, 0, false
+		}
+		key.localPort, key.remotePort = info.icmpID, info.icmpID
+		timeout = icmpFlowTimeout
+	default:
+		return key, 0, false
+	}
+	return key, timeout, true
+}
+
+// track creates or refreshes the flow for key.
+func (c *connTracker) track(key flowKey, timeout time.Duration) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.Sub(c.lastSweep) > conntrackSweepInterval {
+		c._sweep(now)
+	}
+	if f := c.flows[key]; f != nil && now.Before(f.expires) {
+		f.extend(now, timeout)
+		return
+	}
+	c.flows[key] = &flow{created: now, expires: now.Add(timeout), timeout: timeout}
+}
+
+// refresh extends an existing, unexpired flow for key, returning false if there is none.
+func (c *connTracker) refresh(key flowKey, timeout time.Duration) bool {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	f := c.flows[key]
+	if f == nil {
+		return false
+	}
+	if !now.Before(f.expires) {
+		delete(c.flows, key)
+		return false
+	}
+	f.extend(now, timeout)
+	return true
+}
+
+// has reports whether there is an unexpired flow for key, without refreshing it.
+func (c *connTracker) has(key flowKey) bool {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	f := c.flows[key]
+	return f != nil && now.Before(f.expires)
+}
+
+// drop removes the flows for which remove returns true.
+func (c *connTracker) drop(remove func(flowKey) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.flows {
+		if remove(key) {
+			delete(c.flows, key)
+		}
+	}
+}
+
+// flush removes all flows.
+func (c *connTracker) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.flows = make(map[flowKey]*flow)
+}
+
+func (c *connTracker) _sweep(now time.Time) {
+	for key, f := range c.flows {
+		if !now.Before(f.expires) {
+			delete(c.flows, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// FlowInfo describes a tracked flow.
+type FlowInfo struct {
+	Protocol      string
+	LocalAddress  address.Address
+	LocalPort     uint16
+	RemoteAddress address.Address
+	RemotePort    uint16
+	Age           time.Duration
+	ExpiresIn     time.Duration
+}
+
+func (c *connTracker) flowInfos() []FlowInfo {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c._sweep(now)
+	infos := make([]FlowInfo, 0, len(c.flows))
+	for key, f := range c.flows {
+		infos = append(infos, FlowInfo{
+			Protocol:      Rule{Protocol: key.protocol}.String(),
+			LocalAddress:  key.local,
+			LocalPort:     key.localPort,
+			RemoteAddress: key.remote,
+			RemotePort:    key.remotePort,
+			Age:           now.Sub(f.created),
+			ExpiresIn:     f.expires.Sub(now),
+		})
+	}
+	return infos
+}
@@ -1,39 +1,255 @@
 package filter
 
 import (
-	"crypto/ed25519"
-	"encoding/hex"
-	"fmt"
+	"sync/atomic"
+
+	"github.com/gologme/log"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 )
 
 type Filter struct {
-	allowedAddresses []*address.Address
+	policy    atomic.Pointer[policy]
+	conntrack *connTracker // only consulted while the policy enables ConnectionTracking
+	stats     *dropStats
+	logger    atomic.Pointer[log.Logger]
+	names     atomic.Pointer[NameResolver]
 }
 
-func NewFilter(allowedKeys []string) (*Filter, error) {
-	f := new(Filter)
+// NameResolver maps an address to a human readable name, such as a device name.
+type NameResolver func(address.Address) (string, bool)
 
-	f.allowedAddresses = make([]*address.Address, len(allowedKeys))
-	for i, hexKey := range allowedKeys {
-		keyBytes, err := hex.DecodeString(hexKey)
-		if err != nil {
-			panic(fmt.Errorf("invalid allowed public key hex: %w", err))
-		}
-		f.allowedAddresses[i] = address.AddrForKey(ed25519.PublicKey(keyBytes))
+// NewFilter builds a filter allowing traffic to/from allowedKeys.
+func NewFilter(allowedKeys []string, options ...SetupOption) (*Filter, error) {
+	p, err := newPolicy(allowedKeys, options...)
+	if err != nil {
+		return nil, err
 	}
 
+	f := new(Filter)
+	f.conntrack = newConnTracker()
+	f.stats = newDropStats()
+	f.policy.Store(p)
+
 	return f, nil
 }
 
-func (f *Filter) IsAllowed(ipAddr *address.Address) bool {
-	allowed := false
-	for _, a := range f.allowedAddresses {
-		if *ipAddr == *a {
-			allowed = true
-			break
+// Reload compiles a new policy and atomically replaces the current one.
+// Packets checked after Reload returns are subject to the new policy only.
+// Tracked flows with remotes that were allowed and no longer are, or that are now blocked, are
+// dropped, so their sessions are cut. Flows to other keys are kept, unless connection tracking
+// is disabled by the new policy.
+func (f *Filter) Reload(allowedKeys []string, options ...SetupOption) error {
+	p, err := newPolicy(allowedKeys, options...)
+	if err != nil {
+		return err
+	}
+	old := f.policy.Swap(p)
+	if !p.connectionTracking {
+		f.conntrack.flush()
+		return nil
+	}
+	f.conntrack.drop(func(key flowKey) bool {
+		return p.isBlocked(&key.remote) || (old.allowsRemote(&key.local, &key.remote) && !p.allowsRemote(&key.local, &key.remote))
+	})
+	return nil
+}
+
+// SetLogger sets the logger used for rate-limited debug logging of dropped flows.
+func (f *Filter) SetLogger(logger *log.Logger) {
+	f.logger.Store(logger)
+}
+
+// SetNameResolver sets the function used to name remotes in logs and admin responses.
+func (f *Filter) SetNameResolver(resolver NameResolver) {
+	f.names.Store(&resolver)
+}
+
+// nameFor returns the resolved name of a remote address, or "" if it has none.
+func (f *Filter) nameFor(ip address.Address) string {
+	if resolver := f.names.Load(); resolver != nil {
+		if name, ok := (*resolver)(ip); ok {
+			return name
 		}
 	}
+	return ""
+}
+
+func (f *Filter) IsAllowed(ipAddr *address.Address) bool {
+	return f.policy.Load().isAllowed(ipAddr)
+}
+
+// IsInboundAllowed reports whether a packet received from the network may be delivered locally.
+// The source may be an allowed key's address or, if subnets are trusted, inside its subnet.
+// Keys with rules may only reach the matching local protocol/destination port.
+// With connection tracking, return traffic for locally initiated flows is always allowed.
+func (f *Filter) IsInboundAllowed(bs []byte) bool {
+	var srcIP address.Address
+	copy(srcIP[:], bs[8:24])
+	if allowed, reason := f.isAllowedPacket(&srcIP, bs, false, true); !allowed {
+		f.RecordDrop(&srcIP, bs, reason, false)
+		return false
+	}
+	return true
+}
+
+// IsOutboundAllowed reports whether a locally originated packet may be sent to the network.
+// For keys with rules, only replies from the matching local protocol/source port are sent.
+// With connection tracking, any trackable packet is sent and starts or refreshes its flow.
+func (f *Filter) IsOutboundAllowed(bs []byte) bool {
+	var dstIP address.Address
+	copy(dstIP[:], bs[24:40])
+	if allowed, reason := f.isAllowedPacket(&dstIP, bs, true, true); !allowed {
+		f.RecordDrop(&dstIP, bs, reason, true)
+		return false
+	}
+	return true
+}
+
+// AllowsOutbound reports whether IsOutboundAllowed would send a locally originated packet,
+// without recording a drop or starting a flow, e.g. to re-check packets queued before a reload.
+func (f *Filter) AllowsOutbound(bs []byte) bool {
+	var dstIP address.Address
+	copy(dstIP[:], bs[24:40])
+	allowed, _ := f.isAllowedPacket(&dstIP, bs, true, false)
 	return allowed
 }
+
+// isAllowedPacket checks a packet against the policy. With track unset, flows aren't started or refreshed.
+func (f *Filter) isAllowedPacket(remoteIP *address.Address, bs []byte, outbound, track bool) (bool, DropReason) {
+	p := f.policy.Load()
+	if p.isBlocked(remoteIP) {
+		return false, DropBlocked
+	}
+	if app := p.appFor(bs, outbound); app != nil {
+		return f.isAllowedAppPacket(p, app, remoteIP, bs, outbound, track)
+	}
+	remote, allowed := p.resolve(remoteIP)
+	rules, hasRules := p.rules[remote]
+	hasRules = allowed && hasRules
+	if !hasRules && !p.connectionTracking && len(p.publicServices) == 0 {
+		return allowed, DropNotAllowed
+	}
+	info, ok := parsePacket(bs)
+	if !ok {
+		if !allowed {
+			return false, DropNotAllowed
+		}
+		return !hasRules, DropNoMatchingRule
+	}
+	if p.connectionTracking && f.isTrackedFlow(bs, info, outbound, track) {
+		return true, 0
+	}
+	port := info.dstPort
+	if outbound {
+		port = info.srcPort
+	}
+	if matchAny(p.publicServices, info.protocol, port, info.hasPorts) {
+		return true, 0
+	}
+	if !allowed {
+		return false, DropNotAllowed
+	}
+	return !hasRules || matchAny(rules, info.protocol, port, info.hasPorts), DropNoMatchingRule
+}
+
+// isAllowedAppPacket checks a packet to/from an app address against the keys and rules of the app only.
+func (f *Filter) isAllowedAppPacket(p *policy, app *appPolicy, remoteIP *address.Address, bs []byte, outbound, track bool) (bool, DropReason) {
+	allowed := app.isAllowed(remoteIP, p.trustSubnets)
+	info, ok := parsePacket(bs)
+	if !ok {
+		if !allowed {
+			return false, DropNotAllowed
+		}
+		return len(app.rules) == 0, DropNoMatchingRule
+	}
+	if p.connectionTracking && f.isTrackedFlow(bs, info, outbound, track) {
+		return true, 0
+	}
+	if !allowed {
+		return false, DropNotAllowed
+	}
+	port := info.dstPort
+	if outbound {
+		port = info.srcPort
+	}
+	return len(app.rules) == 0 || matchAny(app.rules, info.protocol, port, info.hasPorts), DropNoMatchingRule
+}
+
+// isTrackedFlow starts or refreshes the flow of an outbound packet and reports
+// whether an inbound packet belongs to a tracked flow. With track unset, it only reports.
+func (f *Filter) isTrackedFlow(bs []byte, info packetInfo, outbound, track bool) bool {
+	key, timeout, ok := flowFor(bs, info, outbound)
+	if !ok {
+		return false
+	}
+	if outbound {
+		if track {
+			f.conntrack.track(key, timeout)
+		}
+		return true
+	}
+	if !track {
+		return f.conntrack.has(key)
+	}
+	return f.conntrack.refresh(key, timeout)
+}
+
+// RecordDrop counts a packet dropped on the tunnel, attributing it to the remote address,
+// and logs the dropped flow at debug level subject to rate limiting.
+func (f *Filter) RecordDrop(remote *address.Address, bs []byte, reason DropReason, outbound bool) {
+	shouldLog, suppressed := f.stats.record(remote, reason, outbound)
+	logger := f.logger.Load()
+	if !shouldLog || logger == nil {
+		return
+	}
+	dir := "inbound"
+	if outbound {
+		dir = "outbound"
+	}
+	if suppressed > 0 {
+		logger.Debugf("Filter suppressed %d dropped flow log messages", suppressed)
+	}
+	if name := f.nameFor(*remote); name != "" {
+		logger.Debugf("Filter dropped %s packet (%s) for %s: %s", dir, reason, name, describeFlow(bs))
+		return
+	}
+	logger.Debugf("Filter dropped %s packet (%s): %s", dir, reason, describeFlow(bs))
+}
+
+// DropStats returns a snapshot of the drop counters.
+func (f *Filter) DropStats() DropStats {
+	return f.stats.snapshot()
+}
+
+func matchAny(rules []Rule, protocol uint8, port uint16, hasPorts bool) bool {
+	for _, r := range rules {
+		if r.matches(protocol, port, hasPorts) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionTrackingEnabled reports whether the current policy tracks connections.
+func (f *Filter) ConnectionTrackingEnabled() bool {
+	return f.policy.Load().connectionTracking
+}
+
+// RejectsLocal reports whether dropped local packets should be answered with an ICMPv6 error.
+func (f *Filter) RejectsLocal() bool {
+	return f.policy.Load().rejectLocal
+}
+
+// RejectsRemote reports whether dropped remote packets should be answered with an ICMPv6 error.
+func (f *Filter) RejectsRemote() bool {
+	return f.policy.Load().rejectRemote
+}
+
+// Flows returns the currently tracked flows, or nil if connection tracking is disabled.
+func (f *Filter) Flows() []FlowInfo {
+	if !f.ConnectionTrackingEnabled() {
+		return nil
+	}
+	return f.conntrack.flowInfos()
+}
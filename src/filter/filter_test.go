@@ -0,0 +1,361 @@
+package filter
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// buildPacket builds a minimal IPv6 packet with the given extension headers
+// (as raw next-header/payload pairs) followed by a TCP/UDP port pair.
+func buildPacket(proto uint8, srcPort, dstPort uint16, extHeaders ...uint8) []byte {
+	bs := make([]byte, ipv6HeaderLen)
+	bs[0] = 0x60
+	chain := append(extHeaders, proto)
+	bs[6] = chain[0]
+	for i := range extHeaders {
+		ext := make([]byte, 8)
+		ext[0] = chain[i+1]
+		bs = append(bs, ext...)
+	}
+	ports := make([]byte, 20)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	return append(bs, ports...)
+}
+
+func withAddrs(bs []byte, src, dst *address.Address) []byte {
+	copy(bs[8:24], src[:])
+	copy(bs[24:40], dst[:])
+	return bs
+}
+
+func TestParseRule(t *testing.T) {
+	valid := map[string]Rule{
+		"tcp/22":        {Protocol: protoTCP, PortStart: 22, PortEnd: 22},
+		"UDP/5353":      {Protocol: protoUDP, PortStart: 5353, PortEnd: 5353},
+		"tcp/8000-8080": {Protocol: protoTCP, PortStart: 8000, PortEnd: 8080},
+		"icmp":          {Protocol: protoICMPv6},
+		"any":           {},
+	}
+	for s, expected := range valid {
+		r, err := ParseRule(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, expected, r, s)
+		}
+	}
+	for _, s := range []string{"", "sctp/1", "tcp/0", "tcp/70000", "tcp/90-80", "icmp/1", "tcp/x"} {
+		_, err := ParseRule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParsePacketExtensionHeaders(t *testing.T) {
+	info, ok := parsePacket(buildPacket(protoTCP, 40000, 22, protoHopByHop, protoDestOpts))
+	if assert.True(t, ok) {
+		assert.Equal(t, packetInfo{protocol: protoTCP, srcPort: 40000, dstPort: 22, hasPorts: true}, info)
+	}
+
+	// non-initial fragments have no transport header
+	bs := buildPacket(protoUDP, 1, 2, protoFragment)
+	binary.BigEndian.PutUint16(bs[ipv6HeaderLen+2:], 8<<3)
+	_, ok = parsePacket(bs)
+	assert.False(t, ok)
+
+	_, ok = parsePacket(buildPacket(protoTCP, 1, 2)[:ipv6HeaderLen+8])
+	assert.False(t, ok)
+}
+
+func TestFilterRules(t *testing.T) {
+	restricted, _, _ := ed25519.GenerateKey(nil)
+	unrestricted, _, _ := ed25519.GenerateKey(nil)
+	unknown, _, _ := ed25519.GenerateKey(nil)
+	local, _, _ := ed25519.GenerateKey(nil)
+
+	f, err := NewFilter(
+		[]string{hex.EncodeToString(restricted), hex.EncodeToString(unrestricted)},
+		Rules{hex.EncodeToString(restricted): {"tcp/22"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restrictedAddr := address.AddrForKey(restricted)
+	unrestrictedAddr := address.AddrForKey(unrestricted)
+	unknownAddr := address.AddrForKey(unknown)
+	localAddr := address.AddrForKey(local)
+
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), restrictedAddr, localAddr)))
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 80), restrictedAddr, localAddr)))
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoUDP, 40000, 22), restrictedAddr, localAddr)))
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 22, 40000), localAddr, restrictedAddr)))
+	assert.False(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), localAddr, restrictedAddr)))
+
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoUDP, 1, 2), unrestrictedAddr, localAddr)))
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoUDP, 1, 2), localAddr, unrestrictedAddr)))
+
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), unknownAddr, localAddr)))
+
+	_, err = NewFilter(nil, Rules{hex.EncodeToString(unknown): {"tcp/22"}})
+	assert.Error(t, err, "rules for keys outside the allow list are rejected")
+}
+
+func TestFilterConnectionTracking(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	remote, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	remoteAddr := address.AddrForKey(remote)
+
+	f, err := NewFilter(nil, ConnectionTracking(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unsolicited inbound traffic is dropped
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 443, 40000), remoteAddr, localAddr)))
+
+	// replies to an outbound flow are allowed, other ports are not
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 443), localAddr, remoteAddr)))
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 443, 40000), remoteAddr, localAddr)))
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 443, 40001), remoteAddr, localAddr)))
+	assert.Len(t, f.Flows(), 1)
+
+	// ICMPv6 echo replies match their request identifier
+	echo := func(icmpType uint8, id uint16, src, dst *address.Address) []byte {
+		bs := withAddrs(buildPacket(protoICMPv6, 0, 0), src, dst)
+		bs[ipv6HeaderLen] = icmpType
+		binary.BigEndian.PutUint16(bs[ipv6HeaderLen+4:], id)
+		return bs
+	}
+	assert.True(t, f.IsOutboundAllowed(echo(icmpEchoRequest, 7, localAddr, remoteAddr)))
+	assert.True(t, f.IsInboundAllowed(echo(icmpEchoReply, 7, remoteAddr, localAddr)))
+	assert.False(t, f.IsInboundAllowed(echo(icmpEchoReply, 8, remoteAddr, localAddr)))
+	assert.False(t, f.IsInboundAllowed(echo(icmpEchoRequest, 7, remoteAddr, localAddr)))
+}
+
+func TestFilterSubnets(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	remote, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	remoteSubnet := address.SubnetForKey(remote)
+	var remoteSubnetAddr address.Address
+	copy(remoteSubnetAddr[:], remoteSubnet[:])
+	remoteSubnetAddr[15] = 1
+
+	allowed := []string{hex.EncodeToString(remote)}
+	untrusted, err := NewFilter(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, untrusted.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), &remoteSubnetAddr, localAddr)))
+	assert.False(t, untrusted.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 22, 40000), localAddr, &remoteSubnetAddr)))
+
+	trusted, err := NewFilter(allowed, TrustSubnets(true), Rules{hex.EncodeToString(remote): {"tcp/22"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, trusted.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), &remoteSubnetAddr, localAddr)))
+	assert.False(t, trusted.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 80), &remoteSubnetAddr, localAddr)), "rules apply to the subnet")
+	assert.True(t, trusted.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 22, 40000), localAddr, &remoteSubnetAddr)))
+}
+
+func TestFilterReload(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	remote, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	remoteAddr := address.AddrForKey(remote)
+	inbound := withAddrs(buildPacket(protoTCP, 40000, 22), remoteAddr, localAddr)
+
+	f, err := NewFilter([]string{hex.EncodeToString(remote)}, ConnectionTracking(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, f.IsInboundAllowed(inbound))
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoUDP, 40000, 53), localAddr, remoteAddr)))
+
+	// invalid policies leave the current one in place
+	assert.Error(t, f.Reload([]string{"zz"}))
+	assert.True(t, f.IsInboundAllowed(inbound))
+
+	if err := f.Reload(nil, ConnectionTracking(true)); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, f.IsInboundAllowed(inbound), "removed keys are cut off immediately")
+	assert.Empty(t, f.Flows(), "flows of removed keys are dropped")
+
+	if err := f.Reload(nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, f.Flows())
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoUDP, 53, 40000), remoteAddr, localAddr)))
+}
+
+// TestFilterReloadSessions checks that sessions of a removed key are cut on reload, even
+// established inbound ones whose replies started flows, while other flows are kept.
+func TestFilterReloadSessions(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	device, _, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	deviceAddr := address.AddrForKey(device)
+	otherAddr := address.AddrForKey(other)
+
+	f, err := NewFilter([]string{hex.EncodeToString(device)}, ConnectionTracking(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an inbound SSH session from the device, and an outbound connection to a key that isn't one
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), deviceAddr, localAddr)))
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 22, 40000), localAddr, deviceAddr)))
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 40001, 443), localAddr, otherAddr)))
+	assert.Len(t, f.Flows(), 2)
+
+	if err := f.Reload([]string{hex.EncodeToString(other)}, ConnectionTracking(true)); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), deviceAddr, localAddr)), "the session of the removed device is cut")
+	if flows := f.Flows(); assert.Len(t, flows, 1) {
+		assert.Equal(t, *otherAddr, flows[0].RemoteAddress, "flows to keys that are still allowed are kept")
+	}
+
+	// blocking the key drops its flows too
+	if err := f.Reload([]string{hex.EncodeToString(other)}, ConnectionTracking(true), BlockedKeys{hex.EncodeToString(other)}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, f.Flows())
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 443, 40001), otherAddr, localAddr)))
+}
+
+func TestFilterAllowsOutbound(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	remote, _, _ := ed25519.GenerateKey(nil)
+	unknown, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	remoteAddr := address.AddrForKey(remote)
+	unknownAddr := address.AddrForKey(unknown)
+
+	f, err := NewFilter([]string{hex.EncodeToString(remote)}, ConnectionTracking(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, f.AllowsOutbound(withAddrs(buildPacket(protoTCP, 40000, 443), localAddr, remoteAddr)))
+	assert.Empty(t, f.Flows(), "checking a packet doesn't start its flow")
+
+	f, err = NewFilter([]string{hex.EncodeToString(remote)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, f.AllowsOutbound(withAddrs(buildPacket(protoTCP, 40000, 443), localAddr, unknownAddr)))
+	assert.Empty(t, f.DropStats().Outbound, "checking a packet doesn't count it as dropped")
+}
+
+func TestFilterDropStats(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	restricted, _, _ := ed25519.GenerateKey(nil)
+	unknown, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	restrictedAddr := address.AddrForKey(restricted)
+	unknownAddr := address.AddrForKey(unknown)
+
+	f, err := NewFilter([]string{hex.EncodeToString(restricted)}, Rules{hex.EncodeToString(restricted): {"tcp/22"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), restrictedAddr, localAddr))
+	f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 80), restrictedAddr, localAddr))
+	f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), unknownAddr, localAddr))
+	f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), localAddr, unknownAddr))
+	f.RecordDrop(restrictedAddr, withAddrs(buildPacket(protoTCP, 40000, 22), unknownAddr, localAddr), DropBadSource, false)
+
+	stats := f.DropStats()
+	assert.Equal(t, uint64(1), stats.Inbound[DropNotAllowed])
+	assert.Equal(t, uint64(1), stats.Inbound[DropNoMatchingRule])
+	assert.Equal(t, uint64(1), stats.Inbound[DropBadSource])
+	assert.Equal(t, uint64(1), stats.Outbound[DropNotAllowed])
+	assert.Len(t, stats.Remotes, 3)
+	for _, r := range stats.Remotes {
+		if r.Remote == *restrictedAddr {
+			assert.Equal(t, uint64(1), r.Counts[DropNoMatchingRule])
+			assert.Equal(t, uint64(1), r.Counts[DropBadSource])
+		}
+	}
+}
+
+func TestFilterPublicServices(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	unknown, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	unknownAddr := address.AddrForKey(unknown)
+
+	f, err := NewFilter(nil, PublicServices{"tcp/9777"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 9777), unknownAddr, localAddr)))
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 9777, 40000), localAddr, unknownAddr)))
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), unknownAddr, localAddr)))
+
+	_, err = NewFilter(nil, PublicServices{"tcp/0"})
+	assert.Error(t, err)
+}
+
+func TestFilterBlockedKeys(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	remote, _, _ := ed25519.GenerateKey(nil)
+	localAddr := address.AddrForKey(local)
+	remoteAddr := address.AddrForKey(remote)
+	var remoteSubnetAddr address.Address
+	copy(remoteSubnetAddr[:], address.SubnetForKey(remote)[:])
+	remoteSubnetAddr[15] = 1
+
+	remoteHex := hex.EncodeToString(remote)
+	f, err := NewFilter([]string{remoteHex}, ConnectionTracking(true), PublicServices{"tcp/9777"}, BlockedKeys{remoteHex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), remoteAddr, localAddr)), "blocked even though allowed")
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 9777), remoteAddr, localAddr)), "blocked from public services")
+	assert.False(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 443), localAddr, remoteAddr)), "no flows to blocked keys")
+	assert.False(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 443), localAddr, &remoteSubnetAddr)), "subnets are blocked")
+	assert.Empty(t, f.Flows())
+	stats := f.DropStats()
+	assert.Equal(t, uint64(2), stats.Inbound[DropBlocked])
+	assert.Equal(t, uint64(2), stats.Outbound[DropBlocked])
+
+	_, err = NewFilter(nil, BlockedKeys{"nope"})
+	assert.Error(t, err)
+}
+
+func TestFilterAppAddresses(t *testing.T) {
+	local, _, _ := ed25519.GenerateKey(nil)
+	device, _, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	localAddr, deviceAddr, otherAddr := address.AddrForKey(local), address.AddrForKey(device), address.AddrForKey(other)
+	var appAddr address.Address
+	copy(appAddr[:], address.SubnetForKey(local)[:])
+	appAddr[15] = 1
+
+	deviceHex, otherHex := hex.EncodeToString(device), hex.EncodeToString(other)
+	f, err := NewFilter([]string{deviceHex, otherHex}, Rules{deviceHex: {"tcp/22"}}, AppAddresses{
+		{Address: appAddr, Keys: []string{otherHex}, Rules: []string{"tcp/443"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the node address keeps its rules
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), deviceAddr, localAddr)))
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 443), otherAddr, localAddr)))
+
+	// the app address only has its own
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), deviceAddr, &appAddr)))
+	assert.True(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 443), otherAddr, &appAddr)))
+	assert.False(t, f.IsInboundAllowed(withAddrs(buildPacket(protoTCP, 40000, 22), otherAddr, &appAddr)))
+	assert.True(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 443, 40000), &appAddr, otherAddr)))
+	assert.False(t, f.IsOutboundAllowed(withAddrs(buildPacket(protoTCP, 22, 40000), &appAddr, deviceAddr)))
+
+	_, err = NewFilter(nil, AppAddresses{{Address: appAddr, Keys: []string{"nope"}}})
+	assert.Error(t, err)
+}
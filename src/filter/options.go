@@ -0,0 +1,78 @@
+package filter
+
+import "github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+func (p *policy) _applyOption(opt SetupOption) error {
+	switch v := opt.(type) {
+	case Rules:
+		return p.applyRules(v)
+	case PublicServices:
+		return p.applyPublicServices(v)
+	case TrustSubnets:
+		p.trustSubnets = bool(v)
+	case ConnectionTracking:
+		p.connectionTracking = bool(v)
+	case RejectLocal:
+		p.rejectLocal = bool(v)
+	case RejectRemote:
+		p.rejectRemote = bool(v)
+	case BlockedKeys:
+		return p.applyBlockedKeys(v)
+	case AppAddresses:
+		return p.applyAppAddresses(v)
+	}
+	return nil
+}
+
+type SetupOption interface {
+	isSetupOption()
+}
+
+// Rules restricts individual keys (by hex public key) to the listed services,
+// see ParseRule for the rule format.
+type Rules map[string][]string
+
+// PublicServices lists local services that any key may reach, whether or not it is allowed,
+// see ParseRule for the rule format.
+type PublicServices []string
+
+// TrustSubnets treats traffic from/to an allowed key's routed subnet like
+// traffic from/to its address, including any rules for the key.
+type TrustSubnets bool
+
+// ConnectionTracking allows return traffic for locally initiated flows,
+// even when the remote key is not allowed.
+type ConnectionTracking bool
+
+// RejectLocal answers locally originated packets that are dropped by the filter with an
+// ICMPv6 "administratively prohibited" error, so local applications fail immediately.
+type RejectLocal bool
+
+// RejectRemote answers packets from remote nodes that are dropped by the filter with an
+// ICMPv6 "administratively prohibited" error.
+type RejectRemote bool
+
+// BlockedKeys lists keys (by hex public key) whose traffic is always dropped, including their
+// subnets, replies to tracked flows and public services.
+type BlockedKeys []string
+
+// AppAddress restricts traffic to/from a local address other than the node address,
+// such as an app address in the node's subnet, to the listed keys and services.
+type AppAddress struct {
+	Address address.Address
+	Keys    []string // hex public keys that may reach the address
+	Rules   []string // services on the address they may reach, all services if empty
+}
+
+// AppAddresses lists local addresses with their own keys and rules. Only these apply to traffic
+// to/from them, not the allowed keys and rules of the node. Connection tracking still applies.
+type AppAddresses []AppAddress
+
+func (a Rules) isSetupOption()              {}
+func (a PublicServices) isSetupOption()     {}
+func (a TrustSubnets) isSetupOption()       {}
+func (a ConnectionTracking) isSetupOption() {}
+func (a RejectLocal) isSetupOption()        {}
+func (a RejectRemote) isSetupOption()       {}
+func (a BlockedKeys) isSetupOption()        {}
+func (a AppAddresses) isSetupOption()       {}
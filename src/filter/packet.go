@@ -0,0 +1,121 @@
+package filter
+
+import "encoding/binary"
+
+// IPv6 next header values relevant to the filter
+const (
+	protoHopByHop = 0
+	protoTCP      = 6
+	protoUDP      = 17
+	protoRouting  = 43
+	protoFragment = 44
+	protoESP      = 50
+	protoAH       = 51
+	protoICMPv6   = 58
+	protoNoNext   = 59
+	protoDestOpts = 60
+)
+
+const ipv6HeaderLen = 40
+
+// ICMPv6 echo message types
+const (
+	icmpEchoRequest = 128
+	icmpEchoReply   = 129
+)
+
+// TCP flags relevant to connection tracking
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+)
+
+// packetInfo holds the transport layer details of an IPv6 packet needed to match rules.
+type packetInfo struct {
+	protocol uint8
+	srcPort  uint16
+	dstPort  uint16
+	hasPorts bool
+	tcpFlags uint8
+	icmpType uint8
+	icmpID   uint16
+}
+
+// parsePacket walks the IPv6 extension header chain of bs and extracts the
+// upper-layer protocol and, for TCP/UDP, the ports. For ICMPv6 the message type
+// and, for echo messages, the identifier are extracted.
+// Returns false if the packet is truncated or the transport header can't be reached,
+// for example for non-initial fragments.
+func parsePacket(bs []byte) (packetInfo, bool) {
+	var info packetInfo
+	if len(bs) < ipv6HeaderLen || bs[0]&0xf0 != 0x60 {
+		return info, false
+	}
+	next := bs[6]
+	offset := ipv6HeaderLen
+	for {
+		switch next {
+		case protoHopByHop, protoRouting, protoDestOpts:
+			if len(bs) < offset+8 {
+				return info, false
+			}
+			next = bs[offset]
+			offset += (int(bs[offset+1]) + 1) * 8
+		case protoFragment:
+			if len(bs) < offset+8 {
+				return info, false
+			}
+			// only the first fragment carries the transport header
+			if binary.BigEndian.Uint16(bs[offset+2:offset+4])&0xfff8 != 0 {
+				return info, false
+			}
+			next = bs[offset]
+			offset += 8
+		case protoAH:
+			if len(bs) < offset+8 {
+				return info, false
+			}
+			next = bs[offset]
+			offset += (int(bs[offset+1]) + 2) * 4
+		case protoTCP:
+			if len(bs) < offset+14 {
+				return info, false
+			}
+			info.protocol = next
+			info.srcPort = binary.BigEndian.Uint16(bs[offset : offset+2])
+			info.dstPort = binary.BigEndian.Uint16(bs[offset+2 : offset+4])
+			info.hasPorts = true
+			info.tcpFlags = bs[offset+13]
+			return info, true
+		case protoUDP:
+			if len(bs) < offset+4 {
+				return info, false
+			}
+			info.protocol = next
+			info.srcPort = binary.BigEndian.Uint16(bs[offset : offset+2])
+			info.dstPort = binary.BigEndian.Uint16(bs[offset+2 : offset+4])
+			info.hasPorts = true
+			return info, true
+		case protoICMPv6:
+			if len(bs) < offset+8 {
+				return info, false
+			}
+			info.protocol = next
+			info.icmpType = bs[offset]
+			if info.icmpType == icmpEchoRequest || info.icmpType == icmpEchoReply {
+				info.icmpID = binary.BigEndian.Uint16(bs[offset+4 : offset+6])
+			}
+			return info, true
+		case protoESP, protoNoNext:
+			// payload is opaque or absent
+			info.protocol = next
+			return info, true
+		default:
+			if len(bs) < offset {
+				return info, false
+			}
+			info.protocol = next
+			return info, true
+		}
+	}
+}
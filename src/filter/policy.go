@@ -0,0 +1,209 @@
+package filter
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// policy is the compiled, immutable form of the filter configuration.
+// It is swapped as a whole on reload so that packets never see a partial update.
+// Lookups are hash based so per-packet cost doesn't grow with the number of allowed keys.
+type policy struct {
+	allowedAddresses   map[address.Address]struct{}
+	allowedSubnets     map[address.Subnet]address.Address // subnet to the address of the same key
+	rules              map[address.Address][]Rule
+	blockedAddresses   map[address.Address]struct{}
+	blockedSubnets     map[address.Subnet]struct{}
+	publicServices     []Rule // local services any key may reach
+	trustSubnets       bool
+	connectionTracking bool
+	rejectLocal        bool
+	rejectRemote       bool
+	apps               map[address.Address]*appPolicy // by local address
+}
+
+func newPolicy(allowedKeys []string, options ...SetupOption) (*policy, error) {
+	p := new(policy)
+
+	p.allowedAddresses = make(map[address.Address]struct{}, len(allowedKeys))
+	p.allowedSubnets = make(map[address.Subnet]address.Address, len(allowedKeys))
+	for _, hexKey := range allowedKeys {
+		keyBytes, err := hex.DecodeString(hexKey)
+		if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid allowed public key hex %q", hexKey)
+		}
+		addr := address.AddrForKey(ed25519.PublicKey(keyBytes))
+		p.allowedAddresses[*addr] = struct{}{}
+		p.allowedSubnets[*address.SubnetForKey(ed25519.PublicKey(keyBytes))] = *addr
+	}
+
+	p.rules = make(map[address.Address][]Rule)
+	for _, opt := range options {
+		if err := p._applyOption(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// applyRules restricts keys with rules to the matching local services,
+// keys without rules keep full access.
+func (p *policy) applyRules(rules Rules) error {
+	for hexKey, ruleStrs := range rules {
+		keyBytes, err := hex.DecodeString(hexKey)
+		if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid rule public key hex %q", hexKey)
+		}
+		addr := address.AddrForKey(ed25519.PublicKey(keyBytes))
+		if !p.isAllowed(addr) {
+			return fmt.Errorf("rules given for public key %s which is not allowed", hexKey)
+		}
+		for _, s := range ruleStrs {
+			r, err := ParseRule(s)
+			if err != nil {
+				return err
+			}
+			p.rules[*addr] = append(p.rules[*addr], r)
+		}
+	}
+	return nil
+}
+
+func (p *policy) applyPublicServices(services PublicServices) error {
+	for _, s := range services {
+		r, err := ParseRule(s)
+		if err != nil {
+			return err
+		}
+		p.publicServices = append(p.publicServices, r)
+	}
+	return nil
+}
+
+func (p *policy) applyBlockedKeys(keys BlockedKeys) error {
+	if p.blockedAddresses == nil {
+		p.blockedAddresses = make(map[address.Address]struct{}, len(keys))
+		p.blockedSubnets = make(map[address.Subnet]struct{}, len(keys))
+	}
+	for _, hexKey := range keys {
+		keyBytes, err := hex.DecodeString(hexKey)
+		if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid blocked public key hex %q", hexKey)
+		}
+		p.blockedAddresses[*address.AddrForKey(ed25519.PublicKey(keyBytes))] = struct{}{}
+		p.blockedSubnets[*address.SubnetForKey(ed25519.PublicKey(keyBytes))] = struct{}{}
+	}
+	return nil
+}
+
+// isBlocked reports whether a remote IP belongs to the address or subnet of a blocked key.
+func (p *policy) isBlocked(ip *address.Address) bool {
+	if len(p.blockedAddresses) == 0 {
+		return false
+	}
+	if _, blocked := p.blockedAddresses[*ip]; blocked {
+		return true
+	}
+	var snet address.Subnet
+	copy(snet[:], ip[:])
+	_, blocked := p.blockedSubnets[snet]
+	return blocked
+}
+
+// appPolicy is the compiled form of an AppAddress.
+type appPolicy struct {
+	allowedAddresses map[address.Address]struct{}
+	allowedSubnets   map[address.Subnet]struct{}
+	rules            []Rule
+}
+
+func (p *policy) applyAppAddresses(apps AppAddresses) error {
+	if p.apps == nil {
+		p.apps = make(map[address.Address]*appPolicy, len(apps))
+	}
+	for _, a := range apps {
+		app := &appPolicy{
+			allowedAddresses: make(map[address.Address]struct{}, len(a.Keys)),
+			allowedSubnets:   make(map[address.Subnet]struct{}, len(a.Keys)),
+		}
+		for _, hexKey := range a.Keys {
+			keyBytes, err := hex.DecodeString(hexKey)
+			if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+				return fmt.Errorf("invalid app public key hex %q", hexKey)
+			}
+			app.allowedAddresses[*address.AddrForKey(ed25519.PublicKey(keyBytes))] = struct{}{}
+			app.allowedSubnets[*address.SubnetForKey(ed25519.PublicKey(keyBytes))] = struct{}{}
+		}
+		for _, s := range a.Rules {
+			r, err := ParseRule(s)
+			if err != nil {
+				return err
+			}
+			app.rules = append(app.rules, r)
+		}
+		p.apps[a.Address] = app
+	}
+	return nil
+}
+
+// appFor returns the policy of the local address of a packet, or nil if it has none.
+func (p *policy) appFor(bs []byte, outbound bool) *appPolicy {
+	if len(p.apps) == 0 {
+		return nil
+	}
+	var local address.Address
+	if outbound {
+		copy(local[:], bs[8:24])
+	} else {
+		copy(local[:], bs[24:40])
+	}
+	return p.apps[local]
+}
+
+// isAllowed reports whether a remote IP may reach the app, subnet addresses only if subnets are trusted.
+func (a *appPolicy) isAllowed(ip *address.Address, trustSubnets bool) bool {
+	if _, allowed := a.allowedAddresses[*ip]; allowed || !trustSubnets {
+		return allowed
+	}
+	var snet address.Subnet
+	copy(snet[:], ip[:])
+	_, allowed := a.allowedSubnets[snet]
+	return allowed && snet.IsValid()
+}
+
+// allowsRemote reports whether the remote IP of a flow with the given local address is allowed,
+// by the app of the local address if it has one.
+func (p *policy) allowsRemote(local, remote *address.Address) bool {
+	if app := p.apps[*local]; app != nil {
+		return app.isAllowed(remote, p.trustSubnets)
+	}
+	_, allowed := p.resolve(remote)
+	return allowed
+}
+
+func (p *policy) isAllowed(ipAddr *address.Address) bool {
+	_, allowed := p.allowedAddresses[*ipAddr]
+	return allowed
+}
+
+// resolve maps a remote IP to the address of the allowed key it belongs to.
+// Addresses inside an allowed key's subnet only resolve if subnets are trusted.
+func (p *policy) resolve(ip *address.Address) (address.Address, bool) {
+	if ip.IsValid() {
+		return *ip, p.isAllowed(ip)
+	}
+	if !p.trustSubnets {
+		return address.Address{}, false
+	}
+	var snet address.Subnet
+	copy(snet[:], ip[:])
+	if !snet.IsValid() {
+		return address.Address{}, false
+	}
+	addr, allowed := p.allowedSubnets[snet]
+	return addr, allowed
+}
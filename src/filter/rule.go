@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rule describes a local service that a remote key is permitted to reach.
+// A zero Protocol matches any protocol, and a zero port range matches any port.
+type Rule struct {
+	Protocol  uint8
+	PortStart uint16
+	PortEnd   uint16
+}
+
+var protocolNames = map[string]uint8{
+	"any":    0,
+	"tcp":    protoTCP,
+	"udp":    protoUDP,
+	"icmp":   protoICMPv6,
+	"icmpv6": protoICMPv6,
+}
+
+// ParseRule parses a rule of the form "<proto>[/<port>[-<port>]]", e.g. "tcp/22",
+// "udp/5353", "tcp/8000-8080" or "icmp".
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	protoStr, portStr, hasPorts := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "/")
+	proto, ok := protocolNames[protoStr]
+	if !ok {
+		return r, fmt.Errorf("invalid rule %q: unknown protocol %q", s, protoStr)
+	}
+	r.Protocol = proto
+	if !hasPorts {
+		return r, nil
+	}
+	if proto != protoTCP && proto != protoUDP {
+		return r, fmt.Errorf("invalid rule %q: ports are only supported for tcp and udp", s)
+	}
+	startStr, endStr, isRange := strings.Cut(portStr, "-")
+	start, err := strconv.ParseUint(startStr, 10, 16)
+	if err != nil || start == 0 {
+		return r, fmt.Errorf("invalid rule %q: bad port %q", s, startStr)
+	}
+	end := start
+	if isRange {
+		if end, err = strconv.ParseUint(endStr, 10, 16); err != nil || end < start {
+			return r, fmt.Errorf("invalid rule %q: bad port range %q", s, portStr)
+		}
+	}
+	r.PortStart, r.PortEnd = uint16(start), uint16(end)
+	return r, nil
+}
+
+func (r Rule) matches(protocol uint8, port uint16, hasPorts bool) bool {
+	if r.Protocol != 0 && r.Protocol != protocol {
+		return false
+	}
+	if r.PortStart == 0 {
+		return true
+	}
+	return hasPorts && port >= r.PortStart && port <= r.PortEnd
+}
+
+// Covers reports whether every packet to service is also permitted by r.
+func (r Rule) Covers(service Rule) bool {
+	if r.Protocol != 0 && r.Protocol != service.Protocol {
+		return false
+	}
+	if r.PortStart == 0 {
+		return true
+	}
+	return service.PortStart != 0 && service.PortStart >= r.PortStart && service.PortEnd <= r.PortEnd
+}
+
+func (r Rule) String() string {
+	proto := "any"
+	for name, p := range protocolNames {
+		if p == r.Protocol && name != "icmpv6" {
+			proto = name
+		}
+	}
+	switch {
+	case r.PortStart == 0:
+		return proto
+	case r.PortStart == r.PortEnd:
+		return fmt.Sprintf("%s/%d", proto, r.PortStart)
+	default:
+		return fmt.Sprintf("%s/%d-%d", proto, r.PortStart, r.PortEnd)
+	}
+}
@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// DropReason describes why a packet was dropped on the tunnel.
+type DropReason int
+
+const (
+	DropNotAllowed     DropReason = iota // the remote key isn't allowed and there's no tracked flow
+	DropNoMatchingRule                   // the remote key is allowed, but none of its rules match
+	DropBadSource                        // the source address doesn't belong to the sender
+	DropBlocked                          // the remote key is blocked
+	numDropReasons
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropNotAllowed:
+		return "not_allowed"
+	case DropNoMatchingRule:
+		return "no_matching_rule"
+	case DropBadSource:
+		return "bad_source"
+	case DropBlocked:
+		return "blocked"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// maxDropStatsEntries bounds the per-remote counters, as drops can come from any node.
+	// Drops for further remotes are only counted in the totals.
+	maxDropStatsEntries = 4096
+	// dropLogsPerSecond limits how many dropped flows are logged.
+	dropLogsPerSecond = 10
+)
+
+type dropStatsKey struct {
+	remote   address.Address
+	outbound bool
+}
+
+// DropCounters holds the drop counts for one remote and direction.
+type DropCounters struct {
+	Counts   [numDropReasons]uint64
+	LastDrop time.Time
+}
+
+// DropStats is a snapshot of the filter drop counters.
+type DropStats struct {
+	Inbound  [numDropReasons]uint64
+	Outbound [numDropReasons]uint64
+	Remotes  []RemoteDropStats
+}
+
+// RemoteDropStats holds the drop counters for one remote address and direction.
+type RemoteDropStats struct {
+	Remote   address.Address
+	Outbound bool
+	DropCounters
+}
+
+type dropStats struct {
+	mutex      sync.Mutex
+	totals     [2][numDropReasons]uint64 // indexed by outbound
+	remotes    map[dropStatsKey]*DropCounters
+	logWindow  time.Time
+	logCount   int
+	suppressed int
+}
+
+func newDropStats() *dropStats {
+	return &dropStats{
+		remotes: make(map[dropStatsKey]*DropCounters),
+	}
+}
+
+// record counts a drop and reports whether it should be logged,
+// along with how many log lines were suppressed since the last one.
+func (s *dropStats) record(remote *address.Address, reason DropReason, outbound bool) (bool, int) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dir := 0
+	if outbound {
+		dir = 1
+	}
+	s.totals[dir][reason]++
+	key := dropStatsKey{remote: *remote, outbound: outbound}
+	counters := s.remotes[key]
+	if counters == nil && len(s.remotes) < maxDropStatsEntries {
+		counters = new(DropCounters)
+		s.remotes[key] = counters
+	}
+	if counters != nil {
+		counters.Counts[reason]++
+		counters.LastDrop = now
+	}
+	if now.Sub(s.logWindow) >= time.Second {
+		s.logWindow, s.logCount = now, 0
+	}
+	if s.logCount >= dropLogsPerSecond {
+		s.suppressed++
+		return false, 0
+	}
+	s.logCount++
+	suppressed := s.suppressed
+	s.suppressed = 0
+	return true, suppressed
+}
+
+func (s *dropStats) snapshot() DropStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := DropStats{
+		Inbound:  s.totals[0],
+		Outbound: s.totals[1],
+		Remotes:  make([]RemoteDropStats, 0, len(s.remotes)),
+	}
+	for key, counters := range s.remotes {
+		stats.Remotes = append(stats.Remotes, RemoteDropStats{
+			Remote:       key.remote,
+			Outbound:     key.outbound,
+			DropCounters: *counters,
+		})
+	}
+	return stats
+}
+
+// describeFlow formats the addresses, protocol and ports of a packet for logging.
+func describeFlow(bs []byte) string {
+	src, dst := net.IP(bs[8:24]), net.IP(bs[24:40])
+	info, ok := parsePacket(bs)
+	switch {
+	case !ok:
+		return fmt.Sprintf("%s -> %s", src, dst)
+	case info.hasPorts:
+		return fmt.Sprintf("%s [%s]:%d -> [%s]:%d", Rule{Protocol: info.protocol}, src, info.srcPort, dst, info.dstPort)
+	case info.protocol == protoICMPv6:
+		return fmt.Sprintf("icmp type %d %s -> %s", info.icmpType, src, dst)
+	default:
+		return fmt.Sprintf("protocol %d %s -> %s", info.protocol, src, dst)
+	}
+}
@@ -0,0 +1,229 @@
+// Package handshake adds devices to a node's network, following
+// architecture/device-addition-handshake.md.
+//
+// The inviting node shares its public key and a temporary secret as a Token out of band,
+// and serves join requests on its management service until one device has joined or
+// the token expires. Join requests are authenticated by the secret, and by the source
+// address of the request, which must belong to the public key being added.
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// JoinPath is where the inviting node serves join requests on the management service.
+const JoinPath = "/join"
+
+const (
+	joinRetryInterval = 2 * time.Second
+	maxRequestSize    = 4096
+)
+
+// ErrExpired is returned once an invite token can no longer be used.
+var ErrExpired = errors.New("invite token expired")
+
+type JoinRequest struct {
+	PublicKey string `json:"key"`
+	Secret    string `json:"secret"`
+	Name      string `json:"name"`
+}
+
+type JoinResponse struct {
+	Config json.RawMessage `json:"config"`
+}
+
+// AcceptFunc adds a joining device and returns the config document for it.
+type AcceptFunc func(name string, publicKey ed25519.PublicKey) (json.RawMessage, error)
+
+// Inviter serves join requests for a single token. The first accepted device closes it.
+type Inviter struct {
+	token  *Token
+	accept AcceptFunc
+	mutex  sync.Mutex
+	joined chan struct{}
+	closed bool
+}
+
+func NewInviter(token *Token, accept AcceptFunc) *Inviter {
+	return &Inviter{
+		token:  token,
+		accept: accept,
+		joined: make(chan struct{}),
+	}
+}
+
+func (i *Inviter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != JoinPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req JoinRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	keyBytes, err := hex.DecodeString(req.PublicKey)
+	if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+	key := ed25519.PublicKey(keyBytes)
+	if req.Name == "" {
+		http.Error(w, "missing device name", http.StatusBadRequest)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	addr := address.AddrForKey(key)
+	if err != nil || !net.ParseIP(host).Equal(net.IP(addr[:])) {
+		http.Error(w, "source address doesn't belong to the public key", http.StatusForbidden)
+		return
+	}
+	secret, err := hex.DecodeString(req.Secret)
+	if err != nil || subtle.ConstantTimeCompare(secret, i.token.Secret[:]) != 1 {
+		http.Error(w, "invalid secret", http.StatusForbidden)
+		return
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.closed || i.token.Expired() {
+		http.Error(w, "invite is no longer valid", http.StatusGone)
+		return
+	}
+	config, err := i.accept(req.Name, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	i.closed = true
+	close(i.joined)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(JoinResponse{Config: config})
+}
+
+// Joined is closed once a device has joined.
+func (i *Inviter) Joined() <-chan struct{} {
+	return i.joined
+}
+
+func (i *Inviter) close() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.closed = true
+}
+
+// Wait waits until a device has joined, the token expires or ctx is done, and then stops
+// accepting join requests. The inviter must be mounted on JoinPath of the management service
+// on the token port meanwhile. It returns nil once a device has joined.
+func (i *Inviter) Wait(ctx context.Context) error {
+	if i.token.Expired() {
+		return ErrExpired
+	}
+	timer := time.NewTimer(time.Until(i.token.Expires))
+	defer timer.Stop()
+	var err error
+	select {
+	case <-i.joined:
+	case <-timer.C:
+		err = ErrExpired
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	i.close()
+	return err
+}
+
+// rejectedError is returned when the inviting node refuses a join request, retrying won't help.
+type rejectedError struct {
+	status  int
+	message string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("join rejected (%d): %s", e.status, e.message)
+}
+
+// Join asks the inviting node of token to add this node, with the given public key and name,
+// and returns the config document it sends back. Requests are retried until the token expires
+// or ctx is done, as the inviting node may not be reachable right away.
+func Join(ctx context.Context, token *Token, publicKey ed25519.PublicKey, name string) (json.RawMessage, error) {
+	if token.Expired() {
+		return nil, ErrExpired
+	}
+	ctx, cancel := context.WithDeadline(ctx, token.Expires)
+	defer cancel()
+
+	// connect from our own address, the inviting node checks it belongs to publicKey
+	localAddr := address.AddrForKey(publicKey)
+	client := management.Client(net.IP(localAddr[:]))
+	body, err := json.Marshal(JoinRequest{
+		PublicKey: hex.EncodeToString(publicKey),
+		Secret:    hex.EncodeToString(token.Secret[:]),
+		Name:      name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := "http://" + token.ManagementAddress() + JoinPath
+	for {
+		config, err := tryJoin(ctx, client, url, body)
+		if err == nil {
+			return config, nil
+		}
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			if token.Expired() {
+				return nil, fmt.Errorf("%w: %v", ErrExpired, err)
+			}
+			return nil, err
+		case <-time.After(joinRetryInterval):
+		}
+	}
+}
+
+func tryJoin(ctx context.Context, client *http.Client, url string, body []byte) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, maxRequestSize))
+		return nil, &rejectedError{status: res.StatusCode, message: strings.TrimSpace(string(msg))}
+	}
+	var joinRes JoinResponse
+	if err := json.NewDecoder(res.Body).Decode(&joinRes); err != nil {
+		return nil, err
+	}
+	return joinRes.Config, nil
+}
@@ -0,0 +1,95 @@
+package handshake
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+func TestToken(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	peers := []string{"tls://192.0.2.1:443", "quic://[2001:db8::1]:9001", "tcp://a:1", "tcp://b:2", "tcp://c:3"}
+	token, err := NewToken(pub, management.DefaultPort, peers, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, peers[:MaxTokenPeers], token.Peers)
+	blob := strings.TrimPrefix(token.String(), TokenPrefix)
+	for _, s := range []string{token.String(), blob, strings.ToLower(token.String()), " " + blob + "\n"} {
+		parsed, err := ParseToken(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, token, parsed)
+			assert.False(t, parsed.Expired())
+		}
+	}
+
+	// a single mistyped character is caught by the checksum
+	typo := []byte(blob)
+	typo[len(typo)/2] = map[bool]byte{true: 'B', false: 'A'}[typo[len(typo)/2] == 'A']
+	_, err = ParseToken(string(typo))
+	assert.ErrorContains(t, err, "checksum")
+
+	for _, s := range []string{"", "ygg-invite:", "ygg-invite:AAAA", "ygg-invite:" + blob[:len(blob)-4], "ygg-invite:" + blob + "1"} {
+		_, err := ParseToken(s)
+		assert.Error(t, err, s)
+	}
+
+	_, err = NewToken(pub, management.DefaultPort, []string{"tcp://" + strings.Repeat("a", 255)}, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestInviter(t *testing.T) {
+	inviterKey, _, _ := ed25519.GenerateKey(nil)
+	joinerKey, _, _ := ed25519.GenerateKey(nil)
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	token, err := NewToken(inviterKey, management.DefaultPort, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var joined []string
+	inviter := NewInviter(token, func(name string, key ed25519.PublicKey) (json.RawMessage, error) {
+		joined = append(joined, name)
+		return json.RawMessage(`{"Manager":{}}`), nil
+	})
+
+	join := func(from, key ed25519.PublicKey, secret string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(JoinRequest{PublicKey: hex.EncodeToString(key), Secret: secret, Name: "laptop"})
+		req := httptest.NewRequest(http.MethodPost, JoinPath, strings.NewReader(string(body)))
+		addr := address.AddrForKey(from)
+		req.RemoteAddr = net.JoinHostPort(net.IP(addr[:]).String(), "40000")
+		rec := httptest.NewRecorder()
+		inviter.ServeHTTP(rec, req)
+		return rec
+	}
+	secret := hex.EncodeToString(token.Secret[:])
+
+	assert.Equal(t, http.StatusForbidden, join(joinerKey, joinerKey, hex.EncodeToString(make([]byte, secretSize))).Code, "wrong secret")
+	assert.Equal(t, http.StatusForbidden, join(otherKey, joinerKey, secret).Code, "source address of another key")
+	assert.Empty(t, joined)
+
+	rec := join(joinerKey, joinerKey, secret)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		var res JoinResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		assert.JSONEq(t, `{"Manager":{}}`, string(res.Config))
+	}
+	assert.Equal(t, []string{"laptop"}, joined)
+	select {
+	case <-inviter.Joined():
+	default:
+		t.Error("inviter should be closed after a device joined")
+	}
+
+	assert.Equal(t, http.StatusGone, join(otherKey, otherKey, secret).Code, "tokens are single use")
+}
@@ -0,0 +1,136 @@
+package handshake
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+const (
+	// TokenPrefix starts every encoded invite token, it is matched case-insensitively.
+	TokenPrefix = "ygg-invite:"
+	// MaxTokenPeers bounds the peer URIs carried by a token, to keep its QR code scannable.
+	MaxTokenPeers = 4
+
+	secretSize    = 16
+	checksumSize  = 4
+	maxPeerURILen = 255
+	tokenVersion  = 1
+)
+
+// tokenEncoding is upper case only, so that tokens fit the compact alphanumeric mode of QR codes.
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Token is shared out of band with a device to let it join the inviting node.
+//
+// It is encoded as TokenPrefix followed by unpadded base32 of: a version byte, the public key,
+// the secret, the port (uint16), the expiry (uint64 unix seconds), the number of peers
+// (uint8) and each peer URI prefixed by its length (uint8), followed by a CRC32 of all of it.
+type Token struct {
+	PublicKey ed25519.PublicKey // key of the inviting node
+	Secret    [secretSize]byte
+	Port      uint16   // management port on the inviting node's address
+	Peers     []string // peer URIs through which the inviting node can be reached
+	Expires   time.Time
+}
+
+// NewToken creates a token with a random secret, valid for lifetime.
+// Only the first MaxTokenPeers peers are included.
+func NewToken(publicKey ed25519.PublicKey, port uint16, peers []string, lifetime time.Duration) (*Token, error) {
+	if len(peers) > MaxTokenPeers {
+		peers = peers[:MaxTokenPeers]
+	}
+	for _, p := range peers {
+		if len(p) > maxPeerURILen {
+			return nil, fmt.Errorf("peer URI %q is too long for an invite token", p)
+		}
+	}
+	t := &Token{
+		PublicKey: publicKey,
+		Port:      port,
+		Peers:     peers,
+		Expires:   time.Now().Add(lifetime).Truncate(time.Second),
+	}
+	if _, err := rand.Read(t.Secret[:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ParseToken decodes a token produced by Token.String, with or without TokenPrefix.
+func ParseToken(s string) (*Token, error) {
+	s = strings.TrimSpace(s)
+	if len(s) >= len(TokenPrefix) && strings.EqualFold(s[:len(TokenPrefix)], TokenPrefix) {
+		s = s[len(TokenPrefix):]
+	}
+	bs, err := tokenEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil || len(bs) < 1+checksumSize {
+		return nil, errors.New("invalid invite token: bad encoding")
+	}
+	body, sum := bs[:len(bs)-checksumSize], bs[len(bs)-checksumSize:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, errors.New("invalid invite token: checksum mismatch, it may have been copied incorrectly")
+	}
+	if body[0] != tokenVersion {
+		return nil, fmt.Errorf("invalid invite token: unsupported version %d", body[0])
+	}
+	body = body[1:]
+	if len(body) < ed25519.PublicKeySize+secretSize+2+8+1 {
+		return nil, errors.New("invalid invite token: too short")
+	}
+	t := &Token{PublicKey: ed25519.PublicKey(body[:ed25519.PublicKeySize])}
+	body = body[ed25519.PublicKeySize:]
+	copy(t.Secret[:], body[:secretSize])
+	body = body[secretSize:]
+	t.Port = binary.BigEndian.Uint16(body)
+	t.Expires = time.Unix(int64(binary.BigEndian.Uint64(body[2:])), 0)
+	count := int(body[10])
+	body = body[11:]
+	for range count {
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return nil, errors.New("invalid invite token: truncated peers")
+		}
+		t.Peers = append(t.Peers, string(body[1:1+int(body[0])]))
+		body = body[1+int(body[0]):]
+	}
+	if len(body) != 0 {
+		return nil, errors.New("invalid invite token: trailing data")
+	}
+	return t, nil
+}
+
+func (t *Token) String() string {
+	bs := []byte{tokenVersion}
+	bs = append(bs, t.PublicKey...)
+	bs = append(bs, t.Secret[:]...)
+	bs = binary.BigEndian.AppendUint16(bs, t.Port)
+	bs = binary.BigEndian.AppendUint64(bs, uint64(t.Expires.Unix()))
+	bs = append(bs, byte(len(t.Peers)))
+	for _, p := range t.Peers {
+		bs = append(bs, byte(len(p)))
+		bs = append(bs, p...)
+	}
+	bs = binary.BigEndian.AppendUint32(bs, crc32.ChecksumIEEE(bs))
+	return TokenPrefix + tokenEncoding.EncodeToString(bs)
+}
+
+// Expired reports whether the token can no longer be used.
+func (t *Token) Expired() bool {
+	return !time.Now().Before(t.Expires)
+}
+
+// ManagementAddress returns the address of the inviting node's management service.
+func (t *Token) ManagementAddress() string {
+	addr := address.AddrForKey(t.PublicKey)
+	return net.JoinHostPort(net.IP(addr[:]).String(), strconv.Itoa(int(t.Port)))
+}
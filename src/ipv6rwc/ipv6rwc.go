@@ -22,6 +22,9 @@ import (
 
 const keyStoreTimeout = 2 * time.Minute
 
+// maxRemoteRejectsPerSecond limits ICMPv6 errors sent to remote nodes for filtered traffic
+const maxRemoteRejectsPerSecond = 10
+
 /*
 // Out-of-band packet types
 const (
@@ -45,6 +48,9 @@ type keyStore struct {
 	subnetBuffer map[address.Subnet]*buffer
 	mtu          uint64
 	filter       *filter.Filter
+	localPackets chan []byte // generated packets to be delivered to the local stack by readPC
+	rejectWindow time.Time
+	rejectCount  int
 }
 
 type keyInfo struct {
@@ -77,6 +83,7 @@ func (k *keyStore) init(c *core.Core, f *filter.Filter) {
 	k.subnetBuffer = make(map[address.Subnet]*buffer)
 	k.mtu = 1280 // Default to something safe, expect user to set this
 	k.filter = f
+	k.localPackets = make(chan []byte, 16)
 }
 
 func (k *keyStore) sendToAddress(addr address.Address, bs []byte) {
@@ -233,9 +240,19 @@ func (k *keyStore) sendKeyResponse(dest ed25519.PublicKey) { // nolint:unused
 func (k *keyStore) readPC(p []byte) (int, error) {
 	buf := make([]byte, k.core.MTU(), 65535)
 	for {
+		select {
+		case packet := <-k.localPackets:
+			return copy(p, packet), nil
+		default:
+		}
 		bs := buf
 		n, from, err := k.core.ReadFrom(bs)
 		if err != nil {
+			if errors.Is(err, iwt.ErrTimeout) {
+				// woken up by deliverLocal, clear the deadline before checking the queue
+				_ = k.core.SetReadDeadline(time.Time{})
+				continue
+			}
 			return n, err
 		}
 		if n == 0 {
@@ -278,9 +295,13 @@ func (k *keyStore) readPC(p []byte) (int, error) {
 		}
 		info := k.update(ed25519.PublicKey(from.(iwt.Addr)))
 		if srcAddr != info.address && srcSubnet != info.subnet {
+			k.filter.RecordDrop(&info.address, bs, filter.DropBadSource, false)
 			continue // bad remote address/subnet
 		}
-		if !k.filter.IsAllowed(&srcAddr) {
+		if !k.filter.IsInboundAllowed(bs) {
+			if k.filter.RejectsRemote() {
+				k.rejectRemote(info, bs)
+			}
 			continue
 		}
 		n = copy(p, bs)
@@ -304,16 +325,22 @@ func (k *keyStore) writePC(bs []byte) (int, error) {
 	copy(dstSubnet[:], bs[24:])
 	if srcAddr != k.address && srcSubnet != k.subnet {
 		// This happens all the time due to link-local traffic
-		// Don't send back an error, just drop it
+		// Don't send back an error, just drop it, and only count it if it was headed for the network
+		if dstAddr.IsValid() || dstSubnet.IsValid() {
+			k.filter.RecordDrop(&dstAddr, bs, filter.DropBadSource, true)
+		}
 		strErr := fmt.Sprint("incorrect source address: ", net.IP(srcAddr[:]).String())
 		return 0, errors.New(strErr)
 	}
-	if dstAddr.IsValid() {
-		// if dstAddr doesn't match allowed addresses, return error
-		if !k.filter.IsAllowed(&dstAddr) {
-			strErr := fmt.Sprint("destination address not allowed: ", net.IP(dstAddr[:]).String())
-			return 0, errors.New(strErr)
+	if (dstAddr.IsValid() || dstSubnet.IsValid()) && !k.filter.IsOutboundAllowed(bs) {
+		// destination address or subnet doesn't match allowed keys
+		if k.filter.RejectsLocal() {
+			k.rejectLocal(bs)
 		}
+		strErr := fmt.Sprint("destination address not allowed: ", net.IP(dstAddr[:]).String())
+		return 0, errors.New(strErr)
+	}
+	if dstAddr.IsValid() {
 		k.sendToAddress(dstAddr, bs)
 	} else if dstSubnet.IsValid() {
 		k.sendToSubnet(dstSubnet, bs)
@@ -323,6 +350,79 @@ func (k *keyStore) writePC(bs []byte) (int, error) {
 	return len(bs), nil
 }
 
+// createProhibited builds an ICMPv6 "administratively prohibited" destination unreachable error
+// in reply to bs. Returns nil if bs is itself an ICMPv6 error, which must not be answered.
+func createProhibited(bs []byte) []byte {
+	if bs[6] == 58 && len(bs) > 40 && bs[40] < 128 { // ICMPv6 error types are below 128
+		return nil
+	}
+	// quote as much of the original packet as fits in the minimum IPv6 MTU
+	buf := make([]byte, 1280-40-8)
+	cn := copy(buf, bs)
+	du := &icmp.DstUnreach{
+		Data: buf[:cn],
+	}
+	packet, err := ipv6rwcInternal.CreateICMPv6(net.IP(bs[8:24]), net.IP(bs[24:40]), ipv6.ICMPTypeDestinationUnreachable, 1, du)
+	if err != nil {
+		return nil
+	}
+	return packet
+}
+
+// rejectLocal answers a locally originated packet dropped by the filter.
+func (k *keyStore) rejectLocal(bs []byte) {
+	if packet := createProhibited(bs); packet != nil {
+		k.deliverLocal(packet)
+	}
+}
+
+// rejectRemote answers a packet from the remote node described by info that was dropped by the filter.
+func (k *keyStore) rejectRemote(info *keyInfo, bs []byte) {
+	now := time.Now()
+	k.mutex.Lock()
+	if now.Sub(k.rejectWindow) >= time.Second {
+		k.rejectWindow, k.rejectCount = now, 0
+	}
+	k.rejectCount++
+	limited := k.rejectCount > maxRemoteRejectsPerSecond
+	k.mutex.Unlock()
+	if limited {
+		return
+	}
+	if packet := createProhibited(bs); packet != nil {
+		_, _ = k.core.WriteTo(packet, iwt.Addr(info.key[:]))
+	}
+}
+
+// deliverLocal queues a packet to be returned by readPC, waking it up if it's
+// blocked reading from the core. The packet is dropped if the queue is full.
+func (k *keyStore) deliverLocal(packet []byte) {
+	select {
+	case k.localPackets <- packet:
+		_ = k.core.SetReadDeadline(time.Now())
+	default:
+	}
+}
+
+// dropDisallowedBuffers discards packets waiting on a key lookup that the filter no longer allows,
+// so they aren't sent once the lookup completes.
+func (k *keyStore) dropDisallowedBuffers() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for addr, buf := range k.addrBuffer {
+		if !k.filter.AllowsOutbound(buf.packet) {
+			buf.timeout.Stop()
+			delete(k.addrBuffer, addr)
+		}
+	}
+	for subnet, buf := range k.subnetBuffer {
+		if !k.filter.AllowsOutbound(buf.packet) {
+			buf.timeout.Stop()
+			delete(k.subnetBuffer, subnet)
+		}
+	}
+}
+
 // Exported API
 
 func (k *keyStore) MaxMTU() uint64 {
@@ -366,6 +466,16 @@ func (rwc *ReadWriteCloser) Subnet() address.Subnet {
 	return rwc.subnet
 }
 
+// ReloadFilter atomically replaces the filter policy. Traffic that is no longer allowed
+// is dropped from the next packet on, including packets still waiting on a key lookup.
+func (rwc *ReadWriteCloser) ReloadFilter(allowedKeys []string, options ...filter.SetupOption) error {
+	if err := rwc.filter.Reload(allowedKeys, options...); err != nil {
+		return err
+	}
+	rwc.dropDisallowedBuffers()
+	return nil
+}
+
 func (rwc *ReadWriteCloser) Read(p []byte) (n int, err error) {
 	return rwc.readPC(p)
 }
@@ -0,0 +1,144 @@
+package ipv6rwc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/nermolov/yggdrasil-manager/src/filter"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// TestRejectLocal ensures that a blocked write is answered with an ICMPv6 error on Read,
+// even while Read is blocked waiting for network traffic.
+func TestRejectLocal(t *testing.T) {
+	cfg := config.GenerateConfig()
+	c, err := core.New(cfg.Certificate, log.New(os.Stderr, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	f, err := filter.NewFilter(nil, filter.RejectLocal(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rwc := NewReadWriteCloser(c, f)
+
+	unknown, _, _ := ed25519.GenerateKey(nil)
+	packet := make([]byte, 60)
+	packet[0] = 0x60
+	packet[6] = 59 // no next header
+	copy(packet[8:24], c.Address())
+	copy(packet[24:40], address.AddrForKey(unknown)[:])
+
+	read := make(chan []byte)
+	go func() {
+		buf := make([]byte, 65535)
+		n, _ := rwc.Read(buf)
+		read <- buf[:n]
+	}()
+	time.Sleep(10 * time.Millisecond) // let Read block in the core
+
+	if _, err := rwc.Write(packet); err == nil {
+		t.Fatal("write to a filtered destination should fail")
+	}
+	select {
+	case reply := <-read:
+		if len(reply) < 48 || reply[6] != 58 || reply[40] != 1 || reply[41] != 1 {
+			t.Fatalf("expected ICMPv6 administratively prohibited, got %x", reply)
+		}
+		if string(reply[24:40]) != string(packet[8:24]) {
+			t.Fatal("error should be addressed to the original sender")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ICMPv6 error delivered")
+	}
+}
+
+// TestBadSourceDrops ensures that only packets with a wrong source headed for the network
+// are counted as dropped, not the link-local traffic the OS sends to the TUN all the time.
+func TestBadSourceDrops(t *testing.T) {
+	cfg := config.GenerateConfig()
+	c, err := core.New(cfg.Certificate, log.New(os.Stderr, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	f, err := filter.NewFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rwc := NewReadWriteCloser(c, f)
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	packet := func(dst net.IP) []byte {
+		bs := make([]byte, 60)
+		bs[0] = 0x60
+		bs[6] = 59 // no next header
+		copy(bs[8:24], net.ParseIP("fe80::1"))
+		copy(bs[24:40], dst)
+		return bs
+	}
+	if _, err := rwc.Write(packet(net.ParseIP("ff02::2"))); err == nil {
+		t.Fatal("write with a link-local source should fail")
+	}
+	if drops := f.DropStats().Outbound[filter.DropBadSource]; drops != 0 {
+		t.Fatalf("link-local traffic counted as %d drops", drops)
+	}
+	if _, err := rwc.Write(packet(address.AddrForKey(other)[:])); err == nil {
+		t.Fatal("write with a link-local source should fail")
+	}
+	if drops := f.DropStats().Outbound[filter.DropBadSource]; drops != 1 {
+		t.Fatalf("expected 1 drop for a packet to the network, got %d", drops)
+	}
+}
+
+// BenchmarkWriteFiltered measures the cost of writing a packet to a destination that
+// the filter denies, the worst case for the allow list lookup.
+// It should stay flat as the number of allowed keys grows.
+func BenchmarkWriteFiltered(b *testing.B) {
+	cfg := config.GenerateConfig()
+	c, err := core.New(cfg.Certificate, log.New(os.Stderr, "", 0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Stop()
+
+	unknown, _, _ := ed25519.GenerateKey(nil)
+	packet := make([]byte, 60)
+	packet[0] = 0x60
+	packet[6] = 59 // no next header
+	copy(packet[8:24], c.Address())
+	copy(packet[24:40], address.AddrForKey(unknown)[:])
+
+	for _, count := range []int{1, 10, 100, 1000, 10000} {
+		keys := make([]string, count)
+		for i := range keys {
+			k := make([]byte, ed25519.PublicKeySize)
+			_, _ = rand.Read(k)
+			keys[i] = hex.EncodeToString(k)
+		}
+		f, err := filter.NewFilter(keys)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rwc := NewReadWriteCloser(c, f)
+
+		b.Run(fmt.Sprintf("keys=%d", count), func(b *testing.B) {
+			for b.Loop() {
+				_, _ = rwc.Write(packet)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package lan
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetLANLinksRequest struct{}
+type GetLANLinksResponse struct {
+	Endpoints []string      `json:"endpoints"`
+	Devices   []LANLinkInfo `json:"devices"`
+}
+
+type LANLinkInfo struct {
+	Name        string `json:"name"`
+	PublicKey   string `json:"key"`
+	Hops        int    `json:"hops,omitempty"`
+	HopsBefore  int    `json:"hops_before,omitempty"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Since       int64  `json:"since,omitempty"`
+	LastAttempt int64  `json:"last_attempt,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+func (o *Optimizer) getLANLinksHandler(req *GetLANLinksRequest, res *GetLANLinksResponse) error {
+	res.Endpoints = o.Endpoints()
+	now := time.Now()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, d := range o.registry.Devices() {
+		if !d.IsActive(now) {
+			continue
+		}
+		info := LANLinkInfo{Name: d.Name, PublicKey: d.PublicKey}
+		if s, ok := o.devices[d.PublicKey]; ok {
+			info.Hops, info.Endpoint, info.LastError = s.hops, s.endpoint, s.lastError
+			if s.endpoint != "" {
+				info.HopsBefore, info.Since = s.hopsBefore, s.since.Unix()
+			}
+			if !s.lastAttempt.IsZero() {
+				info.LastAttempt = s.lastAttempt.Unix()
+			}
+		}
+		res.Devices = append(res.Devices, info)
+	}
+	return nil
+}
+
+func (o *Optimizer) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getLANLinks", "Show the path length to each device and the direct LAN links that shortened it", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetLANLinksRequest{}
+			res := &GetLANLinksResponse{Devices: []LANLinkInfo{}}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := o.getLANLinksHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
@@ -0,0 +1,343 @@
+// Package lan upgrades devices that share a LAN with this node, but reach it through other
+// nodes, to direct peers.
+//
+// Devices advertise the addresses they listen for peerings on through the management service.
+// Devices on the LAN are found by their paths: a device that isn't a peer but has a path of
+// two or more hops is asked for its endpoints, and the ones in the networks of the local
+// multicast interfaces are tried. Multicast normally peers such devices, but beacons don't get
+// through every network, e.g. Wi-Fi that filters multicast or separate LAN segments.
+package lan
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// EndpointsPath is where devices advertise their endpoints on the management service.
+const EndpointsPath = "/endpoints"
+
+const (
+	checkInterval = 30 * time.Second
+	retryInterval = 10 * time.Minute
+	dialTimeout   = 2 * time.Second
+	peerTimeout   = 5 * time.Second
+)
+
+// schemes are the peering schemes that can be advertised.
+var schemes = []string{"tcp", "tls", "quic"}
+
+// Core is the part of the Yggdrasil core an optimizer uses.
+type Core interface {
+	PublicKey() ed25519.PublicKey
+	GetPeers() []core.PeerInfo
+	GetPaths() []core.PathEntryInfo
+	CallPeer(u *url.URL, sintf string) error
+}
+
+// endpointsMessage lists the peering URIs a device listens on.
+type endpointsMessage struct {
+	Endpoints []string
+}
+
+// deviceState is what is known about the path to a device.
+type deviceState struct {
+	hops        int       // hops on the last path seen, 0 if there was none
+	hopsBefore  int       // hops on the path before the direct link
+	endpoint    string    // URI of the direct link, empty without one
+	since       time.Time // when the direct link came up
+	connecting  bool
+	lastAttempt time.Time
+	lastError   string
+}
+
+// Optimizer peers directly with devices on the LAN that this node reaches through other nodes.
+type Optimizer struct {
+	core     Core
+	registry *devices.Registry
+	port     uint16
+	listen   []string
+	networks func() []*net.IPNet
+	logger   *log.Logger
+
+	mutex   sync.Mutex
+	devices map[string]*deviceState
+}
+
+// NewOptimizer creates an optimizer for the devices in registry. It advertises the listen URIs
+// of this node and tries endpoints of other devices in the LAN networks returned by networks.
+// The management service of other devices is reached on port.
+func NewOptimizer(c Core, registry *devices.Registry, port uint16, listen []string, networks func() []*net.IPNet, logger *log.Logger) *Optimizer {
+	return &Optimizer{
+		core:     c,
+		registry: registry,
+		port:     port,
+		listen:   listen,
+		networks: networks,
+		logger:   logger,
+		devices:  map[string]*deviceState{},
+	}
+}
+
+// InterfaceNetworks returns the networks of the unicast addresses of interfaces, except
+// link-local ones, which can't be told apart between LANs.
+func InterfaceNetworks(interfaces map[string]net.Interface) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && usable(ipnet.IP) {
+				networks = append(networks, ipnet)
+			}
+		}
+	}
+	return networks
+}
+
+func usable(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// contains reports whether ip is in one of networks.
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	return slices.ContainsFunc(networks, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
+// Endpoints returns the peering URIs this node advertises, those with an address in the LAN
+// networks. Listen addresses on all interfaces are replaced by the addresses in the networks.
+func (o *Optimizer) Endpoints() []string {
+	endpoints := []string{}
+	for _, listen := range o.listen {
+		u, err := url.Parse(listen)
+		if err != nil || !slices.Contains(schemes, u.Scheme) {
+			continue
+		}
+		host, port, err := net.SplitHostPort(u.Host)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			continue
+		}
+		networks := o.networks()
+		if !ip.IsUnspecified() {
+			if contains(networks, ip) {
+				endpoints = append(endpoints, listen)
+			}
+			continue
+		}
+		for _, network := range networks {
+			if ip.To4() != nil && network.IP.To4() == nil {
+				continue // 0.0.0.0 only listens on IPv4
+			}
+			advertised := *u
+			advertised.Host = net.JoinHostPort(network.IP.String(), port)
+			if !slices.Contains(endpoints, advertised.String()) {
+				endpoints = append(endpoints, advertised.String())
+			}
+		}
+	}
+	return endpoints
+}
+
+// onLAN returns the endpoints that are in one of the LAN networks.
+func (o *Optimizer) onLAN(endpoints []string) []*url.URL {
+	networks := o.networks()
+	var found []*url.URL
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || !slices.Contains(schemes, u.Scheme) {
+			continue
+		}
+		host, _, err := net.SplitHostPort(u.Host)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			continue
+		}
+		if contains(networks, ip) {
+			found = append(found, u)
+		}
+	}
+	return found
+}
+
+func (o *Optimizer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(endpointsMessage{Endpoints: o.Endpoints()})
+}
+
+// Run checks the paths to devices until ctx is done, using client for the management service.
+// Requests from the other devices are served by mounting the optimizer on EndpointsPath of
+// the management service.
+func (o *Optimizer) Run(ctx context.Context, client *http.Client) error {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		o.checkAll(ctx, client)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll records the paths to the active devices and starts connecting to those that have a
+// path of two or more hops but aren't peers, unless that failed recently.
+func (o *Optimizer) checkAll(ctx context.Context, client *http.Client) {
+	peered := map[string]bool{}
+	for _, p := range o.core.GetPeers() {
+		if p.Up {
+			peered[string(p.Key)] = true
+		}
+	}
+	hops := map[string]int{}
+	for _, p := range o.core.GetPaths() {
+		// the path is a route through the tree, which is empty when the device is the root
+		// but more than one hop away from a node that doesn't peer with it
+		hops[string(p.Key)] = max(len(p.Path), 2)
+	}
+	now := time.Now()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, d := range o.registry.Devices() {
+		key, err := d.Key()
+		if err != nil || !d.IsActive(now) {
+			continue
+		}
+		s, ok := o.devices[d.PublicKey]
+		if !ok {
+			s = &deviceState{}
+			o.devices[d.PublicKey] = s
+		}
+		s.hops = hops[string(key)]
+		if peered[string(key)] {
+			s.hops = 1
+			continue
+		}
+		if s.endpoint != "" {
+			o.logger.Infof("Direct LAN link with device %s over %s closed", d.Name, s.endpoint)
+			s.endpoint, s.since = "", time.Time{}
+		}
+		if s.hops < 2 || s.connecting || s.lastError != "" && now.Before(s.lastAttempt.Add(retryInterval)) {
+			continue
+		}
+		s.connecting, s.lastAttempt = true, now
+		go func(hops int) {
+			endpoint, err := o.connect(ctx, client, d, key)
+			o.mutex.Lock()
+			defer o.mutex.Unlock()
+			s.connecting = false
+			if err != nil {
+				s.lastError = err.Error()
+				o.logger.Debugf("No direct LAN link with device %s: %v", d.Name, err)
+				return
+			}
+			s.hops, s.hopsBefore, s.endpoint, s.since, s.lastError = 1, hops, endpoint, time.Now(), ""
+			o.logger.Infof("Device %s is now peered directly over %s on the LAN, its path went from %d hops to 1", d.Name, endpoint, hops)
+		}(s.hops)
+	}
+}
+
+// connect asks the device for its endpoints and peers with it over the first one on the LAN
+// that it connects through. Returns the endpoint.
+func (o *Optimizer) connect(ctx context.Context, client *http.Client, d devices.Device, key ed25519.PublicKey) (string, error) {
+	endpoints, err := o.fetch(ctx, client, key)
+	if err != nil {
+		return "", err
+	}
+	candidates := o.onLAN(endpoints)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("none of the %d advertised endpoints is on the LAN", len(endpoints))
+	}
+	var errs []error
+	for _, u := range candidates {
+		if u.Scheme != "quic" {
+			// fail fast on endpoints that aren't reachable, the core retries for a while
+			conn, err := (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, "tcp", u.Host)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			_ = conn.Close()
+		}
+		pinned := *u
+		query := pinned.Query()
+		query.Set("key", d.PublicKey)
+		pinned.RawQuery = query.Encode()
+		if err := o.core.CallPeer(&pinned, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u, err))
+			continue
+		}
+		if o.waitForPeer(ctx, key) {
+			return u.String(), nil
+		}
+		errs = append(errs, fmt.Errorf("%s: no peering", u))
+	}
+	return "", errors.Join(errs...)
+}
+
+// waitForPeer waits for a peering with key to come up.
+func (o *Optimizer) waitForPeer(ctx context.Context, key ed25519.PublicKey) bool {
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for _, p := range o.core.GetPeers() {
+			if p.Up && p.Key.Equal(key) {
+				return true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch asks the device with the given key for its endpoints.
+func (o *Optimizer) fetch(ctx context.Context, client *http.Client, key ed25519.PublicKey) ([]string, error) {
+	addr := address.AddrForKey(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, management.URL(net.IP(addr[:]), o.port, EndpointsPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("endpoints rejected (%d): %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var msg endpointsMessage
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return msg.Endpoints, nil
+}
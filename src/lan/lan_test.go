@@ -0,0 +1,147 @@
+package lan
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// fakeCore routes to every device over two hops until it is called directly.
+type fakeCore struct {
+	key   ed25519.PublicKey
+	paths []core.PathEntryInfo
+
+	mutex  sync.Mutex
+	called []string
+	peers  []core.PeerInfo
+}
+
+func (c *fakeCore) PublicKey() ed25519.PublicKey   { return c.key }
+func (c *fakeCore) GetPaths() []core.PathEntryInfo { return c.paths }
+
+func (c *fakeCore) GetPeers() []core.PeerInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.peers
+}
+
+func (c *fakeCore) CallPeer(u *url.URL, _ string) error {
+	key, err := hex.DecodeString(u.Query().Get("key"))
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.called = append(c.called, u.String())
+	c.peers = append(c.peers, core.PeerInfo{URI: u.String(), Up: true, Key: key})
+	return nil
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	network.IP = ip
+	return network
+}
+
+func TestEndpoints(t *testing.T) {
+	networks := []*net.IPNet{mustParseCIDR("192.168.1.20/24"), mustParseCIDR("fd00::20/64")}
+	o := NewOptimizer(nil, nil, management.DefaultPort, []string{
+		"tls://0.0.0.0:5000",
+		"tcp://[::]:5001?password=secret",
+		"quic://192.168.1.20:5002",
+		"tls://127.0.0.1:5003",
+		"tcp://laptop.local:5004",
+		"unix:///run/ygg.sock",
+	}, func() []*net.IPNet { return networks }, log.New(io.Discard, "", 0))
+
+	assert.Equal(t, []string{
+		"tls://192.168.1.20:5000",
+		"tcp://192.168.1.20:5001?password=secret",
+		"tcp://[fd00::20]:5001?password=secret",
+		"quic://192.168.1.20:5002",
+	}, o.Endpoints())
+
+	var onLAN []string
+	for _, u := range o.onLAN([]string{"tls://192.168.1.30:5000", "tls://192.168.2.30:5000", "tcp://[fd00::30]:5001", "tls://[fe80::30]:5000", "unix:///x"}) {
+		onLAN = append(onLAN, u.String())
+	}
+	assert.Equal(t, []string{"tls://192.168.1.30:5000", "tcp://[fd00::30]:5001"}, onLAN)
+}
+
+// TestConnect finds phone two hops away from laptop and peers with it over the endpoint it
+// advertises on the LAN.
+func TestConnect(t *testing.T) {
+	laptopKey, _, _ := ed25519.GenerateKey(nil)
+	phoneKey, _, _ := ed25519.GenerateKey(nil)
+	phone := devices.Device{Name: "phone", PublicKey: hex.EncodeToString(phoneKey), AddedAt: time.Now()}
+	registry, _ := devices.NewRegistry([]devices.Device{phone})
+	laptopCore := &fakeCore{key: laptopKey, paths: []core.PathEntryInfo{{Key: phoneKey, Path: []uint64{1, 2}}}}
+	loopback := func() []*net.IPNet { return []*net.IPNet{mustParseCIDR("127.0.0.1/8")} }
+	logger := log.New(io.Discard, "", 0)
+
+	// the peering listener of phone, a loopback address stands in for the LAN
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	phoneOptimizer := NewOptimizer(nil, nil, management.DefaultPort, []string{"tls://" + ln.Addr().String()}, loopback, logger)
+	httpServer := httptest.NewServer(phoneOptimizer)
+	defer httpServer.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, httpServer.Listener.Addr().String())
+		},
+	}}
+
+	laptopOptimizer := NewOptimizer(laptopCore, registry, management.DefaultPort, nil, loopback, logger)
+	info := func() LANLinkInfo {
+		res := &GetLANLinksResponse{}
+		assert.NoError(t, laptopOptimizer.getLANLinksHandler(&GetLANLinksRequest{}, res))
+		return res.Devices[0]
+	}
+	laptopOptimizer.checkAll(context.Background(), client)
+	assert.Eventually(t, func() bool { return info().Endpoint != "" }, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []string{"tls://" + ln.Addr().String() + "?key=" + phone.PublicKey}, laptopCore.called)
+	assert.Equal(t, LANLinkInfo{
+		Name:        "phone",
+		PublicKey:   phone.PublicKey,
+		Hops:        1,
+		HopsBefore:  2,
+		Endpoint:    "tls://" + ln.Addr().String(),
+		Since:       info().Since,
+		LastAttempt: info().LastAttempt,
+	}, info())
+
+	// the direct link dropped and the endpoint is gone
+	laptopCore.mutex.Lock()
+	laptopCore.peers = nil
+	laptopCore.mutex.Unlock()
+	_ = ln.Close()
+	laptopOptimizer.checkAll(context.Background(), client)
+	assert.Eventually(t, func() bool { return info().LastError != "" }, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 2, info().Hops)
+	assert.Empty(t, info().Endpoint)
+	assert.Len(t, laptopCore.called, 1)
+}
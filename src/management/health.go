@@ -0,0 +1,61 @@
+package management
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HealthPath is where every node answers health queries from its devices.
+const HealthPath = "/health"
+
+type Health struct {
+	Name         string `json:"name"`
+	PublicKey    string `json:"key"`
+	Address      string `json:"address"`
+	BuildName    string `json:"build_name"`
+	BuildVersion string `json:"build_version"`
+	Uptime       int64  `json:"uptime"` // seconds
+	Peers        int    `json:"peers"`
+	Sessions     int    `json:"sessions"`
+	Devices      int    `json:"devices"`
+	Sync         bool   `json:"sync"`
+}
+
+// HealthHandler answers health queries with the state returned by health.
+func HealthHandler(health func() Health) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(health())
+	})
+}
+
+// GetHealth queries the health of the node with the given address.
+func GetHealth(ctx context.Context, client *http.Client, ip net.IP, port uint16) (*Health, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL(ip, port, HealthPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("health query rejected (%d): %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	health := &Health{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
@@ -0,0 +1,165 @@
+// Package management serves requests between nodes over the Yggdrasil network, on a TCP port
+// of the node address.
+//
+// Callers are authenticated by the source address of their connection: the tunnel only delivers
+// packets whose source address belongs to the key that sent them, so the address identifies the
+// caller's public key. Each endpoint is open to anyone, to devices, or to admin devices only.
+package management
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+const (
+	// DefaultPort is the TCP port the management service listens on.
+	DefaultPort = 9777
+
+	requestTimeout  = 10 * time.Second
+	shutdownTimeout = 5 * time.Second
+)
+
+// Access is who may use an endpoint.
+type Access int
+
+const (
+	Anyone  Access = iota // any node, e.g. devices that are joining
+	Devices               // active devices
+	Admins                // devices allowed to administer this node
+)
+
+// Caller is the node a request came from.
+type Caller struct {
+	Address  address.Address
+	Device   devices.Device // set if IsDevice
+	IsDevice bool           // an active device
+	IsAdmin  bool           // a device allowed to administer this node
+}
+
+// AuthorizeFunc identifies the caller with the given address.
+type AuthorizeFunc func(addr address.Address) Caller
+
+type endpoint struct {
+	access  Access
+	handler http.Handler
+}
+
+type callerKey struct{}
+
+// CallerFrom returns the caller of a request served by the management service.
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// Server dispatches management requests to the endpoints registered by path.
+// Endpoints can be added and removed while it runs.
+type Server struct {
+	port      uint16
+	authorize AuthorizeFunc
+
+	mutex     sync.RWMutex
+	endpoints map[string]endpoint
+}
+
+func NewServer(port uint16, authorize AuthorizeFunc) *Server {
+	return &Server{
+		port:      port,
+		authorize: authorize,
+		endpoints: map[string]endpoint{},
+	}
+}
+
+// Port returns the TCP port the server listens on.
+func (s *Server) Port() uint16 {
+	return s.port
+}
+
+// Handle serves path with handler for the callers allowed by access, replacing any previous handler.
+func (s *Server) Handle(path string, access Access, handler http.Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.endpoints[path] = endpoint{access: access, handler: handler}
+}
+
+// Remove stops serving path.
+func (s *Server) Remove(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.endpoints, path)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	e, ok := s.endpoints[r.URL.Path]
+	s.mutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host).To16()
+	if err != nil || ip == nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	var addr address.Address
+	copy(addr[:], ip)
+	if !addr.IsValid() {
+		// subnet addresses may be used by any host behind a node
+		http.Error(w, "requests must come from a node address", http.StatusForbidden)
+		return
+	}
+	caller := s.authorize(addr)
+	switch {
+	case e.access == Devices && !caller.IsDevice:
+		http.Error(w, "not a device of this node", http.StatusForbidden)
+		return
+	case e.access == Admins && !caller.IsAdmin:
+		http.Error(w, "not an admin device of this node", http.StatusForbidden)
+		return
+	}
+	e.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+}
+
+// Run serves requests on the port of listenIP until ctx is done.
+func (s *Server) Run(ctx context.Context, listenIP net.IP) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(listenIP.String(), strconv.Itoa(int(s.port))))
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: requestTimeout}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Client returns an HTTP client for the management service of other nodes. It connects from
+// localIP, the node address of this node, so that the other side can authenticate it.
+func Client(localIP net.IP) *http.Client {
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: localIP}}
+	return &http.Client{
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		Timeout:   requestTimeout,
+	}
+}
+
+// URL returns the URL of path on the management service of the node with the given address.
+func URL(ip net.IP, port uint16, path string) string {
+	return "http://" + net.JoinHostPort(ip.String(), strconv.Itoa(int(port))) + path
+}
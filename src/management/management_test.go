@@ -0,0 +1,61 @@
+package management
+
+import (
+	"crypto/ed25519"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+func TestServerAccess(t *testing.T) {
+	admin, _, _ := ed25519.GenerateKey(nil)
+	device, _, _ := ed25519.GenerateKey(nil)
+	stranger, _, _ := ed25519.GenerateKey(nil)
+	adminAddr, deviceAddr := *address.AddrForKey(admin), *address.AddrForKey(device)
+	s := NewServer(DefaultPort, func(addr address.Address) Caller {
+		return Caller{Address: addr, IsDevice: addr == adminAddr || addr == deviceAddr, IsAdmin: addr == adminAddr}
+	})
+	var served []Caller
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := CallerFrom(r.Context())
+		served = append(served, caller)
+	})
+	s.Handle("/anyone", Anyone, handler)
+	s.Handle("/devices", Devices, handler)
+	s.Handle("/admins", Admins, handler)
+
+	get := func(from net.IP, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(from.String(), "40000")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	ip := func(key ed25519.PublicKey) net.IP {
+		addr := address.AddrForKey(key)
+		return net.IP(addr[:])
+	}
+
+	assert.Equal(t, http.StatusOK, get(ip(stranger), "/anyone"))
+	assert.Equal(t, http.StatusForbidden, get(ip(stranger), "/devices"))
+	assert.Equal(t, http.StatusOK, get(ip(device), "/devices"))
+	assert.Equal(t, http.StatusForbidden, get(ip(device), "/admins"))
+	assert.Equal(t, http.StatusOK, get(ip(admin), "/admins"))
+	assert.Equal(t, http.StatusNotFound, get(ip(admin), "/missing"))
+	if assert.Len(t, served, 3) {
+		assert.Equal(t, *address.AddrForKey(stranger), served[0].Address)
+		assert.True(t, served[2].IsAdmin)
+	}
+
+	// subnet addresses don't identify a node
+	subnet := address.SubnetForKey(admin)
+	assert.Equal(t, http.StatusForbidden, get(net.IP(append(subnet[:], 0, 0, 0, 0, 0, 0, 0, 1)), "/anyone"))
+	assert.Equal(t, http.StatusForbidden, get(net.ParseIP("192.0.2.1"), "/anyone"))
+
+	s.Remove("/anyone")
+	assert.Equal(t, http.StatusNotFound, get(ip(stranger), "/anyone"))
+}
@@ -0,0 +1,69 @@
+package management
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+// AdminPath is where admin devices send admin socket requests to run on this node.
+const AdminPath = "/admin"
+
+const (
+	maxAdminRequestSize  = 64 << 10
+	maxAdminResponseSize = 4 << 20
+)
+
+// AdminProxy forwards admin socket requests, as sent to the admin socket, to the local
+// admin socket listening on endpoint and answers with its response.
+func AdminProxy(endpoint string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req admin.AdminSocketRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		req.KeepAlive = false
+		conn, err := dialAdmin(endpoint)
+		if err != nil {
+			http.Error(w, "admin socket unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+		if err := json.NewEncoder(conn).Encode(req); err != nil {
+			http.Error(w, "admin socket unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var res json.RawMessage
+		if err := json.NewDecoder(io.LimitReader(conn, maxAdminResponseSize)).Decode(&res); err != nil {
+			http.Error(w, "invalid admin socket response", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(res)
+	})
+}
+
+// dialAdmin connects to an admin socket endpoint as given by AdminListen.
+func dialAdmin(endpoint string) (net.Conn, error) {
+	if u, err := url.Parse(endpoint); err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "unix":
+			return net.DialTimeout("unix", endpoint[len("unix://"):], requestTimeout)
+		case "tcp":
+			return net.DialTimeout("tcp", u.Host, requestTimeout)
+		}
+	}
+	return net.DialTimeout("tcp", endpoint, requestTimeout)
+}
@@ -0,0 +1,168 @@
+// Package peerindex loads lists of public peers from the public peer index, either the HTML
+// page or the JSON format of the public-peers repository, or from local files for offline use.
+package peerindex
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// DefaultURL is the public peer index page.
+const DefaultURL = "https://publicpeers.neilalexander.dev/"
+
+// maxSize limits the size of an index.
+const maxSize = 4 << 20
+
+// Load reads the index at location, an http(s) URL or the path of a local file, and returns the
+// online peers listed in the sections of countries, or in all sections if there are none. See
+// Parse for the formats.
+func Load(ctx context.Context, client *http.Client, location string, countries []string) ([]string, error) {
+	data, err := Fetch(ctx, client, location)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, countries)
+}
+
+// Fetch reads the index at location without parsing it, see Load.
+func Fetch(ctx context.Context, client *http.Client, location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		path := strings.TrimPrefix(location, "file://")
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, maxSize))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch peer index: %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxSize))
+}
+
+// Parse returns the online peers of an index in the sections of countries, or in all sections
+// if there are none. The index is one of:
+//   - the HTML index page, with a table row per peer under a header per country
+//   - the JSON format of the public-peers repository, which maps the section files, e.g.
+//     "europe/germany.md", to the status of their peers by URI
+//   - a list of one peer URI per line, ignoring empty lines and lines starting with #, which
+//     has no sections
+func Parse(data []byte, countries []string) ([]string, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return parseJSON(data, countries)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return parseHTML(data, countries)
+	}
+	return parseList(data), nil
+}
+
+// inSection reports whether a section is one of countries, or there are none.
+func inSection(section string, countries []string) bool {
+	return len(countries) == 0 || slices.Contains(countries, section)
+}
+
+func parseHTML(data []byte, countries []string) ([]string, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []string{}
+
+	inCountry := false
+	for node := range doc.Descendants() {
+		// find table header
+		if found := hasAttribute(node, "id", "country"); found {
+			inCountry = node.FirstChild != nil && inSection(strings.TrimSpace(node.FirstChild.Data), countries)
+			continue
+		}
+		// collect online peers in the country section
+		if inCountry {
+			if found := hasAttribute(node, "class", "statusgood"); found {
+				for subnode := range node.Descendants() {
+					if found := hasAttribute(subnode, "id", "address"); found && subnode.FirstChild != nil {
+						peers = append(peers, strings.TrimSpace(subnode.FirstChild.Data))
+					}
+				}
+			}
+		}
+	}
+
+	return peers, nil
+}
+
+// peerStatus is the status of a peer in the JSON format, other fields are ignored.
+type peerStatus struct {
+	Up bool `json:"up"`
+}
+
+func parseJSON(data []byte, countries []string) ([]string, error) {
+	var sections map[string]map[string]peerStatus
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+	peers := []string{}
+	for _, file := range slices.Sorted(maps.Keys(sections)) {
+		if !inSection(strings.TrimSuffix(path.Base(file), ".md"), countries) {
+			continue
+		}
+		for _, uri := range slices.Sorted(maps.Keys(sections[file])) {
+			if sections[file][uri].Up {
+				peers = append(peers, uri)
+			}
+		}
+	}
+	return peers, nil
+}
+
+func parseList(data []byte) []string {
+	peers := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			peers = append(peers, line)
+		}
+	}
+	return peers
+}
+
+// hasAttribute reports whether an element has an attribute with value, or with value as one of
+// its space separated words, e.g. one of its classes.
+func hasAttribute(node *html.Node, name, value string) bool {
+	if node.Type != html.ElementNode {
+		return false
+	}
+	for _, attr := range node.Attr {
+		if attr.Key == name && slices.Contains(strings.Fields(attr.Val), value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package peerindex
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	data, err := os.ReadFile("testdata/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := Parse(data, []string{"united-states"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"quic://us1.example.org:443", "tcp://[2001:db8::1]:1234"}, peers)
+	}
+	peers, err = Parse(data, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"tls://de1.example.org:443", "quic://us1.example.org:443", "tcp://[2001:db8::1]:1234"}, peers)
+	}
+	peers, err = Parse(data, []string{"narnia"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, peers)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	data, err := os.ReadFile("testdata/publicnodes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := Parse(data, []string{"germany", "united-states"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"tls://de1.example.org:443", "quic://us1.example.org:443", "tcp://[2001:db8::1]:1234"}, peers)
+	}
+	peers, err = Parse(data, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"quic://fr1.example.org:443", "tls://de1.example.org:443", "quic://us1.example.org:443", "tcp://[2001:db8::1]:1234"}, peers)
+	}
+	_, err = Parse([]byte(`{"europe/germany.md": []}`), nil)
+	assert.Error(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	peers, err := Load(context.Background(), http.DefaultClient, "testdata/peers.txt", []string{"germany"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"tls://de1.example.org:443", "quic://us1.example.org:443"}, peers, "lists have no sections")
+	}
+
+	index, _ := os.ReadFile("testdata/index.html")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(index)
+	}))
+	defer server.Close()
+	peers, err = Load(context.Background(), server.Client(), server.URL+"/", []string{"germany"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"tls://de1.example.org:443"}, peers)
+	}
+	_, err = Load(context.Background(), server.Client(), server.URL+"/missing", nil)
+	assert.ErrorContains(t, err, "404")
+	_, err = Load(context.Background(), server.Client(), "file://testdata/missing.html", nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
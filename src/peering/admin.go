@@ -0,0 +1,69 @@
+package peering
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetPeeringRequest struct{}
+type GetPeeringResponse struct {
+	Mode        Mode         `json:"mode"`
+	AllowedKeys int          `json:"allowed_keys"`
+	Relays      []string     `json:"relays,omitempty"`
+	RelaysUp    bool         `json:"relays_up"`
+	RelaysSince int64        `json:"relays_since,omitempty"`
+	Peers       []PeerReason `json:"peers"`
+}
+
+type PeerReason struct {
+	URI       string `json:"remote"`
+	PublicKey string `json:"key"`
+	Inbound   bool   `json:"inbound"`
+	Up        bool   `json:"up"`
+	Reason    string `json:"reason"`
+	Allowed   bool   `json:"allowed"`
+}
+
+func (s *Supervisor) getPeeringHandler(req *GetPeeringRequest, res *GetPeeringResponse) error {
+	res.Mode, res.AllowedKeys = s.mode, len(s.allowed)
+	for _, u := range s.relays {
+		res.Relays = append(res.Relays, u.String())
+	}
+	for _, p := range s.core.GetPeers() {
+		reason, allowed := s.reason(p)
+		res.Peers = append(res.Peers, PeerReason{
+			URI:       p.URI,
+			PublicKey: hex.EncodeToString(p.Key),
+			Inbound:   p.Inbound,
+			Up:        p.Up,
+			Reason:    reason,
+			Allowed:   allowed,
+		})
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res.RelaysUp = s.relaysUp
+	if !s.relaysSince.IsZero() {
+		res.RelaysSince = s.relaysSince.Unix()
+	}
+	return nil
+}
+
+func (s *Supervisor) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getPeering", "Show who may peer with this node and why each peer is allowed", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetPeeringRequest{}
+			res := &GetPeeringResponse{Peers: []PeerReason{}}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := s.getPeeringHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
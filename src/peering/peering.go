@@ -0,0 +1,212 @@
+// Package peering keeps track of who may peer with this node and why.
+//
+// In private-mesh mode the allow list of the core holds only the keys of devices, and public
+// peers are only used as relays of last resort: they are connected while no device is peered
+// with this node, and disconnected once a device has stayed peered for a while.
+package peering
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+// Mode is how the allow list of the core is filled.
+type Mode string
+
+const (
+	// ModeOpen lets any node peer, the allow list is empty.
+	ModeOpen Mode = "open"
+	// ModeAllowList lets the keys in AllowedPublicKeys and the devices peer.
+	ModeAllowList Mode = "allow-list"
+	// ModePrivateMesh lets only devices peer, public peers are last-resort relays.
+	ModePrivateMesh Mode = "private-mesh"
+)
+
+const (
+	checkInterval = 10 * time.Second
+	// relayHold is how long a device has to stay peered before the relays are disconnected,
+	// so that a flapping link doesn't flap the relays too.
+	relayHold = 2 * time.Minute
+)
+
+// Core is the part of the Yggdrasil core a supervisor uses.
+type Core interface {
+	GetPeers() []core.PeerInfo
+	AddPeer(u *url.URL, sintf string) error
+	RemovePeer(u *url.URL, sintf string) error
+}
+
+// Supervisor connects the relays of a private mesh and explains why each peer is allowed.
+type Supervisor struct {
+	core     Core
+	registry *devices.Registry
+	mode     Mode
+	allowed  []string   // hex keys in the allow list of the core
+	peers    []*url.URL // configured peers
+	relays   []*url.URL
+	logger   *log.Logger
+
+	mutex        sync.Mutex
+	relaysUp     bool
+	relaysSince  time.Time // when the relays were last connected or disconnected
+	devicePeered time.Time // since when a device is peered, zero if none is
+}
+
+// NewSupervisor creates a supervisor for a core that was set up with the allow list allowed
+// and the configured peers. In private-mesh mode, relays are connected as needed once it runs.
+func NewSupervisor(c Core, registry *devices.Registry, privateMesh bool, allowed []string, peers []string, relays []string, logger *log.Logger) *Supervisor {
+	s := &Supervisor{
+		core:     c,
+		registry: registry,
+		mode:     ModeAllowList,
+		allowed:  allowed,
+		peers:    parseURIs(peers),
+		relays:   parseURIs(relays),
+		logger:   logger,
+	}
+	switch {
+	case privateMesh:
+		s.mode = ModePrivateMesh
+	case len(allowed) == 0:
+		s.mode = ModeOpen
+	}
+	return s
+}
+
+func parseURIs(uris []string) []*url.URL {
+	var parsed []*url.URL
+	for _, uri := range uris {
+		if u, err := url.Parse(uri); err == nil {
+			parsed = append(parsed, u)
+		}
+	}
+	return parsed
+}
+
+// Mode returns how the allow list of the core is filled.
+func (s *Supervisor) Mode() Mode {
+	return s.mode
+}
+
+// Run connects the relays while no device is peered, until ctx is done.
+func (s *Supervisor) Run(ctx context.Context) error {
+	if s.mode != ModePrivateMesh || len(s.relays) == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		s.check(time.Now())
+		select {
+		case <-ctx.Done():
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.relaysUp {
+				s.setRelays(false)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// check connects the relays if no device is peered, and disconnects them once a device has
+// been peered for relayHold.
+func (s *Supervisor) check(now time.Time) {
+	peered := slices.ContainsFunc(s.core.GetPeers(), func(p core.PeerInfo) bool {
+		_, ok := s.device(p)
+		return ok && p.Up
+	})
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case !peered:
+		s.devicePeered = time.Time{}
+		if !s.relaysUp {
+			s.logger.Infof("No device is peered, connecting to %d relay peers", len(s.relays))
+			s.setRelays(true)
+		}
+	case s.devicePeered.IsZero():
+		s.devicePeered = now
+	case s.relaysUp && now.Sub(s.devicePeered) >= relayHold:
+		s.logger.Infof("A device is peered, disconnecting from the relay peers")
+		s.setRelays(false)
+	}
+}
+
+func (s *Supervisor) setRelays(up bool) {
+	for _, u := range s.relays {
+		var err error
+		if up {
+			err = s.core.AddPeer(u, "")
+		} else {
+			err = s.core.RemovePeer(u, "")
+		}
+		if err != nil {
+			s.logger.Errorf("Failed to update relay peer %s: %v", u, err)
+		}
+	}
+	s.relaysUp, s.relaysSince = up, time.Now()
+}
+
+// device returns the active device a peer is, if any.
+func (s *Supervisor) device(p core.PeerInfo) (devices.Device, bool) {
+	d, ok := s.registry.Lookup(hex.EncodeToString(p.Key))
+	return d, ok && d.PublicKey == hex.EncodeToString(p.Key) && d.IsActive(time.Now())
+}
+
+// reason explains why a peer is allowed. Returns false if nothing allows it.
+func (s *Supervisor) reason(p core.PeerInfo) (string, bool) {
+	key := hex.EncodeToString(p.Key)
+	if d, ok := s.device(p); ok {
+		return "device " + d.Name, true
+	}
+	switch {
+	case !p.Inbound && matches(s.relays, p.URI):
+		return "last-resort relay, no device was peered", true
+	case isLocal(p):
+		return "link-local peering, e.g. multicast, which the allow list doesn't apply to", true
+	case !p.Inbound && matches(s.peers, p.URI):
+		return "configured in Peers, the allow list doesn't apply to outgoing peerings", true
+	case !p.Inbound:
+		return "added at runtime, the allow list doesn't apply to outgoing peerings", true
+	case slices.Contains(s.allowed, key):
+		return "in the allow list the node was started with", true
+	case s.mode == ModeOpen:
+		return "the allow list is empty, any node may peer", true
+	}
+	return "not allowed", false
+}
+
+// matches reports whether a peer URI has the scheme and host of one of uris.
+func matches(uris []*url.URL, uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(uris, func(c *url.URL) bool {
+		return c.Scheme == u.Scheme && c.Host == u.Host
+	})
+}
+
+// isLocal reports whether a peer is connected over a link-local address.
+func isLocal(p core.PeerInfo) bool {
+	u, err := url.Parse(p.URI)
+	if err != nil {
+		return false
+	}
+	host, _, _ := strings.Cut(u.Hostname(), "%")
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLinkLocalUnicast()
+}
@@ -0,0 +1,112 @@
+package peering
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+)
+
+type fakeCore struct {
+	peers []core.PeerInfo
+	added []string
+}
+
+func (c *fakeCore) GetPeers() []core.PeerInfo { return c.peers }
+
+func (c *fakeCore) AddPeer(u *url.URL, _ string) error {
+	c.added = append(c.added, u.String())
+	return nil
+}
+
+func (c *fakeCore) RemovePeer(u *url.URL, _ string) error {
+	for i, added := range c.added {
+		if added == u.String() {
+			c.added = append(c.added[:i], c.added[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func newKey() ed25519.PublicKey {
+	key, _, _ := ed25519.GenerateKey(nil)
+	return key
+}
+
+func TestRelays(t *testing.T) {
+	phoneKey := newKey()
+	registry, _ := devices.NewRegistry([]devices.Device{{Name: "phone", PublicKey: hex.EncodeToString(phoneKey), AddedAt: time.Now()}})
+	c := &fakeCore{}
+	relay := "tls://relay.example.org:443"
+	s := NewSupervisor(c, registry, true, []string{hex.EncodeToString(phoneKey)}, nil, []string{relay}, log.New(io.Discard, "", 0))
+
+	now := time.Now()
+	s.check(now)
+	assert.Equal(t, []string{relay}, c.added, "relays are connected without a device")
+
+	c.peers = []core.PeerInfo{{URI: "tls://10.0.0.2:443", Up: true, Key: phoneKey}}
+	s.check(now.Add(time.Minute))
+	s.check(now.Add(time.Minute + relayHold/2))
+	assert.Equal(t, []string{relay}, c.added, "relays stay until the device has been peered for a while")
+	s.check(now.Add(time.Minute + relayHold))
+	assert.Empty(t, c.added, "relays are disconnected once a device stays peered")
+
+	c.peers = nil
+	s.check(now.Add(time.Minute + 2*relayHold))
+	assert.Equal(t, []string{relay}, c.added, "relays are connected again when the device is gone")
+}
+
+func TestReason(t *testing.T) {
+	phoneKey, strangerKey, allowedKey := newKey(), newKey(), newKey()
+	registry, _ := devices.NewRegistry([]devices.Device{{Name: "phone", PublicKey: hex.EncodeToString(phoneKey), AddedAt: time.Now()}})
+	peers := []core.PeerInfo{
+		{URI: "tls://10.0.0.2:443", Inbound: true, Key: phoneKey},
+		{URI: "tls://relay.example.org:443?key=00", Key: strangerKey},
+		{URI: "tls://[fe80::1%25eth0]:1234", Inbound: true, Key: strangerKey},
+		{URI: "tcp://server.example.org:1234", Key: strangerKey},
+		{URI: "tcp://other.example.org:1234", Key: strangerKey},
+		{URI: "tls://10.0.0.3:443", Inbound: true, Key: allowedKey},
+		{URI: "tls://10.0.0.4:443", Inbound: true, Key: strangerKey},
+	}
+	explain := func(s *Supervisor) []string {
+		var reasons []string
+		for _, p := range peers {
+			reason, allowed := s.reason(p)
+			if !allowed {
+				reason = "!" + reason
+			}
+			reasons = append(reasons, reason)
+		}
+		return reasons
+	}
+
+	s := NewSupervisor(&fakeCore{}, registry, false, []string{hex.EncodeToString(phoneKey), hex.EncodeToString(allowedKey)}, []string{"tcp://server.example.org:1234"}, nil, log.New(io.Discard, "", 0))
+	assert.Equal(t, ModeAllowList, s.Mode())
+	assert.Equal(t, []string{
+		"device phone",
+		"added at runtime, the allow list doesn't apply to outgoing peerings",
+		"link-local peering, e.g. multicast, which the allow list doesn't apply to",
+		"configured in Peers, the allow list doesn't apply to outgoing peerings",
+		"added at runtime, the allow list doesn't apply to outgoing peerings",
+		"in the allow list the node was started with",
+		"!not allowed",
+	}, explain(s))
+
+	s = NewSupervisor(&fakeCore{}, registry, true, []string{hex.EncodeToString(phoneKey)}, nil, []string{"tls://relay.example.org:443"}, log.New(io.Discard, "", 0))
+	assert.Equal(t, ModePrivateMesh, s.Mode())
+	assert.Equal(t, "last-resort relay, no device was peered", explain(s)[1])
+	assert.Equal(t, "!not allowed", explain(s)[5])
+
+	s = NewSupervisor(&fakeCore{}, registry, false, nil, nil, nil, log.New(io.Discard, "", 0))
+	assert.Equal(t, ModeOpen, s.Mode())
+	assert.Equal(t, "the allow list is empty, any node may peer", explain(s)[6])
+}
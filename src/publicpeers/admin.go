@@ -0,0 +1,85 @@
+package publicpeers
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetPublicPeersRequest struct{}
+type GetPublicPeersResponse struct {
+	Count       int              `json:"count"`
+	LastRound   int64            `json:"last_round,omitempty"`
+	SourceError string           `json:"source_error,omitempty"`
+	Peers       []PublicPeerInfo `json:"peers"`
+}
+
+type PublicPeerInfo struct {
+	URI       string        `json:"remote"`
+	Selected  bool          `json:"selected"`
+	Since     int64         `json:"since,omitempty"`
+	Up        bool          `json:"up"`
+	Latency   time.Duration `json:"latency,omitempty"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+func (r *Rotator) getPublicPeersHandler(req *GetPublicPeersRequest, res *GetPublicPeersResponse) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res.Count, res.SourceError = r.count, r.sourceError
+	if !r.lastRound.IsZero() {
+		res.LastRound = r.lastRound.Unix()
+	}
+	for _, p := range r.peers {
+		info := PublicPeerInfo{
+			URI:       p.uri.String(),
+			Selected:  !p.selected.IsZero(),
+			Up:        p.up,
+			LastError: p.lastError,
+		}
+		if p.up {
+			info.Latency = p.latency
+		}
+		if info.Selected {
+			info.Since = p.selected.Unix()
+		}
+		res.Peers = append(res.Peers, info)
+	}
+	// selected peers first, then the fastest candidates
+	slices.SortFunc(res.Peers, func(a, b PublicPeerInfo) int {
+		if a.Selected != b.Selected {
+			if a.Selected {
+				return -1
+			}
+			return 1
+		}
+		if a.Up != b.Up {
+			if a.Up {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(cmp.Compare(a.Latency, b.Latency), cmp.Compare(a.URI, b.URI))
+	})
+	return nil
+}
+
+func (r *Rotator) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getPublicPeers", "Show the public peers picked at runtime and the candidates they were picked from", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetPublicPeersRequest{}
+			res := &GetPublicPeersResponse{Peers: []PublicPeerInfo{}}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := r.getPublicPeersHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
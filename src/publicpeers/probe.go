@@ -0,0 +1,75 @@
+package publicpeers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// defaultPorts are the ports of schemes that work without one.
+var defaultPorts = map[string]string{"ws": "80", "wss": "443"}
+
+// Probe measures the round trip time to a peer URI over its transport.
+type Probe func(ctx context.Context, u *url.URL) (time.Duration, error)
+
+// Supported reports whether peers with the scheme of u can be probed.
+func Supported(u *url.URL) bool {
+	switch u.Scheme {
+	case "tcp", "tls", "quic", "ws", "wss":
+		return true
+	}
+	return false
+}
+
+// ProbeTransport measures the round trip time to a peer by opening a connection to its
+// peering port: a TCP connection for stream transports, which takes one round trip, and a
+// QUIC handshake for QUIC. TLS peers must complete a TLS handshake too, which isn't counted.
+func ProbeTransport(ctx context.Context, u *url.URL) (time.Duration, error) {
+	host := u.Host
+	if u.Port() == "" {
+		port, ok := defaultPorts[u.Scheme]
+		if !ok {
+			return 0, fmt.Errorf("%s has no port", u)
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true, // peers use self-signed certificates
+		ServerName:         u.Hostname(),
+		MinVersion:         tls.VersionTLS12,
+	}
+	if sni := u.Query().Get("sni"); sni != "" {
+		tlsConfig.ServerName = sni
+	}
+	switch u.Scheme {
+	case "quic":
+		start := time.Now()
+		conn, err := quic.DialAddr(ctx, host, tlsConfig, &quic.Config{})
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+		_ = conn.CloseWithError(0, "")
+		return rtt, nil
+	case "tcp", "tls", "ws", "wss":
+		start := time.Now()
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		rtt := time.Since(start)
+		if u.Scheme == "tls" || u.Scheme == "wss" {
+			if err := tls.Client(conn, tlsConfig).HandshakeContext(ctx); err != nil {
+				return 0, err
+			}
+		}
+		return rtt, nil
+	}
+	return 0, fmt.Errorf("can't probe %s peers", u.Scheme)
+}
@@ -0,0 +1,279 @@
+// Package publicpeers keeps a node peered with the fastest public peers at runtime.
+//
+// Candidates come from a fixed list or the public peer index and are re-evaluated every few
+// minutes. Candidates are probed over their transport, selected peers are measured by the
+// latency of their links. A selected peer is swapped out with hysteresis: only once it has
+// been down, or clearly slower than the best candidate, for several rounds in a row.
+package publicpeers
+
+import (
+	"cmp"
+	"context"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+const (
+	rotateInterval = 5 * time.Minute
+	probeTimeout   = 3 * time.Second
+	probeWorkers   = 8
+	// downRounds is how many rounds in a row a selected peer may be down before it is replaced.
+	downRounds = 2
+	// slowerRounds is how many rounds in a row a candidate has to be clearly faster than a
+	// selected peer before it replaces it.
+	slowerRounds = 3
+	// minGain is the least a candidate has to be faster by to count as clearly faster, unless
+	// it is more than a third faster.
+	minGain = 20 * time.Millisecond
+)
+
+// Core is the part of the Yggdrasil core a rotator uses.
+type Core interface {
+	GetPeers() []core.PeerInfo
+	AddPeer(u *url.URL, sintf string) error
+	RemovePeer(u *url.URL, sintf string) error
+}
+
+// peerState is what is known about a candidate or selected peer.
+type peerState struct {
+	uri       *url.URL
+	selected  time.Time // when it was added, zero if it is a candidate
+	up        bool
+	latency   time.Duration // of the link if selected, the probe otherwise
+	lastError string
+	down      int // rounds in a row a selected peer was down
+	slower    int // rounds in a row a selected peer was clearly slower than a candidate
+}
+
+// Rotator keeps count public peers selected from the candidates of a source.
+type Rotator struct {
+	core    Core
+	count   int
+	source  Source
+	exclude []*url.URL // configured peers, which are never selected
+	probe   Probe
+	logger  *log.Logger
+
+	mutex       sync.Mutex
+	peers       map[string]*peerState // by URI
+	lastRound   time.Time
+	sourceError string
+}
+
+// NewRotator creates a rotator that keeps count peers from the candidates of source, except
+// those in exclude, probing the candidates with probe.
+func NewRotator(c Core, count int, source Source, exclude []string, probe Probe, logger *log.Logger) *Rotator {
+	r := &Rotator{
+		core:   c,
+		count:  count,
+		source: source,
+		probe:  probe,
+		logger: logger,
+		peers:  map[string]*peerState{},
+	}
+	for _, uri := range exclude {
+		if u, err := url.Parse(uri); err == nil {
+			r.exclude = append(r.exclude, u)
+		}
+	}
+	return r
+}
+
+// Run re-evaluates the peers until ctx is done, and removes the selected peers then.
+func (r *Rotator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(rotateInterval)
+	defer ticker.Stop()
+	for {
+		r.rotate(ctx)
+		select {
+		case <-ctx.Done():
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			for _, p := range r.peers {
+				if !p.selected.IsZero() {
+					_ = r.core.RemovePeer(p.uri, "")
+				}
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// rotate runs one round: it refreshes the candidates, measures all peers and swaps selected
+// peers that were down or clearly slower than a candidate for long enough.
+func (r *Rotator) rotate(ctx context.Context) {
+	uris, err := r.source(ctx)
+	r.mutex.Lock()
+	r.lastRound, r.sourceError = time.Now(), ""
+	if err != nil {
+		r.sourceError = err.Error()
+		r.logger.Warnf("Public peer candidates: %v", err)
+	}
+	candidates := []*peerState{}
+	seen := map[string]bool{}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || !Supported(u) || seen[u.String()] || slices.ContainsFunc(r.exclude, func(e *url.URL) bool { return sameHost(e, u) }) {
+			continue
+		}
+		seen[u.String()] = true
+		p, ok := r.peers[u.String()]
+		if !ok {
+			p = &peerState{uri: u}
+			r.peers[u.String()] = p
+		}
+		if p.selected.IsZero() {
+			candidates = append(candidates, p)
+		}
+	}
+	for key, p := range r.peers {
+		if !seen[key] && p.selected.IsZero() {
+			delete(r.peers, key) // no longer a candidate
+		}
+	}
+	r.mutex.Unlock()
+
+	results := r.probeAll(ctx, candidates)
+	links := r.core.GetPeers()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, p := range candidates {
+		p.up, p.latency, p.lastError = results[i].err == nil, results[i].latency, ""
+		if results[i].err != nil {
+			p.latency, p.lastError = 0, results[i].err.Error()
+		}
+	}
+	usable := slices.DeleteFunc(slices.Clone(candidates), func(p *peerState) bool { return !p.up })
+	slices.SortFunc(usable, func(a, b *peerState) int { return cmp.Compare(a.latency, b.latency) })
+
+	selected := []*peerState{}
+	for _, p := range r.peers {
+		if !p.selected.IsZero() {
+			selected = append(selected, p)
+		}
+	}
+	slices.SortFunc(selected, func(a, b *peerState) int { return cmp.Compare(b.latency, a.latency) }) // slowest first
+	for _, p := range selected {
+		p.up, p.lastError = false, ""
+		for _, link := range links {
+			if sameHost(p.uri, parse(link.URI)) {
+				p.up = link.Up
+				if link.Up && link.Latency > 0 {
+					p.latency = link.Latency
+				}
+				if link.LastError != nil {
+					p.lastError = link.LastError.Error()
+				}
+			}
+		}
+		if p.up {
+			p.down = 0
+		} else {
+			p.down++
+		}
+		if len(usable) > 0 && p.up && clearlyFaster(usable[0].latency, p.latency) {
+			p.slower++
+		} else {
+			p.slower = 0
+		}
+		switch {
+		case len(usable) == 0:
+			continue
+		case p.down >= downRounds:
+			r.logger.Infof("Replacing public peer %s, which has been down for %d rounds, with %s (%s)", p.uri, p.down, usable[0].uri, usable[0].latency)
+		case p.slower >= slowerRounds:
+			r.logger.Infof("Replacing public peer %s (%s) with %s (%s)", p.uri, p.latency, usable[0].uri, usable[0].latency)
+		default:
+			continue
+		}
+		r.unselect(p)
+		r.selectPeer(usable[0])
+		usable = usable[1:]
+	}
+	for len(usable) > 0 && r.selectedCount() < r.count {
+		r.logger.Infof("Adding public peer %s (%s)", usable[0].uri, usable[0].latency)
+		r.selectPeer(usable[0])
+		usable = usable[1:]
+	}
+}
+
+// clearlyFaster reports whether a candidate latency is better enough than a peer latency.
+func clearlyFaster(candidate, peer time.Duration) bool {
+	gain := peer - candidate
+	return gain > minGain || gain > peer/3
+}
+
+func (r *Rotator) selectedCount() int {
+	n := 0
+	for _, p := range r.peers {
+		if !p.selected.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Rotator) selectPeer(p *peerState) {
+	if err := r.core.AddPeer(p.uri, ""); err != nil {
+		r.logger.Errorf("Failed to add public peer %s: %v", p.uri, err)
+		p.lastError = err.Error()
+		return
+	}
+	p.selected, p.down, p.slower = time.Now(), 0, 0
+}
+
+func (r *Rotator) unselect(p *peerState) {
+	if err := r.core.RemovePeer(p.uri, ""); err != nil {
+		r.logger.Errorf("Failed to remove public peer %s: %v", p.uri, err)
+	}
+	p.selected, p.down, p.slower = time.Time{}, 0, 0
+}
+
+type probeResult struct {
+	latency time.Duration
+	err     error
+}
+
+// probeAll probes the candidates with a few at a time.
+func (r *Rotator) probeAll(ctx context.Context, candidates []*peerState) []probeResult {
+	results := make([]probeResult, len(candidates))
+	uris := make(chan int)
+	var wg sync.WaitGroup
+	for range probeWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range uris {
+				ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+				results[i].latency, results[i].err = r.probe(ctx, candidates[i].uri)
+				cancel()
+			}
+		}()
+	}
+	for i := range candidates {
+		uris <- i
+	}
+	close(uris)
+	wg.Wait()
+	return results
+}
+
+func parse(uri string) *url.URL {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return &url.URL{}
+	}
+	return u
+}
+
+// sameHost reports whether two peer URIs reach the same host over the same transport.
+func sameHost(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host
+}
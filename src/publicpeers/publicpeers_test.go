@@ -0,0 +1,138 @@
+package publicpeers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// fakeCore has a link to every added peer, with the latency in latencies or down without one.
+type fakeCore struct {
+	added     []string
+	latencies map[string]time.Duration
+}
+
+func (c *fakeCore) GetPeers() []core.PeerInfo {
+	var peers []core.PeerInfo
+	for _, uri := range c.added {
+		latency, up := c.latencies[uri]
+		peers = append(peers, core.PeerInfo{URI: uri, Up: up, Latency: latency})
+	}
+	return peers
+}
+
+func (c *fakeCore) AddPeer(u *url.URL, _ string) error {
+	c.added = append(c.added, u.String())
+	return nil
+}
+
+func (c *fakeCore) RemovePeer(u *url.URL, _ string) error {
+	c.added = slices.DeleteFunc(c.added, func(uri string) bool { return uri == u.String() })
+	return nil
+}
+
+// fakeProbe answers with the latency in latencies, or fails without one.
+func fakeProbe(latencies map[string]time.Duration) Probe {
+	return func(_ context.Context, u *url.URL) (time.Duration, error) {
+		if latency, ok := latencies[u.String()]; ok {
+			return latency, nil
+		}
+		return 0, errors.New("connection refused")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	probed := map[string]time.Duration{
+		"tls://a:1":  50 * time.Millisecond,
+		"tls://b:1":  30 * time.Millisecond,
+		"quic://c:1": 60 * time.Millisecond,
+		"tcp://d:1":  10 * time.Millisecond,
+	}
+	c := &fakeCore{latencies: map[string]time.Duration{}}
+	candidates := []string{"tls://a:1", "tls://b:1", "quic://c:1", "tcp://d:1", "unix:///run/e.sock", "tls://down:1"}
+	r := NewRotator(c, 2, List(candidates), []string{"tcp://d:1"}, fakeProbe(probed), log.New(io.Discard, "", 0))
+
+	r.rotate(context.Background())
+	assert.ElementsMatch(t, []string{"tls://b:1", "tls://a:1"}, c.added, "the fastest candidates are picked, except configured peers")
+
+	// links are slower than the probes, c is faster but only clearly so after a few rounds
+	c.latencies["tls://a:1"], c.latencies["tls://b:1"] = 100*time.Millisecond, 40*time.Millisecond
+	for range slowerRounds - 1 {
+		r.rotate(context.Background())
+		assert.ElementsMatch(t, []string{"tls://b:1", "tls://a:1"}, c.added)
+	}
+	r.rotate(context.Background())
+	assert.ElementsMatch(t, []string{"tls://b:1", "quic://c:1"}, c.added, "a is replaced once c has been clearly faster for long enough")
+
+	// b goes down, it is replaced once it stays down
+	c.latencies["quic://c:1"] = 80 * time.Millisecond
+	delete(c.latencies, "tls://b:1")
+	for range downRounds - 1 {
+		r.rotate(context.Background())
+		assert.ElementsMatch(t, []string{"tls://b:1", "quic://c:1"}, c.added)
+	}
+	r.rotate(context.Background())
+	assert.ElementsMatch(t, []string{"tls://a:1", "quic://c:1"}, c.added, "b is replaced once it stays down")
+
+	res := &GetPublicPeersResponse{}
+	assert.NoError(t, r.getPublicPeersHandler(&GetPublicPeersRequest{}, res))
+	var uris []string
+	for _, p := range res.Peers {
+		uris = append(uris, p.URI)
+	}
+	assert.Equal(t, []string{"tls://a:1", "quic://c:1", "tls://b:1", "tls://down:1"}, uris, "selected peers are listed first")
+	assert.Equal(t, "connection refused", res.Peers[3].LastError)
+}
+
+func TestIndexCache(t *testing.T) {
+	dir := t.TempDir()
+	index, cache := filepath.Join(dir, "index.txt"), filepath.Join(dir, "index.txt.peers")
+	if err := os.WriteFile(index, []byte("tls://a:1\ntls://b:1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	source := Index(nil, index, nil, cache)
+	peers, err := source(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tls://a:1", "tls://b:1"}, peers)
+
+	_ = os.Remove(index)
+	peers, err = source(context.Background())
+	assert.ErrorContains(t, err, "using the cached index")
+	assert.Equal(t, []string{"tls://a:1", "tls://b:1"}, peers, "the cached index is used when the index can't be read")
+}
+
+func TestProbeTransport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	rtt, err := ProbeTransport(context.Background(), &url.URL{Scheme: "tcp", Host: ln.Addr().String()})
+	assert.NoError(t, err)
+	assert.Positive(t, rtt)
+
+	_, err = ProbeTransport(context.Background(), &url.URL{Scheme: "tls", Host: ln.Addr().String()})
+	assert.Error(t, err, "a TLS peer has to complete a handshake")
+	_, err = ProbeTransport(context.Background(), &url.URL{Scheme: "unix", Path: "/run/ygg.sock"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package publicpeers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/nermolov/yggdrasil-manager/src/peerindex"
+)
+
+// Source lists the candidate peer URIs. A source may return candidates together with an error,
+// e.g. when they come from a cache because the index couldn't be read.
+type Source func(ctx context.Context) ([]string, error)
+
+// List returns a source of fixed candidates.
+func List(uris []string) Source {
+	return func(context.Context) ([]string, error) {
+		return slices.Clone(uris), nil
+	}
+}
+
+// Index returns a source that reads the peer index at location, an http(s) URL or a local file,
+// and picks the online peers in the sections of countries, or in all sections if there are none.
+// If cacheFile is set, the last index that was read is kept in it and used when the index
+// can't be read.
+func Index(client *http.Client, location string, countries []string, cacheFile string) Source {
+	return func(ctx context.Context) ([]string, error) {
+		data, err := peerindex.Fetch(ctx, client, location)
+		if err != nil {
+			if cacheFile == "" {
+				return nil, err
+			}
+			cached, cacheErr := os.ReadFile(cacheFile)
+			if cacheErr != nil {
+				return nil, err
+			}
+			peers, cacheErr := peerindex.Parse(cached, countries)
+			if cacheErr != nil {
+				return nil, err
+			}
+			return peers, fmt.Errorf("using the cached index: %w", err)
+		}
+		peers, err := peerindex.Parse(data, countries)
+		if err != nil {
+			return nil, err
+		}
+		if cacheFile != "" {
+			if err := os.WriteFile(cacheFile, data, 0600); err != nil {
+				return peers, fmt.Errorf("failed to cache the index: %w", err)
+			}
+		}
+		return peers, nil
+	}
+}
@@ -0,0 +1,71 @@
+package traversal
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type GetTraversalRequest struct{}
+type GetTraversalResponse struct {
+	Endpoint string            `json:"endpoint,omitempty"`
+	Devices  []TraversalDevice `json:"devices"`
+}
+
+type TraversalDevice struct {
+	Name        string `json:"name"`
+	PublicKey   string `json:"key"`
+	State       string `json:"state"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Since       int64  `json:"since,omitempty"`
+	LastAttempt int64  `json:"last_attempt,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+const (
+	StateDirect   = "direct"   // peered over a punched path
+	StatePunching = "punching" // an attempt is running
+	StateRelayed  = "relayed"  // traffic goes through the other peers
+)
+
+func (t *Traverser) getTraversalHandler(req *GetTraversalRequest, res *GetTraversalResponse) error {
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res.Endpoint = t.endpoint
+	for _, d := range t.registry.Devices() {
+		if !d.IsActive(now) {
+			continue
+		}
+		entry := TraversalDevice{Name: d.Name, PublicKey: d.PublicKey, State: StateRelayed}
+		if s, ok := t.devices[d.PublicKey]; ok {
+			switch {
+			case !s.since.IsZero():
+				entry.State, entry.Endpoint, entry.Since = StateDirect, s.endpoint, s.since.Unix()
+			case s.punching:
+				entry.State = StatePunching
+			}
+			entry.LastAttempt, entry.LastError = s.lastAttempt.Unix(), s.lastError
+		}
+		res.Devices = append(res.Devices, entry)
+	}
+	return nil
+}
+
+func (t *Traverser) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"getTraversal", "Show which devices are peered directly through NAT and the last attempt with each", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetTraversalRequest{}
+			res := &GetTraversalResponse{Devices: []TraversalDevice{}}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := t.getTraversalHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
@@ -0,0 +1,166 @@
+package traversal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A minimal STUN (RFC 5389) binding client and server, only used to learn the public endpoint
+// a NAT maps a UDP socket to.
+
+const (
+	stunHeaderSize       = 20
+	stunMagicCookie      = 0x2112a442
+	stunBindingRequest   = 0x0001
+	stunBindingResponse  = 0x0101
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+	stunFamilyIPv4       = 0x01
+	stunFamilyIPv6       = 0x02
+
+	stunRetransmit = 500 * time.Millisecond
+	stunTimeout    = 3 * time.Second
+)
+
+var errNotSTUN = errors.New("not a STUN binding response")
+
+func stunMessage(typ uint16, txID []byte, attrs []byte) []byte {
+	msg := make([]byte, stunHeaderSize, stunHeaderSize+len(attrs))
+	binary.BigEndian.PutUint16(msg[0:], typ)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], txID)
+	return append(msg, attrs...)
+}
+
+// xorAddress encodes or decodes the address of a XOR-MAPPED-ADDRESS attribute.
+func xorAddress(ip net.IP, txID []byte) net.IP {
+	mask := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+	mask = append(mask, txID...)
+	out := make(net.IP, len(ip))
+	for i := range ip {
+		out[i] = ip[i] ^ mask[i]
+	}
+	return out
+}
+
+// parseBindingResponse returns the mapped address of a binding response to the request with txID.
+func parseBindingResponse(msg []byte, txID []byte) (*net.UDPAddr, error) {
+	if len(msg) < stunHeaderSize || binary.BigEndian.Uint16(msg[0:]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie || !bytes.Equal(msg[8:20], txID) {
+		return nil, errNotSTUN
+	}
+	attrs := msg[stunHeaderSize:]
+	if length := int(binary.BigEndian.Uint16(msg[2:])); length <= len(attrs) {
+		attrs = attrs[:length]
+	}
+	var mapped *net.UDPAddr
+	for len(attrs) >= 4 {
+		typ, length := binary.BigEndian.Uint16(attrs[0:]), int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+length {
+			break
+		}
+		value := attrs[4 : 4+length]
+		attrs = attrs[min(len(attrs), 4+(length+3)&^3):]
+		if typ != stunXorMappedAddress && typ != stunMappedAddress || len(value) < 8 {
+			continue
+		}
+		port, ip := binary.BigEndian.Uint16(value[2:]), net.IP(value[4:])
+		switch {
+		case value[1] == stunFamilyIPv4 && len(ip) == net.IPv4len:
+		case value[1] == stunFamilyIPv6 && len(ip) == net.IPv6len:
+		default:
+			continue
+		}
+		if typ == stunXorMappedAddress {
+			// XOR-MAPPED-ADDRESS takes precedence, some NATs rewrite addresses in packets
+			return &net.UDPAddr{IP: xorAddress(ip, txID), Port: int(port ^ stunMagicCookie>>16)}, nil
+		}
+		mapped = &net.UDPAddr{IP: append(net.IP(nil), ip...), Port: int(port)}
+	}
+	if mapped == nil {
+		return nil, errors.New("STUN response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// Discover asks the STUN server at server which public endpoint conn is seen from.
+// Nothing else may read from conn meanwhile.
+func Discover(ctx context.Context, conn net.PacketConn, server string) (*net.UDPAddr, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	txID := make([]byte, 12)
+	_, _ = rand.Read(txID)
+	req := stunMessage(stunBindingRequest, txID, nil)
+	deadline := time.Now().Add(stunTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(req, serverAddr); err != nil {
+			return nil, err
+		}
+		readDeadline := time.Now().Add(stunRetransmit)
+		if deadline.Before(readDeadline) {
+			readDeadline = deadline
+		}
+		_ = conn.SetReadDeadline(readDeadline)
+		for {
+			// responses are matched by transaction ID, multihomed servers may answer from another address
+			n, _, err := conn.ReadFrom(buf)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break // retransmit
+			} else if err != nil {
+				return nil, err
+			}
+			if mapped, err := parseBindingResponse(buf[:n], txID); err == nil {
+				return mapped, nil
+			} else if err != errNotSTUN {
+				return nil, err
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("no response from STUN server %s", server)
+}
+
+// ServeSTUN answers STUN binding requests on conn with the endpoint they came from, until conn
+// is closed. Any node with a public address can serve STUN for devices behind NAT.
+func ServeSTUN(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		msg := buf[:n]
+		udpFrom, ok := from.(*net.UDPAddr)
+		if !ok || len(msg) < stunHeaderSize || binary.BigEndian.Uint16(msg[0:]) != stunBindingRequest ||
+			binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie {
+			continue
+		}
+		txID := msg[8:20]
+		ip, family := udpFrom.IP.To4(), byte(stunFamilyIPv4)
+		if ip == nil {
+			ip, family = udpFrom.IP.To16(), stunFamilyIPv6
+		}
+		attr := binary.BigEndian.AppendUint16(nil, stunXorMappedAddress)
+		attr = binary.BigEndian.AppendUint16(attr, uint16(4+len(ip)))
+		attr = append(attr, 0, family)
+		attr = binary.BigEndian.AppendUint16(attr, uint16(udpFrom.Port)^stunMagicCookie>>16)
+		attr = append(attr, xorAddress(ip, txID)...)
+		_, _ = conn.WriteTo(stunMessage(stunBindingResponse, txID, attr), from)
+	}
+}
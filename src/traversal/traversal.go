@@ -0,0 +1,516 @@
+// Package traversal lets devices behind NAT peer with each other directly instead of through
+// public peers.
+//
+// Two devices that already have a Yggdrasil session swap the public UDP endpoints they learned
+// from a STUN server through the management service, then both send to the endpoint of the other
+// at the same time so that their NATs let the packets of the other side in. If a QUIC connection
+// comes up over the punched path, both sides add a peer for it with core.AddPeer. The core can't
+// peer over a socket it didn't open, so the peer is a local TCP relay into the QUIC connection.
+//
+// Traffic keeps flowing through the existing peers while punching, when it fails and after the
+// direct peering drops, failed attempts are retried with a growing backoff.
+package traversal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/quic-go/quic-go"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// PunchPath is where devices swap endpoints on the management service.
+const PunchPath = "/punch"
+
+const (
+	checkInterval = 30 * time.Second
+	punchTimeout  = 10 * time.Second
+	punchInterval = 200 * time.Millisecond
+	minRetry      = time.Minute
+	maxRetry      = 30 * time.Minute
+	alpn          = "yggdrasil-manager-punch"
+)
+
+// DefaultSTUNServers are used when no STUN servers are configured.
+var DefaultSTUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+// punchPacket is sent to the endpoint of the other side to open the NAT, it isn't a QUIC packet.
+var punchPacket = []byte("\x00yggdrasil-manager punch")
+
+// streamHeader is written by the side that dials as soon as the stream is open, QUIC streams
+// only show up on the other side once something is sent.
+var streamHeader = []byte("yggdrasil-manager peering\n")
+
+// quicConfig keeps the NAT mappings of an idle direct peering alive and notices soon when the
+// punched path breaks.
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:  30 * time.Second,
+	KeepAlivePeriod: 10 * time.Second,
+}
+
+// Core is the part of the Yggdrasil core a traverser uses.
+type Core interface {
+	PublicKey() ed25519.PublicKey
+	AddPeer(u *url.URL, sintf string) error
+	RemovePeer(u *url.URL, sintf string) error
+	GetPeers() []core.PeerInfo
+	GetSessions() []core.SessionInfo
+}
+
+// punchMessage is sent both ways, with the public endpoint of the sender.
+type punchMessage struct {
+	Endpoint string
+}
+
+// deviceState is the direct peering with a device and the outcome of the last attempt.
+type deviceState struct {
+	punching    bool
+	endpoint    string    // public endpoint of the device while directly peered
+	since       time.Time // when the direct peering came up, zero without one
+	lastAttempt time.Time
+	lastError   string
+	failures    int // consecutive failed attempts
+}
+
+// retryAt returns when to try punching again after the last attempt.
+func (s *deviceState) retryAt() time.Time {
+	if s.failures == 0 {
+		return s.lastAttempt
+	}
+	return s.lastAttempt.Add(min(maxRetry, minRetry<<min(s.failures-1, 16)))
+}
+
+// Traverser punches through NAT to the devices this node has a session with. Devices with the
+// lower key start, so both devices of a pair must run a traverser.
+type Traverser struct {
+	core        Core
+	registry    *devices.Registry
+	port        uint16
+	stunServers []string
+	logger      *log.Logger
+	tlsConfig   *tls.Config
+
+	mutex    sync.Mutex
+	ctx      context.Context // of Run, nil until it starts
+	endpoint string          // last public endpoint of this node
+	devices  map[string]*deviceState
+}
+
+// NewTraverser creates a traverser for the devices in registry. It learns its public endpoint
+// from stunServers and reaches the management service on port of the other devices.
+func NewTraverser(c Core, registry *devices.Registry, port uint16, stunServers []string, logger *log.Logger) (*Traverser, error) {
+	tlsConfig, err := generateTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(stunServers) == 0 {
+		stunServers = DefaultSTUNServers
+	}
+	return &Traverser{
+		core:        c,
+		registry:    registry,
+		port:        port,
+		stunServers: stunServers,
+		logger:      logger,
+		tlsConfig:   tlsConfig,
+		devices:     map[string]*deviceState{},
+	}, nil
+}
+
+// generateTLSConfig returns a config with a throwaway certificate. QUIC requires TLS, but the
+// peering on top of it authenticates the other side and is encrypted end to end, so certificates
+// aren't verified.
+func generateTLSConfig() (*tls.Config, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(100 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpn},
+		MinVersion:         tls.VersionTLS13,
+	}, nil
+}
+
+// Run punches through to the devices this node has a session with but no direct peering until
+// ctx is done, using client for the management service. Requests from the other devices are
+// served by mounting the traverser on PunchPath of the management service.
+func (t *Traverser) Run(ctx context.Context, client *http.Client) error {
+	t.mutex.Lock()
+	t.ctx = ctx
+	t.mutex.Unlock()
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		t.punchAll(ctx, client)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// punchAll starts punching through to every active device with a higher key that this node has
+// a session with and isn't peered with, unless an attempt is running or failed recently.
+func (t *Traverser) punchAll(ctx context.Context, client *http.Client) {
+	self := t.core.PublicKey()
+	sessions := map[string]bool{}
+	for _, s := range t.core.GetSessions() {
+		sessions[string(s.Key)] = true
+	}
+	for _, p := range t.core.GetPeers() {
+		if p.Up {
+			delete(sessions, string(p.Key))
+		}
+	}
+	now := time.Now()
+	for _, d := range t.registry.Devices() {
+		key, err := d.Key()
+		if err != nil || !d.IsActive(now) || !sessions[string(key)] || bytes.Compare(self, key) >= 0 {
+			continue
+		}
+		t.mutex.Lock()
+		s := t.devices[d.PublicKey]
+		due := s == nil || !s.punching && s.since.IsZero() && !now.Before(s.retryAt())
+		t.mutex.Unlock()
+		if due {
+			go func() {
+				if err := t.Punch(ctx, client, d); err != nil && ctx.Err() == nil {
+					t.logger.Infof("Failed to punch through to device %s, traffic goes through the other peers: %v", d.Name, err)
+				}
+			}()
+		}
+	}
+}
+
+// start marks an attempt with the device as running. Returns false if one is already running
+// or the device is directly peered.
+func (t *Traverser) start(d devices.Device) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, ok := t.devices[d.PublicKey]
+	if !ok {
+		s = &deviceState{}
+		t.devices[d.PublicKey] = s
+	}
+	if s.punching || !s.since.IsZero() {
+		return false
+	}
+	s.punching, s.lastAttempt = true, time.Now()
+	return true
+}
+
+// finish records the outcome of an attempt with the device.
+func (t *Traverser) finish(d devices.Device, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := t.devices[d.PublicKey]
+	s.punching = false
+	if err != nil {
+		s.lastError = err.Error()
+		s.failures++
+	}
+}
+
+// up records that the device is directly peered at the public endpoint.
+func (t *Traverser) up(d devices.Device, endpoint string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := t.devices[d.PublicKey]
+	s.endpoint, s.since, s.lastError, s.failures = endpoint, time.Now(), "", 0
+}
+
+// closed records that the direct peering with the device went down.
+func (t *Traverser) closed(d devices.Device) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := t.devices[d.PublicKey]
+	s.endpoint, s.since = "", time.Time{}
+}
+
+// listen opens a UDP socket and learns its public endpoint from the first STUN server that answers.
+func (t *Traverser) listen(ctx context.Context) (*net.UDPConn, *net.UDPAddr, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, nil, err
+	}
+	var errs []error
+	for _, server := range t.stunServers {
+		endpoint, err := Discover(ctx, conn, server)
+		if err == nil {
+			t.mutex.Lock()
+			t.endpoint = endpoint.String()
+			t.mutex.Unlock()
+			return conn, endpoint, nil
+		}
+		errs = append(errs, err)
+	}
+	_ = conn.Close()
+	return nil, nil, fmt.Errorf("failed to learn the public endpoint: %w", errors.Join(errs...))
+}
+
+// Punch swaps endpoints with the device over the management service and tries to peer with it
+// directly. The device must run a traverser too.
+func (t *Traverser) Punch(ctx context.Context, client *http.Client, d devices.Device) (err error) {
+	key, err := d.Key()
+	if err != nil {
+		return err
+	}
+	if !t.start(d) {
+		return errors.New("already punching or peered")
+	}
+	defer func() {
+		t.finish(d, err)
+	}()
+	conn, endpoint, err := t.listen(ctx)
+	if err != nil {
+		return err
+	}
+	remote, err := t.exchange(ctx, client, key, endpoint)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	tr := &quic.Transport{Conn: conn}
+	punchCtx, cancel := context.WithTimeout(ctx, punchTimeout)
+	defer cancel()
+	go punch(punchCtx, tr, remote)
+	qc, err := tr.Dial(punchCtx, remote, t.tlsConfig, quicConfig)
+	if err != nil {
+		_ = tr.Close()
+		_ = conn.Close()
+		return fmt.Errorf("no direct path to %s: %w", remote, err)
+	}
+	stream, err := qc.OpenStreamSync(punchCtx)
+	if err == nil {
+		_, err = stream.Write(streamHeader)
+	}
+	if err == nil {
+		err = t.bridge(ctx, d, tr, qc, stream)
+	}
+	if err != nil {
+		_ = qc.CloseWithError(0, "")
+		_ = tr.Close()
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+// exchange sends the public endpoint of this node to the device with the given key and returns its own.
+func (t *Traverser) exchange(ctx context.Context, client *http.Client, key ed25519.PublicKey, endpoint *net.UDPAddr) (*net.UDPAddr, error) {
+	body, err := json.Marshal(punchMessage{Endpoint: endpoint.String()})
+	if err != nil {
+		return nil, err
+	}
+	addr := address.AddrForKey(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, management.URL(net.IP(addr[:]), t.port, PunchPath), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("punching rejected (%d): %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var msg punchMessage
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1024)).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", msg.Endpoint)
+}
+
+func (t *Traverser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller, ok := management.CallerFrom(r.Context())
+	if !ok || !caller.IsDevice {
+		http.Error(w, "not a device of this node", http.StatusForbidden)
+		return
+	}
+	var msg punchMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&msg); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	remote, err := net.ResolveUDPAddr("udp", msg.Endpoint)
+	if err != nil || remote.IP == nil {
+		http.Error(w, "invalid endpoint", http.StatusBadRequest)
+		return
+	}
+	t.mutex.Lock()
+	ctx := t.ctx
+	t.mutex.Unlock()
+	if ctx == nil {
+		http.Error(w, "not running", http.StatusServiceUnavailable)
+		return
+	}
+	d := caller.Device
+	if !t.start(d) {
+		http.Error(w, "already punching or peered", http.StatusConflict)
+		return
+	}
+	conn, endpoint, err := t.listen(r.Context())
+	if err != nil {
+		t.finish(d, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(punchMessage{Endpoint: endpoint.String()})
+	go func() {
+		err := t.accept(ctx, d, conn, remote)
+		t.finish(d, err)
+		if err != nil && ctx.Err() == nil {
+			t.logger.Infof("Failed to punch through to device %s, traffic goes through the other peers: %v", d.Name, err)
+		}
+	}()
+}
+
+// accept punches through to remote and peers with the device when it connects from there.
+func (t *Traverser) accept(ctx context.Context, d devices.Device, conn *net.UDPConn, remote *net.UDPAddr) error {
+	tr := &quic.Transport{Conn: conn}
+	ln, err := tr.Listen(t.tlsConfig, quicConfig)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer ln.Close()
+	punchCtx, cancel := context.WithTimeout(ctx, punchTimeout)
+	defer cancel()
+	go punch(punchCtx, tr, remote)
+	qc, err := ln.Accept(punchCtx)
+	if err != nil {
+		_ = tr.Close()
+		_ = conn.Close()
+		return fmt.Errorf("no direct path to %s: %w", remote, err)
+	}
+	stream, err := qc.AcceptStream(punchCtx)
+	if err == nil {
+		err = readHeader(stream)
+	}
+	if err == nil {
+		err = t.bridge(ctx, d, tr, qc, stream)
+	}
+	if err != nil {
+		_ = qc.CloseWithError(0, "")
+		_ = tr.Close()
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+// readHeader reads the stream header sent by the side that dials.
+func readHeader(stream *quic.Stream) error {
+	_ = stream.SetReadDeadline(time.Now().Add(punchTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+	header := make([]byte, len(streamHeader))
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header, streamHeader) {
+		return errors.New("unexpected stream header")
+	}
+	return nil
+}
+
+// punch sends packets to remote until ctx is done, so that the NAT in front of this node lets
+// the packets from remote in.
+func punch(ctx context.Context, tr *quic.Transport, remote *net.UDPAddr) {
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+	for {
+		_, _ = tr.WriteTo(punchPacket, remote)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// bridge peers with the device through a local TCP relay into stream. The peering is removed
+// and the QUIC connection closed when either side closes or ctx is done.
+func (t *Traverser) bridge(ctx context.Context, d devices.Device, tr *quic.Transport, qc *quic.Conn, stream *quic.Stream) error {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	// the core only accepts the device on the other end
+	u := &url.URL{Scheme: "tcp", Host: ln.Addr().String(), RawQuery: "key=" + d.PublicKey}
+	if err := t.core.AddPeer(u, ""); err != nil {
+		return err
+	}
+	_ = ln.SetDeadline(time.Now().Add(punchTimeout))
+	local, err := ln.Accept()
+	if err != nil {
+		_ = t.core.RemovePeer(u, "")
+		return err
+	}
+	t.up(d, qc.RemoteAddr().String())
+	t.logger.Infof("Peering directly with device %s at %s", d.Name, qc.RemoteAddr())
+	go func() {
+		done := make(chan struct{}, 2)
+		go func() {
+			_, _ = io.Copy(local, stream)
+			done <- struct{}{}
+		}()
+		go func() {
+			_, _ = io.Copy(stream, local)
+			done <- struct{}{}
+		}()
+		select {
+		case <-done:
+		case <-qc.Context().Done():
+		case <-ctx.Done():
+		}
+		_ = t.core.RemovePeer(u, "")
+		_ = local.Close()
+		_ = qc.CloseWithError(0, "")
+		_ = tr.Close()
+		_ = tr.Conn.Close()
+		t.closed(d)
+		t.logger.Infof("Direct peering with device %s closed, traffic goes through the other peers", d.Name)
+	}()
+	return nil
+}
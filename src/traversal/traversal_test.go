@@ -0,0 +1,226 @@
+package traversal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+
+	"github.com/nermolov/yggdrasil-manager/src/devices"
+	"github.com/nermolov/yggdrasil-manager/src/management"
+)
+
+// fakeCore connects to the relay of added peers, standing in for the peering.
+type fakeCore struct {
+	key ed25519.PublicKey
+
+	mutex sync.Mutex
+	peers map[string]net.Conn
+}
+
+func (c *fakeCore) PublicKey() ed25519.PublicKey    { return c.key }
+func (c *fakeCore) GetPeers() []core.PeerInfo       { return nil }
+func (c *fakeCore) GetSessions() []core.SessionInfo { return nil }
+
+func (c *fakeCore) AddPeer(u *url.URL, _ string) error {
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.peers[u.String()] = conn
+	return nil
+}
+
+func (c *fakeCore) RemovePeer(u *url.URL, _ string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if conn, ok := c.peers[u.String()]; ok {
+		_ = conn.Close()
+		delete(c.peers, u.String())
+	}
+	return nil
+}
+
+// peer waits for the only peering of the core.
+func (c *fakeCore) peer(t *testing.T) net.Conn {
+	for range 50 {
+		c.mutex.Lock()
+		for _, conn := range c.peers {
+			c.mutex.Unlock()
+			return conn
+		}
+		c.mutex.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("no peer was added")
+	return nil
+}
+
+func (c *fakeCore) peerCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.peers)
+}
+
+func newTestDevice(name string) (devices.Device, *fakeCore) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	d := devices.Device{Name: name, PublicKey: hex.EncodeToString(pub), AddedAt: time.Now()}
+	return d, &fakeCore{key: pub, peers: map[string]net.Conn{}}
+}
+
+func serveTestSTUN(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() { _ = ServeSTUN(conn) }()
+	return conn.LocalAddr().String()
+}
+
+func TestDiscover(t *testing.T) {
+	server := serveTestSTUN(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	endpoint, err := Discover(context.Background(), conn, server)
+	if assert.NoError(t, err) {
+		assert.Equal(t, conn.LocalAddr().String(), endpoint.String())
+	}
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = Discover(ctx, conn, silent.LocalAddr().String())
+	assert.Error(t, err)
+}
+
+func TestParseBindingResponse(t *testing.T) {
+	txID := []byte("0123456789ab")
+	// MAPPED-ADDRESS of 192.0.2.1:32853, as sent by old servers
+	attr := []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x80, 0x55, 192, 0, 2, 1}
+	endpoint, err := parseBindingResponse(stunMessage(stunBindingResponse, txID, attr), txID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:32853", endpoint.String())
+	}
+	_, err = parseBindingResponse(stunMessage(stunBindingResponse, []byte("other request"), attr), txID)
+	assert.ErrorIs(t, err, errNotSTUN)
+	_, err = parseBindingResponse(stunMessage(stunBindingResponse, txID, nil), txID)
+	assert.Error(t, err)
+}
+
+func TestRetryAt(t *testing.T) {
+	now := time.Now()
+	s := &deviceState{lastAttempt: now}
+	assert.Equal(t, now, s.retryAt())
+	s.failures = 1
+	assert.Equal(t, now.Add(minRetry), s.retryAt())
+	s.failures = 3
+	assert.Equal(t, now.Add(4*minRetry), s.retryAt())
+	s.failures = 100
+	assert.Equal(t, now.Add(maxRetry), s.retryAt())
+}
+
+// TestPunch punches from laptop to phone on loopback, where there is no NAT in between, and
+// checks that the peering added on both sides is connected through the QUIC connection.
+func TestPunch(t *testing.T) {
+	laptop, laptopCore := newTestDevice("laptop")
+	phone, phoneCore := newTestDevice("phone")
+	stun := serveTestSTUN(t)
+	logger := log.New(io.Discard, "", 0)
+	laptopRegistry, _ := devices.NewRegistry([]devices.Device{phone})
+	phoneRegistry, _ := devices.NewRegistry([]devices.Device{laptop})
+	laptopTraverser, err := NewTraverser(laptopCore, laptopRegistry, management.DefaultPort, []string{stun}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phoneTraverser, err := NewTraverser(phoneCore, phoneRegistry, management.DefaultPort, []string{stun}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the management service of phone, receiving requests from the address of laptop
+	server := management.NewServer(management.DefaultPort, func(addr address.Address) management.Caller {
+		d, ok := phoneRegistry.LookupAddress(addr)
+		return management.Caller{Address: addr, Device: d, IsDevice: ok}
+	})
+	laptopKey, _ := laptop.Key()
+	laptopAddr := address.AddrForKey(laptopKey)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = net.JoinHostPort(net.IP(laptopAddr[:]).String(), "40000")
+		server.ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, httpServer.Listener.Addr().String())
+		},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	phoneCtx, phoneCancel := context.WithCancel(context.Background())
+	defer phoneCancel()
+	phoneTraverser.ctx = phoneCtx
+
+	state := func(tr *Traverser, name string) TraversalDevice {
+		res := &GetTraversalResponse{}
+		assert.NoError(t, tr.getTraversalHandler(&GetTraversalRequest{}, res))
+		for _, d := range res.Devices {
+			if d.Name == name {
+				return d
+			}
+		}
+		return TraversalDevice{}
+	}
+
+	assert.Error(t, laptopTraverser.Punch(ctx, client, phone), "phone doesn't run a traverser yet")
+	assert.Equal(t, StateRelayed, state(laptopTraverser, "phone").State)
+	assert.NotEmpty(t, state(laptopTraverser, "phone").LastError)
+
+	server.Handle(PunchPath, management.Devices, phoneTraverser)
+	if !assert.NoError(t, laptopTraverser.Punch(ctx, client, phone)) {
+		return
+	}
+	assert.Error(t, laptopTraverser.Punch(ctx, client, phone), "already peered")
+	laptopConn, phoneConn := laptopCore.peer(t), phoneCore.peer(t)
+	_, err = laptopConn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_ = phoneConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(phoneConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	assert.Equal(t, StateDirect, state(laptopTraverser, "phone").State)
+	assert.Empty(t, state(laptopTraverser, "phone").LastError)
+	assert.Equal(t, StateDirect, state(phoneTraverser, "laptop").State)
+	assert.NotEmpty(t, state(phoneTraverser, "laptop").Endpoint)
+
+	// closing one side removes the peering on both
+	cancel()
+	assert.Eventually(t, func() bool {
+		return laptopCore.peerCount() == 0 && phoneCore.peerCount() == 0 &&
+			state(laptopTraverser, "phone").State == StateRelayed && state(phoneTraverser, "laptop").State == StateRelayed
+	}, 5*time.Second, 100*time.Millisecond)
+}